@@ -0,0 +1,199 @@
+package nds
+
+import (
+	"reflect"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+var batcherKey = "used for *batcher"
+
+// batcher coalesces the Get and GetMulti calls made through a context
+// returned by WithBatcher.
+type batcher struct {
+	sync.Mutex
+	c      context.Context
+	opts   batchOptions
+	window time.Duration
+	limit  int
+
+	// current is the batch that calls are added to, or nil if there are no
+	// calls waiting.
+	current *batch
+}
+
+// batchOptions are the values of a context that change how its calls get
+// entities. Only calls whose contexts have the same options as the batcher's
+// are batched.
+type batchOptions struct {
+	client, config, policy, contextCache interface{}
+}
+
+func batchOptionsFromContext(c context.Context) batchOptions {
+	return batchOptions{
+		client:       c.Value(&clientKey),
+		config:       c.Value(&configKey),
+		policy:       c.Value(&policyKey),
+		contextCache: c.Value(&contextCacheKey),
+	}
+}
+
+// batch is a set of keys that are got together.
+type batch struct {
+	keys  []*datastore.Key
+	index map[string]int
+	calls int
+
+	pls  []datastore.PropertyList
+	errs []error
+	done chan struct{}
+}
+
+// WithBatcher returns a context that coalesces the Get and GetMulti calls
+// made through it, for example by concurrent resolvers each getting a single
+// entity, into single calls. Calls are collected for window after the first
+// of them and then their keys, without duplicates, are got together. Each
+// call then returns its own entities and errors. A batch is also got as soon
+// as it holds the Config's GetMultiLimit keys.
+//
+// If window is not positive batches are only got when they are full or
+// FlushBatcher is called, so a call waits until then or until its context is
+// done, when it returns the context's error.
+//
+// Batches are got with c. Calls made with contexts derived from the returned
+// context that use a different Client, Config, Policy or context cache than c,
+// for example through WithConfig, WithPolicy, WithContextCache or
+// Client.Context, are not batched and neither are calls within transactions.
+// The returned context should be created at the start of each request and
+// discarded at the end of it.
+func WithBatcher(c context.Context, window time.Duration) context.Context {
+	b := &batcher{
+		// Batches themselves are not batched.
+		c:      context.WithValue(c, &batcherKey, (*batcher)(nil)),
+		opts:   batchOptionsFromContext(c),
+		window: window,
+		limit:  configFromContext(c).getMultiLimit(),
+	}
+	return context.WithValue(c, &batcherKey, b)
+}
+
+// FlushBatcher immediately gets the keys of the Get and GetMulti calls
+// waiting in c's batcher, if it has one.
+func FlushBatcher(c context.Context) {
+	if b, ok := batcherFromContext(c); ok {
+		b.flush(nil)
+	}
+}
+
+func batcherFromContext(c context.Context) (*batcher, bool) {
+	b, ok := c.Value(&batcherKey).(*batcher)
+	return b, ok && b != nil
+}
+
+// batches reports whether calls made with c are batched by b.
+func (b *batcher) batches(c context.Context) bool {
+	if _, ok := transactionFromContext(c); ok {
+		return false
+	}
+	return batchOptionsFromContext(c) == b.opts
+}
+
+// add adds keys to the current batch and returns it along with the index of
+// each key in it.
+func (b *batcher) add(keys []*datastore.Key) (*batch, []int) {
+	b.Lock()
+	bt := b.current
+	if bt == nil {
+		bt = &batch{
+			index: map[string]int{},
+			done:  make(chan struct{}),
+		}
+		b.current = bt
+		if b.window > 0 {
+			time.AfterFunc(b.window, func() {
+				b.flush(bt)
+			})
+		}
+	}
+
+	indexes := make([]int, len(keys))
+	for i, key := range keys {
+		encoded := key.Encode()
+		j, ok := bt.index[encoded]
+		if !ok {
+			j = len(bt.keys)
+			bt.index[encoded] = j
+			bt.keys = append(bt.keys, key)
+		}
+		indexes[i] = j
+	}
+	bt.calls++
+	full := len(bt.keys) >= b.limit
+	b.Unlock()
+
+	if full {
+		b.flush(bt)
+	}
+	return bt, indexes
+}
+
+// flush gets the keys of bt, if it is still the current batch, or of the
+// current batch if bt is nil.
+func (b *batcher) flush(bt *batch) {
+	b.Lock()
+	if b.current == nil || (bt != nil && b.current != bt) {
+		b.Unlock()
+		return
+	}
+	bt, b.current = b.current, nil
+	b.Unlock()
+
+	bt.pls = make([]datastore.PropertyList, len(bt.keys))
+	bt.errs = make([]error, len(bt.keys))
+	err := GetMulti(b.c, bt.keys, bt.pls)
+	if me, ok := err.(appengine.MultiError); ok {
+		copy(bt.errs, me)
+	} else if err != nil {
+		for i := range bt.errs {
+			bt.errs[i] = err
+		}
+	}
+	close(bt.done)
+}
+
+// getMulti adds keys to the current batch and loads their entities into
+// vals once it has been got, or returns c's error if c is done first.
+func (b *batcher) getMulti(c context.Context, keys []*datastore.Key,
+	vals reflect.Value) error {
+
+	bt, indexes := b.add(keys)
+	select {
+	case <-bt.done:
+	case <-c.Done():
+		return c.Err()
+	}
+
+	me, errsNil := make(appengine.MultiError, len(keys)), true
+	for i, j := range indexes {
+		if err := bt.errs[j]; err != nil {
+			me[i] = err
+			errsNil = false
+			continue
+		}
+		// Calls for the same key must not share properties.
+		pl := append(datastore.PropertyList{}, bt.pls[j]...)
+		if err := setValue(vals.Index(i), pl); err != nil {
+			me[i] = err
+			errsNil = false
+		}
+	}
+
+	if errsNil {
+		return nil
+	}
+	return me
+}
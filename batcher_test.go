@@ -0,0 +1,149 @@
+package nds_test
+
+import (
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/qedus/nds"
+	"github.com/qedus/nds/ndstest"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestBatcher(t *testing.T) {
+	d := &countingDatastore{Datastore: ndstest.NewDatastore()}
+	ndstest.Install(t, d, ndstest.NewCache())
+	c := nds.WithBatcher(context.Background(), 0)
+
+	keys := make([]*datastore.Key, 5)
+	entities := make([]textEntity, len(keys))
+	for i := range keys {
+		keys[i] = datastore.NewKey(c, "Entity", "", int64(i+1), nil)
+		entities[i].Text = string(rune('a' + i))
+	}
+	if _, err := nds.PutMulti(c, keys, entities); err != nil {
+		t.Fatal(err)
+	}
+	missingKey := datastore.NewKey(c, "Entity", "", 100, nil)
+
+	// Each key is got by two calls, as well as a GetMulti of all of them.
+	var wg sync.WaitGroup
+	errs := make([]error, 2*len(keys)+1)
+	got := make([]textEntity, 2*len(keys))
+	for i := range got {
+		wg.Add(1)
+		go func(i int) {
+			errs[i] = nds.Get(c, keys[i%len(keys)], &got[i])
+			wg.Done()
+		}(i)
+	}
+	wg.Add(1)
+	go func() {
+		errs[len(got)] = nds.GetMulti(c, append(keys, missingKey),
+			make([]textEntity, len(keys)+1))
+		wg.Done()
+	}()
+
+	for nds.BatcherCalls(c) < len(errs) {
+		runtime.Gosched()
+	}
+	nds.FlushBatcher(c)
+	wg.Wait()
+
+	for i, err := range errs[:len(got)] {
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got[i] != entities[i%len(keys)] {
+			t.Fatal("incorrect entity", got[i])
+		}
+	}
+	me, ok := errs[len(got)].(appengine.MultiError)
+	if !ok || me[len(keys)] != datastore.ErrNoSuchEntity {
+		t.Fatal("expected ErrNoSuchEntity", errs[len(got)])
+	}
+
+	// The keys were got once, together.
+	if d.gets != len(keys)+1 || d.maxGets != len(keys)+1 {
+		t.Fatal("incorrect gets", d.gets, d.maxGets)
+	}
+}
+
+func TestBatcherWindow(t *testing.T) {
+	ndstest.NewContext(t)
+	c := nds.WithBatcher(context.Background(), time.Millisecond)
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(c, key, &textEntity{"text"}); err != nil {
+		t.Fatal(err)
+	}
+	entity := &textEntity{}
+	if err := nds.Get(c, key, entity); err != nil {
+		t.Fatal(err)
+	}
+	if entity.Text != "text" {
+		t.Fatal("incorrect entity", entity)
+	}
+}
+
+func TestBatcherOptions(t *testing.T) {
+	d := ndstest.NewDatastore()
+	ndstest.Install(t, d, ndstest.NewCache())
+	bc := nds.WithBatcher(context.Background(), 0)
+	key := datastore.NewKey(bc, "Entity", "", 1, nil)
+	if _, err := nds.Put(bc, key, &textEntity{"default"}); err != nil {
+		t.Fatal(err)
+	}
+
+	cl := nds.NewClient(ndstest.NewDatastore(), ndstest.NewCache(),
+		nds.Config{Logger: testLogger(t)})
+	if _, err := cl.Put(bc, key, &textEntity{"client"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Calls with different options are not batched so they return without
+	// the batcher being flushed.
+	for _, test := range []struct {
+		c    context.Context
+		get  func(context.Context, *datastore.Key, interface{}) error
+		text string
+	}{
+		{bc, cl.Get, "client"},
+		{cl.Context(bc), nds.Get, "client"},
+		{nds.WithConfig(bc, nds.Config{LockTime: time.Second}), nds.Get,
+			"default"},
+		{nds.WithPolicy(bc, nds.BypassCache), nds.Get, "default"},
+		{nds.WithContextCache(bc), nds.Get, "default"},
+	} {
+		c, cancel := context.WithTimeout(test.c, time.Second)
+		entity := &textEntity{}
+		err := test.get(c, key, entity)
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entity.Text != test.text {
+			t.Fatal("incorrect entity", entity)
+		}
+	}
+	if calls := nds.BatcherCalls(bc); calls != 0 {
+		t.Fatal("incorrect batcher calls", calls)
+	}
+}
+
+func TestBatcherContextDone(t *testing.T) {
+	ndstest.NewContext(t)
+	bc := nds.WithBatcher(context.Background(), 0)
+	key := datastore.NewKey(bc, "Entity", "", 1, nil)
+
+	// A lone call waits for the batcher to be flushed or its context to be
+	// done.
+	c, cancel := context.WithTimeout(bc, 10*time.Millisecond)
+	defer cancel()
+	if err := nds.Get(c, key, &textEntity{}); err != context.DeadlineExceeded {
+		t.Fatal("expected context.DeadlineExceeded", err)
+	}
+}
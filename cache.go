@@ -0,0 +1,87 @@
+package nds
+
+import (
+	"errors"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+var (
+	// ErrNotStored is returned by a Cache when an item was not stored because
+	// a condition was not met, for example an AddMulti of an existing key or a
+	// CompareAndSwapMulti of a key that has since been evicted.
+	ErrNotStored = errors.New("nds: item not stored")
+
+	// ErrCASConflict is returned by Cache.CompareAndSwapMulti when an item has
+	// been modified since it was retrieved.
+	ErrCASConflict = errors.New("nds: compare-and-swap conflict")
+)
+
+// Item is the unit of Cache gets and sets.
+type Item struct {
+	// Key is the cache key, at most 250 bytes long.
+	Key string
+
+	// Value is the item's value.
+	Value []byte
+
+	// Flags are opaque to the Cache and are used by nds to determine whether
+	// an item holds an entity, a missing entity marker or a lock.
+	Flags uint32
+
+	// Expiration is the maximum duration the item will live in the cache. The
+	// zero value means the item has no expiration time.
+	Expiration time.Duration
+
+	// CAS is an opaque compare-and-swap token set by Cache.GetMulti. It is
+	// used by Cache.CompareAndSwapMulti to determine whether the item has
+	// been modified since it was retrieved. nds never inspects it.
+	CAS interface{}
+}
+
+// Cache is the interface nds uses to cache entities. The caching strategy
+// relies on each method having the same semantics as its App Engine memcache
+// equivalent. In particular AddMulti must only store items whose keys are not
+// already present, and CompareAndSwapMulti must only store items that have
+// not been modified or evicted since they were retrieved by GetMulti.
+//
+// Methods that operate on multiple items should return an
+// appengine.MultiError, containing ErrNotStored or ErrCASConflict where
+// appropriate, if only some of the items could be stored.
+type Cache interface {
+	// NewContext is called once per nds call before any other Cache method
+	// and allows the Cache to scope the context, for example to a namespace.
+	// The returned context must be derived from c.
+	NewContext(c context.Context) (context.Context, error)
+
+	// GetMulti returns the items for the given keys. Missing keys are not
+	// included in the returned map.
+	GetMulti(c context.Context, keys []string) (map[string]*Item, error)
+
+	// AddMulti writes items to the cache only if their keys are not already
+	// present.
+	AddMulti(c context.Context, items []*Item) error
+
+	// SetMulti unconditionally writes items to the cache.
+	SetMulti(c context.Context, items []*Item) error
+
+	// CompareAndSwapMulti writes items that were previously returned by
+	// GetMulti only if they have not been modified or evicted since.
+	CompareAndSwapMulti(c context.Context, items []*Item) error
+
+	// DeleteMulti removes items from the cache. Missing keys should not be
+	// reported as errors.
+	DeleteMulti(c context.Context, keys []string) error
+}
+
+// SetCache sets the Cache of the default Client, which is used by nds calls
+// whose contexts have no Client. By default, or if c is nil, App Engine
+// memcache is used. SetCache is not safe to call concurrently with other nds
+// functions and should therefore be called during program initialization.
+func SetCache(c Cache) {
+	if c == nil {
+		c = memcacheCache{}
+	}
+	defaultClient.cache = c
+}
@@ -0,0 +1,186 @@
+package nds_test
+
+import (
+	"bytes"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/qedus/nds"
+	"github.com/qedus/nds/ndstest"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+// mapCache is a minimal nds.Cache used to check that nds only relies on the
+// Cache interface.
+type mapCache struct {
+	sync.Mutex
+	items map[string]nds.Item
+	calls map[string]int
+}
+
+func newMapCache() *mapCache {
+	return &mapCache{
+		items: map[string]nds.Item{},
+		calls: map[string]int{},
+	}
+}
+
+func (m *mapCache) NewContext(c context.Context) (context.Context, error) {
+	return c, nil
+}
+
+func (m *mapCache) GetMulti(c context.Context,
+	keys []string) (map[string]*nds.Item, error) {
+	m.Lock()
+	defer m.Unlock()
+	m.calls["GetMulti"]++
+
+	items := map[string]*nds.Item{}
+	for _, key := range keys {
+		if item, ok := m.items[key]; ok {
+			item.CAS = string(item.Value)
+			items[key] = &item
+		}
+	}
+	return items, nil
+}
+
+func (m *mapCache) AddMulti(c context.Context, items []*nds.Item) error {
+	m.Lock()
+	defer m.Unlock()
+	m.calls["AddMulti"]++
+
+	me, errsNil := make(appengine.MultiError, len(items)), true
+	for i, item := range items {
+		if _, ok := m.items[item.Key]; ok {
+			me[i] = nds.ErrNotStored
+			errsNil = false
+			continue
+		}
+		m.items[item.Key] = *item
+	}
+	if errsNil {
+		return nil
+	}
+	return me
+}
+
+func (m *mapCache) SetMulti(c context.Context, items []*nds.Item) error {
+	m.Lock()
+	defer m.Unlock()
+	m.calls["SetMulti"]++
+
+	for _, item := range items {
+		m.items[item.Key] = *item
+	}
+	return nil
+}
+
+func (m *mapCache) CompareAndSwapMulti(c context.Context,
+	items []*nds.Item) error {
+	m.Lock()
+	defer m.Unlock()
+	m.calls["CompareAndSwapMulti"]++
+
+	me, errsNil := make(appengine.MultiError, len(items)), true
+	for i, item := range items {
+		current, ok := m.items[item.Key]
+		if !ok {
+			me[i] = nds.ErrNotStored
+			errsNil = false
+		} else if cas, _ := item.CAS.(string); !bytes.Equal(
+			current.Value, []byte(cas)) {
+			me[i] = nds.ErrCASConflict
+			errsNil = false
+		} else {
+			m.items[item.Key] = *item
+		}
+	}
+	if errsNil {
+		return nil
+	}
+	return me
+}
+
+func (m *mapCache) DeleteMulti(c context.Context, keys []string) error {
+	m.Lock()
+	defer m.Unlock()
+	m.calls["DeleteMulti"]++
+
+	for _, key := range keys {
+		delete(m.items, key)
+	}
+	return nil
+}
+
+func TestSetCache(t *testing.T) {
+	d, cache := ndstest.NewDatastore(), newMapCache()
+	ndstest.Install(t, d, cache)
+	c := context.Background()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	keys := []*datastore.Key{}
+	entities := []testEntity{}
+	for i := 0; i < 3; i++ {
+		keys = append(keys,
+			datastore.NewKey(c, "Entity", strconv.Itoa(i), 0, nil))
+		entities = append(entities, testEntity{i})
+	}
+
+	if _, err := nds.PutMulti(c, keys, entities); err != nil {
+		t.Fatal(err)
+	}
+
+	// Lock, get from datastore and save to cache.
+	response := make([]testEntity, len(keys))
+	if err := nds.GetMulti(c, keys, response); err != nil {
+		t.Fatal(err)
+	}
+
+	// The entities are cached along with the epochs of their kind and
+	// namespace.
+	entityItems := 0
+	for _, item := range cache.items {
+		if item.Flags&nds.ItemTypeMask == nds.EntityItem {
+			entityItems++
+		}
+	}
+	if entityItems != len(keys) || len(cache.items) != len(keys)+2 {
+		t.Fatal("expected items in cache", entityItems, len(cache.items))
+	}
+
+	// Get from cache only.
+	if err := d.DeleteMulti(c, keys); err != nil {
+		t.Fatal(err)
+	}
+
+	response = make([]testEntity, len(keys))
+	if err := nds.GetMulti(c, keys, response); err != nil {
+		t.Fatal(err)
+	}
+	for i := range response {
+		if response[i].IntVal != i {
+			t.Fatal("incorrect IntVal")
+		}
+	}
+
+	if cache.calls["CompareAndSwapMulti"] == 0 {
+		t.Fatal("expected CompareAndSwapMulti call")
+	}
+
+	// Locks should have been written for the delete.
+	if err := nds.DeleteMulti(c, keys); err != nil {
+		t.Fatal(err)
+	}
+	for _, item := range cache.items {
+		if item.Flags&nds.ItemTypeMask == nds.EntityItem {
+			t.Fatal("expected locked item")
+		}
+	}
+}
@@ -0,0 +1,266 @@
+// Package redis provides an nds.Cache that stores entities in Redis.
+//
+// Redis has no direct equivalent of memcache flags or compare-and-swap
+// tokens, so items are stored as a four byte big endian flags header followed
+// by the item value. AddMulti uses SET NX PX and CompareAndSwapMulti uses a
+// Lua script that only replaces a value if it is byte for byte identical to
+// the one returned by GetMulti. As nds lock values are pseudorandom this gives
+// the same guarantees that nds relies upon from memcache.
+package redis
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/qedus/nds"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+)
+
+// flagsSize is the number of bytes used to store item flags before the value.
+const flagsSize = 4
+
+// casScript atomically replaces KEYS[1] with ARGV[2] only if its current value
+// is ARGV[1]. ARGV[3] is the expiration in milliseconds, zero meaning none.
+// It returns 1 if the value was swapped, 0 if the value had been modified and
+// -1 if the key no longer exists.
+var casScript = redis.NewScript(1, `
+local current = redis.call('GET', KEYS[1])
+if not current then
+	return -1
+end
+if current ~= ARGV[1] then
+	return 0
+end
+if ARGV[3] == '0' then
+	redis.call('SET', KEYS[1], ARGV[2])
+else
+	redis.call('SET', KEYS[1], ARGV[2], 'PX', ARGV[3])
+end
+return 1
+`)
+
+// Pool is the subset of *redis.Pool used by Cache.
+type Pool interface {
+	GetContext(c context.Context) (redis.Conn, error)
+}
+
+// Cache is an nds.Cache backed by Redis.
+type Cache struct {
+	pool Pool
+}
+
+var _ nds.Cache = (*Cache)(nil)
+
+// NewCache returns a Cache that uses connections from pool.
+func NewCache(pool Pool) *Cache {
+	return &Cache{pool: pool}
+}
+
+// NewContext returns c unchanged.
+func (rc *Cache) NewContext(c context.Context) (context.Context, error) {
+	return c, nil
+}
+
+// GetMulti returns the items for the given keys using MGET.
+func (rc *Cache) GetMulti(c context.Context,
+	keys []string) (map[string]*nds.Item, error) {
+
+	if len(keys) == 0 {
+		return map[string]*nds.Item{}, nil
+	}
+
+	conn, err := rc.pool.GetContext(c)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	args := make([]interface{}, len(keys))
+	for i, key := range keys {
+		args[i] = key
+	}
+
+	values, err := redis.ByteSlices(conn.Do("MGET", args...))
+	if err != nil {
+		return nil, err
+	}
+
+	items := make(map[string]*nds.Item, len(keys))
+	for i, value := range values {
+		if value == nil {
+			continue
+		}
+		item, err := decodeItem(keys[i], value)
+		if err != nil {
+			return nil, err
+		}
+		items[keys[i]] = item
+	}
+	return items, nil
+}
+
+// AddMulti stores items using SET NX so existing keys are not overwritten.
+func (rc *Cache) AddMulti(c context.Context, items []*nds.Item) error {
+	return rc.setMulti(c, items, true)
+}
+
+// SetMulti unconditionally stores items using SET.
+func (rc *Cache) SetMulti(c context.Context, items []*nds.Item) error {
+	return rc.setMulti(c, items, false)
+}
+
+func (rc *Cache) setMulti(c context.Context,
+	items []*nds.Item, nx bool) error {
+
+	if len(items) == 0 {
+		return nil
+	}
+
+	conn, err := rc.pool.GetContext(c)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	for _, item := range items {
+		args := []interface{}{item.Key, encodeItem(item)}
+		if nx {
+			args = append(args, "NX")
+		}
+		if ms := milliseconds(item.Expiration); ms > 0 {
+			args = append(args, "PX", ms)
+		}
+		if err := conn.Send("SET", args...); err != nil {
+			return err
+		}
+	}
+	if err := conn.Flush(); err != nil {
+		return err
+	}
+
+	me, errsNil := make(appengine.MultiError, len(items)), true
+	for i := range items {
+		reply, err := conn.Receive()
+		if err != nil {
+			me[i] = err
+			errsNil = false
+		} else if reply == nil {
+			me[i] = nds.ErrNotStored
+			errsNil = false
+		}
+	}
+
+	if errsNil {
+		return nil
+	}
+	return me
+}
+
+// CompareAndSwapMulti stores items only if their values have not changed
+// since they were returned by GetMulti.
+func (rc *Cache) CompareAndSwapMulti(c context.Context,
+	items []*nds.Item) error {
+
+	if len(items) == 0 {
+		return nil
+	}
+
+	conn, err := rc.pool.GetContext(c)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	me, errsNil := make(appengine.MultiError, len(items)), true
+	sent := make([]bool, len(items))
+	for i, item := range items {
+		old, ok := item.CAS.([]byte)
+		if !ok {
+			me[i] = errors.New("redis: item not retrieved by GetMulti")
+			errsNil = false
+			continue
+		}
+		if err := casScript.Send(conn, item.Key, old, encodeItem(item),
+			milliseconds(item.Expiration)); err != nil {
+			return err
+		}
+		sent[i] = true
+	}
+	if err := conn.Flush(); err != nil {
+		return err
+	}
+
+	for i := range items {
+		if !sent[i] {
+			continue
+		}
+		result, err := redis.Int(conn.Receive())
+		switch {
+		case err != nil:
+			me[i] = err
+		case result == 0:
+			me[i] = nds.ErrCASConflict
+		case result < 0:
+			me[i] = nds.ErrNotStored
+		default:
+			continue
+		}
+		errsNil = false
+	}
+
+	if errsNil {
+		return nil
+	}
+	return me
+}
+
+// DeleteMulti removes keys using DEL.
+func (rc *Cache) DeleteMulti(c context.Context, keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	conn, err := rc.pool.GetContext(c)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	args := make([]interface{}, len(keys))
+	for i, key := range keys {
+		args[i] = key
+	}
+	_, err = conn.Do("DEL", args...)
+	return err
+}
+
+func encodeItem(item *nds.Item) []byte {
+	data := make([]byte, flagsSize+len(item.Value))
+	binary.BigEndian.PutUint32(data, item.Flags)
+	copy(data[flagsSize:], item.Value)
+	return data
+}
+
+func decodeItem(key string, data []byte) (*nds.Item, error) {
+	if len(data) < flagsSize {
+		return nil, errors.New("redis: item too short")
+	}
+	return &nds.Item{
+		Key:   key,
+		Value: data[flagsSize:],
+		Flags: binary.BigEndian.Uint32(data),
+		CAS:   data,
+	}, nil
+}
+
+// milliseconds converts an expiration into Redis PX milliseconds, rounding up
+// so that short non zero expirations do not become permanent.
+func milliseconds(d time.Duration) int64 {
+	if d <= 0 {
+		return 0
+	}
+	return int64((d + time.Millisecond - 1) / time.Millisecond)
+}
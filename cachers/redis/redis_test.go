@@ -0,0 +1,205 @@
+package redis_test
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	redigo "github.com/gomodule/redigo/redis"
+	"github.com/qedus/nds"
+	"github.com/qedus/nds/cachers/redis"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+)
+
+func newCache(t *testing.T) (*redis.Cache, *miniredis.Miniredis) {
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+
+	pool := &redigo.Pool{
+		Dial: func() (redigo.Conn, error) {
+			return redigo.Dial("tcp", s.Addr())
+		},
+	}
+	t.Cleanup(func() { pool.Close() })
+
+	return redis.NewCache(pool), s
+}
+
+func TestAddMulti(t *testing.T) {
+	cache, _ := newCache(t)
+	c := context.Background()
+
+	items := []*nds.Item{
+		{Key: "one", Value: []byte("1"), Flags: 1},
+		{Key: "two", Value: []byte("2"), Flags: 2},
+	}
+	if err := cache.AddMulti(c, items); err != nil {
+		t.Fatal(err)
+	}
+
+	items = []*nds.Item{
+		{Key: "one", Value: []byte("one"), Flags: 3},
+		{Key: "three", Value: []byte("3"), Flags: 3},
+	}
+	err := cache.AddMulti(c, items)
+	me, ok := err.(appengine.MultiError)
+	if !ok {
+		t.Fatal("expected appengine.MultiError", err)
+	}
+	if me[0] != nds.ErrNotStored || me[1] != nil {
+		t.Fatal("incorrect errors", me)
+	}
+
+	got, err := cache.GetMulti(c, []string{"one", "two", "three", "four"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 3 {
+		t.Fatal("expected 3 items", len(got))
+	}
+	if item := got["one"]; string(item.Value) != "1" || item.Flags != 1 {
+		t.Fatal("item overwritten", item)
+	}
+	if item := got["three"]; string(item.Value) != "3" || item.Flags != 3 {
+		t.Fatal("item not added", item)
+	}
+}
+
+func TestSetMultiExpiration(t *testing.T) {
+	cache, s := newCache(t)
+	c := context.Background()
+
+	items := []*nds.Item{
+		{Key: "lock", Value: []byte{1, 2, 3, 4}, Flags: 2,
+			Expiration: 32 * time.Second},
+		{Key: "entity", Value: []byte("entity"), Flags: 1},
+	}
+	if err := cache.SetMulti(c, items); err != nil {
+		t.Fatal(err)
+	}
+
+	if ttl := s.TTL("lock"); ttl != 32*time.Second {
+		t.Fatal("incorrect lock TTL", ttl)
+	}
+	if ttl := s.TTL("entity"); ttl != 0 {
+		t.Fatal("expected no entity TTL", ttl)
+	}
+
+	s.FastForward(33 * time.Second)
+
+	got, err := cache.GetMulti(c, []string{"lock", "entity"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := got["lock"]; ok {
+		t.Fatal("expected lock to expire")
+	}
+	if _, ok := got["entity"]; !ok {
+		t.Fatal("expected entity")
+	}
+}
+
+func TestCompareAndSwapMulti(t *testing.T) {
+	cache, _ := newCache(t)
+	c := context.Background()
+
+	items := []*nds.Item{
+		{Key: "swap", Value: []byte("lock1"), Flags: 2},
+		{Key: "conflict", Value: []byte("lock2"), Flags: 2},
+		{Key: "evicted", Value: []byte("lock3"), Flags: 2},
+	}
+	if err := cache.SetMulti(c, items); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := cache.GetMulti(c, []string{"swap", "conflict", "evicted"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Another client replaces one lock and removes another.
+	if err := cache.SetMulti(c, []*nds.Item{
+		{Key: "conflict", Value: []byte("lock4"), Flags: 2},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.DeleteMulti(c, []string{"evicted"}); err != nil {
+		t.Fatal(err)
+	}
+
+	swapItems := []*nds.Item{got["swap"], got["conflict"], got["evicted"]}
+	for _, item := range swapItems {
+		item.Value = []byte("entity")
+		item.Flags = 1
+	}
+
+	err = cache.CompareAndSwapMulti(c, swapItems)
+	me, ok := err.(appengine.MultiError)
+	if !ok {
+		t.Fatal("expected appengine.MultiError", err)
+	}
+	if me[0] != nil {
+		t.Fatal(me[0])
+	}
+	if me[1] != nds.ErrCASConflict {
+		t.Fatal("expected ErrCASConflict", me[1])
+	}
+	if me[2] != nds.ErrNotStored {
+		t.Fatal("expected ErrNotStored", me[2])
+	}
+
+	got, err = cache.GetMulti(c, []string{"swap", "conflict", "evicted"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item := got["swap"]; !bytes.Equal(item.Value, []byte("entity")) ||
+		item.Flags != 1 {
+		t.Fatal("item not swapped", item)
+	}
+	if item := got["conflict"]; !bytes.Equal(item.Value, []byte("lock4")) {
+		t.Fatal("item should not be swapped", item)
+	}
+	if _, ok := got["evicted"]; ok {
+		t.Fatal("item should not be stored")
+	}
+}
+
+func TestCompareAndSwapMultiNotRetrieved(t *testing.T) {
+	cache, _ := newCache(t)
+	c := context.Background()
+
+	err := cache.CompareAndSwapMulti(c, []*nds.Item{
+		{Key: "one", Value: []byte("1")},
+	})
+	if me, ok := err.(appengine.MultiError); !ok || me[0] == nil {
+		t.Fatal("expected error", err)
+	}
+}
+
+func TestDeleteMulti(t *testing.T) {
+	cache, _ := newCache(t)
+	c := context.Background()
+
+	if err := cache.SetMulti(c, []*nds.Item{
+		{Key: "one", Value: []byte("1")},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cache.DeleteMulti(c, []string{"one", "missing"}); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := cache.GetMulti(c, []string{"one"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 0 {
+		t.Fatal("expected no items")
+	}
+}
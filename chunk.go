@@ -0,0 +1,217 @@
+package nds
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"math/rand"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+)
+
+const (
+	// chunkSize is the largest entity value stored in a single item. It
+	// leaves room within memcache's item size limit for the item's key and
+	// memcache's own overhead.
+	chunkSize = memcacheMaxItemSize - memcacheMaxKeySize - 1024
+
+	// chunkedFlag is set in the Flags of entity items whose values are larger
+	// than chunkSize. The value of such an item is a manifest identifying the
+	// chunk items that hold the entity's value.
+	chunkedFlag uint32 = 1 << 9
+
+	// manifestSize is the size of a manifest: a random nonce that begins the
+	// value of each of the manifest's chunks, followed by the number of chunks
+	// and the total size of the entity's value as little-endian uint32s.
+	manifestSize = 16
+	nonceSize    = 8
+
+	// maxChunkedSize is the largest value a manifest can describe: the epochs
+	// and encrypted form of an entity of maxEntitySize. Compressed entities
+	// are only stored if they are smaller than the original.
+	maxChunkedSize = epochsSize + maxEntitySize + maxEncryptionOverhead
+
+	// maxChunkExpiration is the longest chunks are cached for. Chunks are
+	// overwritten when their entity is cached again but those of deleted
+	// entities, or beyond the number an entity now needs, are left to expire.
+	maxChunkExpiration = time.Hour
+)
+
+// createChunkKey returns the cache key of the ith chunk of the entity value
+// stored under memcacheKey. Every manifest of the entity uses the same keys
+// so that caching the entity again replaces its previous chunks rather than
+// leaving them in the cache.
+func createChunkKey(prefix, memcacheKey string, i int) string {
+	hash := sha1.Sum([]byte(memcacheKey))
+	return prefix + "C:" + hex.EncodeToString(hash[:]) + ":" + strconv.Itoa(i)
+}
+
+// chunkExpiration returns the expiration of the chunks of an entity cached
+// with expiration. Chunks are stored before their manifest so they outlive it
+// by the lock time.
+func chunkExpiration(cfg *Config, expiration time.Duration) time.Duration {
+	if expiration <= 0 || expiration > maxChunkExpiration {
+		expiration = maxChunkExpiration
+	}
+	return expiration + cfg.lockTime()
+}
+
+// splitValue splits value into chunk items with the given expiration and
+// returns them along with the manifest that identifies them.
+func splitValue(prefix, memcacheKey string, value []byte,
+	expiration time.Duration) ([]byte, []*Item) {
+
+	manifest := make([]byte, manifestSize)
+	nonce := manifest[:nonceSize]
+	binary.LittleEndian.PutUint64(nonce, uint64(rand.Int63()))
+
+	chunks := []*Item{}
+	for lo := 0; lo < len(value); lo += chunkSize {
+		hi := lo + chunkSize
+		if hi > len(value) {
+			hi = len(value)
+		}
+		chunk := make([]byte, 0, nonceSize+hi-lo)
+		chunks = append(chunks, &Item{
+			Key:        createChunkKey(prefix, memcacheKey, len(chunks)),
+			Flags:      chunkItem,
+			Value:      append(append(chunk, nonce...), value[lo:hi]...),
+			Expiration: expiration,
+		})
+	}
+
+	binary.LittleEndian.PutUint32(manifest[nonceSize:], uint32(len(chunks)))
+	binary.LittleEndian.PutUint32(manifest[nonceSize+4:], uint32(len(value)))
+	return manifest, chunks
+}
+
+// manifestChunkKeys returns the keys of the chunks identified by manifest and
+// the total size of their values. Manifests describing values larger than
+// nds stores, or a number of chunks that does not match their size, are
+// invalid.
+func manifestChunkKeys(prefix, memcacheKey string,
+	manifest []byte) ([]string, int, bool) {
+
+	if len(manifest) != manifestSize {
+		return nil, 0, false
+	}
+	count := int(binary.LittleEndian.Uint32(manifest[nonceSize:]))
+	size := int(binary.LittleEndian.Uint32(manifest[nonceSize+4:]))
+	if size <= 0 || size > maxChunkedSize ||
+		count != (size+chunkSize-1)/chunkSize {
+		return nil, 0, false
+	}
+
+	keys := make([]string, count)
+	for i := range keys {
+		keys[i] = createChunkKey(prefix, memcacheKey, i)
+	}
+	return keys, size, true
+}
+
+// loadChunks replaces the chunked entity items in items with items holding
+// the entities' reassembled values. The keys of chunked entity items whose
+// chunks could not all be loaded are returned. Chunks can be evicted
+// independently of their manifest, or replaced by those of another manifest,
+// so such items must be treated as misses.
+func loadChunks(c context.Context, items map[string]*Item) map[string]bool {
+	cache, prefix := clientFromContext(c).cache, configFromContext(c).prefix()
+	missing := map[string]bool{}
+	chunkKeys := map[string][]string{}
+	nonces := map[string][]byte{}
+	sizes := map[string]int{}
+	allChunkKeys := []string{}
+	for key, item := range items {
+		if item.Flags&itemTypeMask != entityItem ||
+			item.Flags&chunkedFlag == 0 {
+			continue
+		}
+
+		keys, size, ok := manifestChunkKeys(prefix, key, item.Value)
+		if !ok {
+			missing[key] = true
+			continue
+		}
+		chunkKeys[key] = keys
+		nonces[key] = item.Value[:nonceSize]
+		sizes[key] = size
+		allChunkKeys = append(allChunkKeys, keys...)
+	}
+
+	if len(allChunkKeys) == 0 {
+		return missing
+	}
+
+	chunks, err := cache.GetMulti(c, allChunkKeys)
+	if err != nil {
+		warningf(c, "nds:loadChunks GetMulti %s", err)
+		for key := range chunkKeys {
+			missing[key] = true
+		}
+		return missing
+	}
+
+	for key, keys := range chunkKeys {
+		value := make([]byte, 0, sizes[key])
+		for _, chunkKey := range keys {
+			chunk, ok := chunks[chunkKey]
+			if !ok || chunk.Flags != chunkItem ||
+				!bytes.HasPrefix(chunk.Value, nonces[key]) {
+				value = nil
+				break
+			}
+			value = append(value, chunk.Value[nonceSize:]...)
+		}
+		if len(value) != sizes[key] {
+			missing[key] = true
+			continue
+		}
+
+		item := items[key]
+		items[key] = &Item{
+			Key:        item.Key,
+			Value:      value,
+			Flags:      item.Flags &^ chunkedFlag,
+			Expiration: item.Expiration,
+			CAS:        item.CAS,
+		}
+	}
+	return missing
+}
+
+// saveChunks stores the chunks of the chunked entity items in saveItems, where
+// chunkOwners holds the index in saveItems of each chunk's entity item. It
+// returns saveItems without the entity items whose chunks were not all
+// stored. Their locks are left to expire as another call may have replaced
+// them.
+func saveChunks(c context.Context, saveItems []*Item, chunks []*Item,
+	chunkOwners []int) []*Item {
+
+	if len(chunks) == 0 {
+		return saveItems
+	}
+
+	failed := map[int]bool{}
+	cache := clientFromContext(c).cache
+	if err := cache.SetMulti(c, chunks); err != nil {
+		warningf(c, "nds:saveChunks SetMulti %s", err)
+		me, ok := err.(appengine.MultiError)
+		for i, owner := range chunkOwners {
+			if !ok || me[i] != nil {
+				failed[owner] = true
+			}
+		}
+	}
+
+	items := make([]*Item, 0, len(saveItems))
+	for i, item := range saveItems {
+		if !failed[i] {
+			items = append(items, item)
+		}
+	}
+	return items
+}
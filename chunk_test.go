@@ -0,0 +1,216 @@
+package nds_test
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/qedus/nds"
+	"github.com/qedus/nds/ndstest"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+type blobEntity struct {
+	Blob []byte
+}
+
+func TestChunkedEntities(t *testing.T) {
+	c := context.Background()
+	d, cache := &countingDatastore{Datastore: ndstest.NewDatastore()},
+		ndstest.NewCache()
+	ndstest.Install(t, d, cache)
+
+	// Random bytes ensure the entity is larger than a cache item.
+	blob := make([]byte, 3<<19)
+	rand.New(rand.NewSource(1)).Read(blob)
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(c, key, &blobEntity{blob}); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(gets int) {
+		t.Helper()
+		entity := &blobEntity{}
+		if err := nds.Get(c, key, entity); err != nil {
+			t.Fatal(err)
+		}
+		if string(entity.Blob) != string(blob) {
+			t.Fatal("incorrect entity")
+		}
+		if d.gets != gets {
+			t.Fatal("incorrect gets", d.gets)
+		}
+	}
+	get(1)
+	get(1)
+
+	memcacheKey := nds.CreateMemcacheKey(key)
+	items, err := cache.GetMulti(c, []string{memcacheKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := items[memcacheKey]
+	flags := manifest.Flags &^ nds.ItemHeaderMask
+	if flags != nds.EntityItem|nds.ChunkedFlag|nds.EpochFlag {
+		t.Fatal("expected chunked item", manifest.Flags)
+	}
+	chunkKeys := nds.ManifestChunkKeys(memcacheKey, manifest.Value)
+	if len(chunkKeys) != 2 {
+		t.Fatal("incorrect chunks", len(chunkKeys))
+	}
+
+	// A missing chunk is a miss and the entity is cached again.
+	if err := cache.DeleteMulti(c, chunkKeys[1:2]); err != nil {
+		t.Fatal(err)
+	}
+	get(2)
+	get(2)
+
+	items, err = cache.GetMulti(c, []string{memcacheKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(items[memcacheKey].Value) == string(manifest.Value) {
+		t.Fatal("expected new manifest")
+	}
+
+	// Puts invalidate chunked entities.
+	blob[0]++
+	if _, err := nds.Put(c, key, &blobEntity{blob}); err != nil {
+		t.Fatal(err)
+	}
+	get(3)
+	get(3)
+}
+
+func TestChunkedEntityUpdates(t *testing.T) {
+	c := context.Background()
+	d, cache := &countingDatastore{Datastore: ndstest.NewDatastore()},
+		ndstest.NewCache()
+	ndstest.Install(t, d, cache)
+
+	blob := make([]byte, 3<<19)
+	rand.New(rand.NewSource(1)).Read(blob)
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	get := func() {
+		t.Helper()
+		entity := &blobEntity{}
+		if err := nds.Get(c, key, entity); err != nil {
+			t.Fatal(err)
+		}
+		if string(entity.Blob) != string(blob) {
+			t.Fatal("incorrect entity")
+		}
+	}
+
+	// Caching an entity again replaces its chunks.
+	size := 0
+	for i := 0; i < 5; i++ {
+		blob[0]++
+		if _, err := nds.Put(c, key, &blobEntity{blob}); err != nil {
+			t.Fatal(err)
+		}
+		get()
+		if i == 0 {
+			size = cache.Len()
+		} else if cache.Len() != size {
+			t.Fatal("cache grew", size, cache.Len())
+		}
+	}
+
+	// Chunks expire even if their entity does not.
+	gets := d.gets
+	cache.Advance(nds.MaxChunkExpiration + time.Minute)
+	if cache.Len() != size-len(nds.ManifestChunkKeys(
+		nds.CreateMemcacheKey(key), manifestValue(t, cache, key))) {
+		t.Fatal("expected chunks to expire", cache.Len())
+	}
+	get()
+	if d.gets != gets+1 {
+		t.Fatal("expected entity to be loaded", d.gets)
+	}
+}
+
+// keyCountingCache records the number of keys of each GetMulti call.
+type keyCountingCache struct {
+	nds.Cache
+	maxKeys int
+}
+
+func (c *keyCountingCache) GetMulti(ctx context.Context,
+	keys []string) (map[string]*nds.Item, error) {
+
+	if len(keys) > c.maxKeys {
+		c.maxKeys = len(keys)
+	}
+	return c.Cache.GetMulti(ctx, keys)
+}
+
+func TestForgedManifests(t *testing.T) {
+	c := context.Background()
+	d := &countingDatastore{Datastore: ndstest.NewDatastore()}
+	cache := &keyCountingCache{Cache: ndstest.NewCache()}
+	ndstest.Install(t, d, cache)
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(c, key, &textEntity{"text"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := nds.Get(c, key, &textEntity{}); err != nil {
+		t.Fatal(err)
+	}
+	memcacheKey := nds.CreateMemcacheKey(key)
+	items, err := cache.GetMulti(c, []string{memcacheKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	item := items[memcacheKey]
+
+	manifest := func(count, size uint32) []byte {
+		m := make([]byte, 16)
+		binary.LittleEndian.PutUint32(m[8:], count)
+		binary.LittleEndian.PutUint32(m[12:], size)
+		return m
+	}
+
+	// Manifests describing entities larger than nds caches, or with the
+	// wrong number of chunks, are misses and do not load any chunks.
+	for i, value := range [][]byte{
+		manifest(5000000, 5000000),
+		manifest(5000, 1<<32-1),
+		manifest(1, 3<<19),
+		manifest(3, 3<<19),
+	} {
+		item.Flags |= nds.ChunkedFlag
+		item.Value = value
+		if err := cache.SetMulti(c, []*nds.Item{item}); err != nil {
+			t.Fatal(err)
+		}
+		cache.maxKeys = 0
+		entity := &textEntity{}
+		if err := nds.Get(c, key, entity); err != nil {
+			t.Fatal(err)
+		} else if entity.Text != "text" {
+			t.Fatal("incorrect entity", entity)
+		}
+		if cache.maxKeys > 3 {
+			t.Fatal("loaded chunks", i, cache.maxKeys)
+		}
+		if d.gets != i+2 {
+			t.Fatal("incorrect gets", i, d.gets)
+		}
+	}
+}
+
+func manifestValue(t *testing.T, cache nds.Cache,
+	key *datastore.Key) []byte {
+
+	memcacheKey := nds.CreateMemcacheKey(key)
+	items, err := cache.GetMulti(context.Background(), []string{memcacheKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return items[memcacheKey].Value
+}
@@ -0,0 +1,138 @@
+package nds
+
+import (
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+var clientKey = "used for *Client"
+
+// Client gets, puts and deletes entities using its own Datastore, Cache and
+// Config, so that differently configured clients can be used side by side in
+// one process. The package level functions use the Client of their context,
+// which is a default Client configured with SetDatastore, SetCache and
+// SetConfig unless the context was returned by Client.Context or passed to
+// the function given to Client.RunInTransaction.
+type Client struct {
+	datastore Datastore
+	cache     Cache
+	config    *Config
+}
+
+// NewClient returns a Client that uses d, c and cfg. If d is nil the App
+// Engine datastore is used and if c is nil App Engine memcache is used.
+func NewClient(d Datastore, c Cache, cfg Config) *Client {
+	if d == nil {
+		d = appengineDatastore{}
+	}
+	if c == nil {
+		c = memcacheCache{}
+	}
+	return &Client{
+		datastore: d,
+		cache:     c,
+		config:    &cfg,
+	}
+}
+
+// defaultClient is used by nds calls whose contexts have no Client.
+var defaultClient = NewClient(nil, nil, Config{})
+
+func clientFromContext(c context.Context) *Client {
+	if cl, ok := c.Value(&clientKey).(*Client); ok {
+		return cl
+	}
+	return defaultClient
+}
+
+// Context returns a context that makes the package level functions and
+// Queries use cl.
+func (cl *Client) Context(c context.Context) context.Context {
+	if clientFromContext(c) == cl {
+		return c
+	}
+	return context.WithValue(c, &clientKey, cl)
+}
+
+// GetMulti is like the package level GetMulti but uses cl.
+func (cl *Client) GetMulti(c context.Context,
+	keys []*datastore.Key, vals interface{}) error {
+	return GetMulti(cl.Context(c), keys, vals)
+}
+
+// Get is like the package level Get but uses cl.
+func (cl *Client) Get(c context.Context,
+	key *datastore.Key, val interface{}) error {
+	return Get(cl.Context(c), key, val)
+}
+
+// PutMulti is like the package level PutMulti but uses cl.
+func (cl *Client) PutMulti(c context.Context,
+	keys []*datastore.Key, vals interface{}) ([]*datastore.Key, error) {
+	return PutMulti(cl.Context(c), keys, vals)
+}
+
+// Put is like the package level Put but uses cl.
+func (cl *Client) Put(c context.Context,
+	key *datastore.Key, val interface{}) (*datastore.Key, error) {
+	return Put(cl.Context(c), key, val)
+}
+
+// DeleteMulti is like the package level DeleteMulti but uses cl.
+func (cl *Client) DeleteMulti(c context.Context, keys []*datastore.Key) error {
+	return DeleteMulti(cl.Context(c), keys)
+}
+
+// Delete is like the package level Delete but uses cl.
+func (cl *Client) Delete(c context.Context, key *datastore.Key) error {
+	return Delete(cl.Context(c), key)
+}
+
+// GetMultiAsync is like the package level GetMultiAsync but uses cl.
+func (cl *Client) GetMultiAsync(c context.Context,
+	keys []*datastore.Key, vals interface{}) *Future {
+	return GetMultiAsync(cl.Context(c), keys, vals)
+}
+
+// PutMultiAsync is like the package level PutMultiAsync but uses cl.
+func (cl *Client) PutMultiAsync(c context.Context,
+	keys []*datastore.Key, vals interface{}) *PutFuture {
+	return PutMultiAsync(cl.Context(c), keys, vals)
+}
+
+// DeleteMultiAsync is like the package level DeleteMultiAsync but uses cl.
+func (cl *Client) DeleteMultiAsync(c context.Context,
+	keys []*datastore.Key) *Future {
+	return DeleteMultiAsync(cl.Context(c), keys)
+}
+
+// Warm is like the package level Warm but uses cl.
+func (cl *Client) Warm(c context.Context, keys []*datastore.Key) error {
+	return Warm(cl.Context(c), keys)
+}
+
+// InvalidateMulti is like the package level InvalidateMulti but uses cl.
+func (cl *Client) InvalidateMulti(c context.Context,
+	keys []*datastore.Key) error {
+	return InvalidateMulti(cl.Context(c), keys)
+}
+
+// InvalidateKind is like the package level InvalidateKind but uses cl.
+func (cl *Client) InvalidateKind(c context.Context,
+	namespace, kind string) error {
+	return InvalidateKind(cl.Context(c), namespace, kind)
+}
+
+// InvalidateNamespace is like the package level InvalidateNamespace but uses
+// cl.
+func (cl *Client) InvalidateNamespace(c context.Context,
+	namespace string) error {
+	return InvalidateNamespace(cl.Context(c), namespace)
+}
+
+// RunInTransaction is like the package level RunInTransaction but uses cl.
+func (cl *Client) RunInTransaction(c context.Context,
+	f func(tc context.Context) error,
+	opts *datastore.TransactionOptions) error {
+	return RunInTransaction(cl.Context(c), f, opts)
+}
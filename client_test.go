@@ -0,0 +1,132 @@
+package nds_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/qedus/nds"
+	"github.com/qedus/nds/ndstest"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestClient(t *testing.T) {
+	c := ndstest.NewContext(t)
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+
+	d1, d2 := &countingDatastore{Datastore: ndstest.NewDatastore()},
+		&countingDatastore{Datastore: ndstest.NewDatastore()}
+	cache1, cache2 := ndstest.NewCache(), ndstest.NewCache()
+	cl1 := nds.NewClient(d1, cache1, nds.Config{Logger: testLogger(t)})
+	cl2 := nds.NewClient(d2, cache2, nds.Config{
+		Prefix: "cl2:",
+		Logger: testLogger(t),
+	})
+
+	if _, err := cl1.Put(c, key, &textEntity{"one"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cl2.Put(c, key, &textEntity{"two"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each Client uses its own Datastore and Cache.
+	for i := 0; i < 2; i++ {
+		entity := &textEntity{}
+		if err := cl1.Get(c, key, entity); err != nil {
+			t.Fatal(err)
+		} else if entity.Text != "one" {
+			t.Fatal("incorrect entity", entity)
+		}
+		if err := cl2.Get(c, key, entity); err != nil {
+			t.Fatal(err)
+		} else if entity.Text != "two" {
+			t.Fatal("incorrect entity", entity)
+		}
+	}
+	if d1.gets != 1 || d2.gets != 1 {
+		t.Fatal("incorrect gets", d1.gets, d2.gets)
+	}
+	// The entity is cached along with the epochs of its namespace and kind.
+	if cache1.Len() != 3 || cache2.Len() != 3 {
+		t.Fatal("incorrect cache lengths", cache1.Len(), cache2.Len())
+	}
+
+	// The default Client is unaffected.
+	err := nds.Get(c, key, &textEntity{})
+	if err != datastore.ErrNoSuchEntity {
+		t.Fatal("expected ErrNoSuchEntity", err)
+	}
+
+	// Package level functions use the Client of the transaction context.
+	if err := cl1.RunInTransaction(c, func(tc context.Context) error {
+		return nds.Delete(tc, key)
+	}, nil); err != nil {
+		t.Fatal(err)
+	}
+	err = nds.Get(cl1.Context(c), key, &textEntity{})
+	if err != datastore.ErrNoSuchEntity {
+		t.Fatal("expected ErrNoSuchEntity", err)
+	}
+	if err := cl2.Get(c, key, &textEntity{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientSettings(t *testing.T) {
+	c := ndstest.NewContext(t)
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+
+	// Clients sharing a LocalCache and Prefix but not a Cache or Datastore.
+	lc := nds.NewLocalCache(100, 1<<20, time.Minute)
+	cache1, cache2 := ndstest.NewCache(), ndstest.NewCache()
+	cl1 := nds.NewClient(ndstest.NewDatastore(), cache1, nds.Config{
+		LocalCache: lc,
+		Logger:     testLogger(t),
+	})
+	cl2 := nds.NewClient(ndstest.NewDatastore(), cache2, nds.Config{
+		Codec:      nds.BinaryCodec{},
+		LocalCache: lc,
+		Logger:     testLogger(t),
+	})
+
+	if _, err := cl1.Put(c, key, &textEntity{"one"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cl2.Put(c, key, &textEntity{"two"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each Client only sees its own entities in the LocalCache.
+	for i := 0; i < 2; i++ {
+		entity := &textEntity{}
+		if err := cl1.Get(c, key, entity); err != nil {
+			t.Fatal(err)
+		} else if entity.Text != "one" {
+			t.Fatal("incorrect entity", entity)
+		}
+		if err := cl2.Get(c, key, entity); err != nil {
+			t.Fatal(err)
+		} else if entity.Text != "two" {
+			t.Fatal("incorrect entity", entity)
+		}
+	}
+
+	// Each Client stores entities with its own Codec.
+	memcacheKey := nds.CreateMemcacheKey(key)
+	flags := []uint32{}
+	for _, cache := range []*ndstest.Cache{cache1, cache2} {
+		items, err := cache.GetMulti(c, []string{memcacheKey})
+		if err != nil {
+			t.Fatal(err)
+		}
+		item, ok := items[memcacheKey]
+		if !ok {
+			t.Fatal("entity not cached")
+		}
+		flags = append(flags, item.Flags&nds.ItemCodecMask)
+	}
+	if flags[0] == flags[1] {
+		t.Fatal("entities stored with the same Codec")
+	}
+}
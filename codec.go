@@ -0,0 +1,453 @@
+package nds
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"time"
+
+	"github.com/qedus/nds/internal/keys"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+// Codec converts entities to and from the values stored in the Cache.
+// Marshal and Unmarshal must be safe to call concurrently.
+type Codec interface {
+	Marshal(pl datastore.PropertyList) ([]byte, error)
+	Unmarshal(data []byte, pl *datastore.PropertyList) error
+}
+
+// SetCodec sets the Codec the default Client's Config uses to store entities
+// in the Cache. By default, or if c is nil, GobCodec is used. Each cached
+// entity records whether it was written by GobCodec or BinaryCodec so both can
+// always be read; entities written by any other Codec are read with c.
+// SetCodec is not safe to call concurrently with other nds functions and
+// should therefore be called during program initialization.
+func SetCodec(c Codec) {
+	defaultClient.config.Codec = c
+}
+
+func init() {
+	gob.Register(time.Time{})
+	gob.Register(datastore.ByteString{})
+	gob.Register(&datastore.Key{})
+	gob.Register(&datastore.Entity{})
+	gob.Register(appengine.BlobKey(""))
+	gob.Register(appengine.GeoPoint{})
+}
+
+// GobCodec is the default Codec and uses encoding/gob. Gob data can only be
+// read by Go programs and repeats type information in each cached entity.
+type GobCodec struct{}
+
+// Marshal implements Codec.
+func (GobCodec) Marshal(pl datastore.PropertyList) ([]byte, error) {
+	buf := bytes.Buffer{}
+	if err := gob.NewEncoder(&buf).Encode(&pl); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Unmarshal implements Codec.
+func (GobCodec) Unmarshal(data []byte, pl *datastore.PropertyList) error {
+	return gob.NewDecoder(bytes.NewBuffer(data)).Decode(pl)
+}
+
+// BinaryCodec is a Codec with a compact binary format that does not depend
+// on Go and so can be read and written by other services sharing the Cache.
+// It also reads entities cached by GobCodec so that an application can switch
+// to BinaryCodec without flushing its Cache.
+//
+// Data begins with a zero byte, which never starts gob data, followed by the
+// format version, currently 1, and then the entity's properties. Unsigned
+// integers are encoded as varints and signed integers as zig-zag varints, in
+// the same way as protocol buffers. Strings and byte slices are encoded as
+// their length followed by their bytes.
+//
+//	properties = count:uvarint property*
+//	property   = name:string flags:byte type:byte value
+//	flags      = 1 if NoIndex | 2 if Multiple
+//	key        = 0:uvarint | count:uvarint appID:string namespace:string
+//	             (kind:string intID:varint stringID:string){count}
+//
+// Key elements are ordered from the root key to the key itself. Values are
+// encoded according to their type:
+//
+//	0  nil                no value
+//	1  int64              varint
+//	2  bool               byte, 0 or 1
+//	3  string             string
+//	4  float64            IEEE 754 bits, 8 bytes little-endian
+//	5  *datastore.Key     key
+//	6  time.Time          microseconds since the Unix epoch, varint
+//	7  appengine.GeoPoint float64 latitude then float64 longitude
+//	8  appengine.BlobKey  string
+//	9  ByteString         string
+//	10 []byte             string
+//	11 *datastore.Entity  key then properties
+//
+// Times are stored with the datastore's microsecond precision and are
+// unmarshaled in UTC, as the datastore returns them.
+type BinaryCodec struct{}
+
+const binaryCodecVersion = 1
+
+const (
+	binaryNoIndex = 1 << iota
+	binaryMultiple
+)
+
+const (
+	binaryNil byte = iota
+	binaryInt64
+	binaryBool
+	binaryString
+	binaryFloat64
+	binaryKey
+	binaryTime
+	binaryGeoPoint
+	binaryBlobKey
+	binaryByteString
+	binaryBytes
+	binaryEntity
+)
+
+var errBinaryCodecData = errors.New("nds: invalid BinaryCodec data")
+
+// Marshal implements Codec.
+func (BinaryCodec) Marshal(pl datastore.PropertyList) ([]byte, error) {
+	e := &binaryEncoder{}
+	e.buf.WriteByte(0)
+	e.buf.WriteByte(binaryCodecVersion)
+	if err := e.properties(pl); err != nil {
+		return nil, err
+	}
+	return e.buf.Bytes(), nil
+}
+
+// Unmarshal implements Codec.
+func (BinaryCodec) Unmarshal(data []byte, pl *datastore.PropertyList) error {
+	if len(data) == 0 || data[0] != 0 {
+		return GobCodec{}.Unmarshal(data, pl)
+	}
+	if len(data) < 2 || data[1] != binaryCodecVersion {
+		return errBinaryCodecData
+	}
+
+	d := &binaryDecoder{r: bytes.NewReader(data[2:])}
+	ps, err := d.properties()
+	if err != nil {
+		return err
+	}
+	if d.r.Len() != 0 {
+		return errBinaryCodecData
+	}
+	*pl = ps
+	return nil
+}
+
+type binaryEncoder struct {
+	buf     bytes.Buffer
+	scratch [binary.MaxVarintLen64]byte
+}
+
+func (e *binaryEncoder) uvarint(v uint64) {
+	n := binary.PutUvarint(e.scratch[:], v)
+	e.buf.Write(e.scratch[:n])
+}
+
+func (e *binaryEncoder) varint(v int64) {
+	n := binary.PutVarint(e.scratch[:], v)
+	e.buf.Write(e.scratch[:n])
+}
+
+func (e *binaryEncoder) string(s string) {
+	e.uvarint(uint64(len(s)))
+	e.buf.WriteString(s)
+}
+
+func (e *binaryEncoder) float64(f float64) {
+	binary.LittleEndian.PutUint64(e.scratch[:8], math.Float64bits(f))
+	e.buf.Write(e.scratch[:8])
+}
+
+func (e *binaryEncoder) key(key *datastore.Key) {
+	path := []*datastore.Key{}
+	for k := key; k != nil; k = k.Parent() {
+		path = append([]*datastore.Key{k}, path...)
+	}
+
+	e.uvarint(uint64(len(path)))
+	if key == nil {
+		return
+	}
+	e.string(key.AppID())
+	e.string(key.Namespace())
+	for _, k := range path {
+		e.string(k.Kind())
+		e.varint(k.IntID())
+		e.string(k.StringID())
+	}
+}
+
+func (e *binaryEncoder) properties(ps []datastore.Property) error {
+	e.uvarint(uint64(len(ps)))
+	for _, p := range ps {
+		e.string(p.Name)
+		flags := byte(0)
+		if p.NoIndex {
+			flags |= binaryNoIndex
+		}
+		if p.Multiple {
+			flags |= binaryMultiple
+		}
+		e.buf.WriteByte(flags)
+		if err := e.value(p.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *binaryEncoder) value(v interface{}) error {
+	switch v := v.(type) {
+	case nil:
+		e.buf.WriteByte(binaryNil)
+	case int64:
+		e.buf.WriteByte(binaryInt64)
+		e.varint(v)
+	case bool:
+		e.buf.WriteByte(binaryBool)
+		if v {
+			e.buf.WriteByte(1)
+		} else {
+			e.buf.WriteByte(0)
+		}
+	case string:
+		e.buf.WriteByte(binaryString)
+		e.string(v)
+	case float64:
+		e.buf.WriteByte(binaryFloat64)
+		e.float64(v)
+	case *datastore.Key:
+		e.buf.WriteByte(binaryKey)
+		e.key(v)
+	case time.Time:
+		e.buf.WriteByte(binaryTime)
+		e.varint(v.Unix()*1e6 + int64(v.Nanosecond()/1e3))
+	case appengine.GeoPoint:
+		e.buf.WriteByte(binaryGeoPoint)
+		e.float64(v.Lat)
+		e.float64(v.Lng)
+	case appengine.BlobKey:
+		e.buf.WriteByte(binaryBlobKey)
+		e.string(string(v))
+	case datastore.ByteString:
+		e.buf.WriteByte(binaryByteString)
+		e.string(string(v))
+	case []byte:
+		e.buf.WriteByte(binaryBytes)
+		e.string(string(v))
+	case *datastore.Entity:
+		if v == nil {
+			e.buf.WriteByte(binaryNil)
+			break
+		}
+		e.buf.WriteByte(binaryEntity)
+		e.key(v.Key)
+		return e.properties(v.Properties)
+	default:
+		return fmt.Errorf("nds: BinaryCodec unsupported property type %T", v)
+	}
+	return nil
+}
+
+type binaryDecoder struct {
+	r *bytes.Reader
+}
+
+func (d *binaryDecoder) uvarint() (uint64, error) {
+	v, err := binary.ReadUvarint(d.r)
+	if err != nil {
+		return 0, errBinaryCodecData
+	}
+	return v, nil
+}
+
+func (d *binaryDecoder) varint() (int64, error) {
+	v, err := binary.ReadVarint(d.r)
+	if err != nil {
+		return 0, errBinaryCodecData
+	}
+	return v, nil
+}
+
+func (d *binaryDecoder) byte() (byte, error) {
+	b, err := d.r.ReadByte()
+	if err != nil {
+		return 0, errBinaryCodecData
+	}
+	return b, nil
+}
+
+func (d *binaryDecoder) bytes() ([]byte, error) {
+	n, err := d.uvarint()
+	if err != nil {
+		return nil, err
+	}
+	if n > uint64(d.r.Len()) {
+		return nil, errBinaryCodecData
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(d.r, b); err != nil {
+		return nil, errBinaryCodecData
+	}
+	return b, nil
+}
+
+func (d *binaryDecoder) string() (string, error) {
+	b, err := d.bytes()
+	return string(b), err
+}
+
+func (d *binaryDecoder) float64() (float64, error) {
+	b := [8]byte{}
+	if _, err := io.ReadFull(d.r, b[:]); err != nil {
+		return 0, errBinaryCodecData
+	}
+	return math.Float64frombits(binary.LittleEndian.Uint64(b[:])), nil
+}
+
+func (d *binaryDecoder) key() (*datastore.Key, error) {
+	n, err := d.uvarint()
+	if err != nil || n == 0 {
+		return nil, err
+	}
+	appID, err := d.string()
+	if err != nil {
+		return nil, err
+	}
+	namespace, err := d.string()
+	if err != nil {
+		return nil, err
+	}
+
+	var key *datastore.Key
+	for i := uint64(0); i < n; i++ {
+		kind, err := d.string()
+		if err != nil {
+			return nil, err
+		}
+		intID, err := d.varint()
+		if err != nil {
+			return nil, err
+		}
+		stringID, err := d.string()
+		if err != nil {
+			return nil, err
+		}
+		if key = keys.New(appID, namespace, kind, stringID, intID,
+			key); key == nil {
+			return nil, errBinaryCodecData
+		}
+	}
+	return key, nil
+}
+
+func (d *binaryDecoder) properties() ([]datastore.Property, error) {
+	n, err := d.uvarint()
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return nil, nil
+	}
+	// Each property takes at least three bytes.
+	if n > uint64(d.r.Len()/3) {
+		return nil, errBinaryCodecData
+	}
+
+	ps := make([]datastore.Property, n)
+	for i := range ps {
+		if ps[i].Name, err = d.string(); err != nil {
+			return nil, err
+		}
+		flags, err := d.byte()
+		if err != nil {
+			return nil, err
+		}
+		ps[i].NoIndex = flags&binaryNoIndex != 0
+		ps[i].Multiple = flags&binaryMultiple != 0
+		if ps[i].Value, err = d.value(); err != nil {
+			return nil, err
+		}
+	}
+	return ps, nil
+}
+
+func (d *binaryDecoder) value() (interface{}, error) {
+	t, err := d.byte()
+	if err != nil {
+		return nil, err
+	}
+
+	switch t {
+	case binaryNil:
+		return nil, nil
+	case binaryInt64:
+		return d.varint()
+	case binaryBool:
+		b, err := d.byte()
+		if err != nil || b > 1 {
+			return nil, errBinaryCodecData
+		}
+		return b == 1, nil
+	case binaryString:
+		return d.string()
+	case binaryFloat64:
+		return d.float64()
+	case binaryKey:
+		return d.key()
+	case binaryTime:
+		v, err := d.varint()
+		if err != nil {
+			return nil, err
+		}
+		return time.Unix(v/1e6, (v%1e6)*1e3).UTC(), nil
+	case binaryGeoPoint:
+		lat, err := d.float64()
+		if err != nil {
+			return nil, err
+		}
+		lng, err := d.float64()
+		if err != nil {
+			return nil, err
+		}
+		return appengine.GeoPoint{Lat: lat, Lng: lng}, nil
+	case binaryBlobKey:
+		s, err := d.string()
+		return appengine.BlobKey(s), err
+	case binaryByteString:
+		b, err := d.bytes()
+		return datastore.ByteString(b), err
+	case binaryBytes:
+		return d.bytes()
+	case binaryEntity:
+		key, err := d.key()
+		if err != nil {
+			return nil, err
+		}
+		ps, err := d.properties()
+		if err != nil {
+			return nil, err
+		}
+		return &datastore.Entity{Key: key, Properties: ps}, nil
+	}
+	return nil, errBinaryCodecData
+}
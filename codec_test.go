@@ -0,0 +1,176 @@
+package nds_test
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/qedus/nds"
+	"github.com/qedus/nds/ndstest"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestBinaryCodecRoundTrip(t *testing.T) {
+	c := ndstest.NewContext(t)
+	parent := datastore.NewKey(c, "Parent", "name", 0, nil)
+	key := datastore.NewKey(c, "Child", "", -5, parent)
+
+	pl := datastore.PropertyList{
+		{Name: "Nil"},
+		{Name: "Int", Value: int64(-1 << 40), NoIndex: true},
+		{Name: "Bool", Value: true},
+		{Name: "String", Value: "ü"},
+		{Name: "Float", Value: 1.5},
+		{Name: "Key", Value: key},
+		{Name: "NilKey", Value: (*datastore.Key)(nil)},
+		{Name: "Time", Value: time.Unix(-1, 123456000).UTC()},
+		{Name: "GeoPoint", Value: appengine.GeoPoint{Lat: 1, Lng: -2}},
+		{Name: "BlobKey", Value: appengine.BlobKey("blob")},
+		{Name: "ByteString", Value: datastore.ByteString("bytes")},
+		{Name: "Bytes", Value: []byte{0, 1}, NoIndex: true},
+		{Name: "Multi", Value: int64(1), Multiple: true},
+		{Name: "Multi", Value: int64(2), Multiple: true},
+		{Name: "Entity", Value: &datastore.Entity{
+			Key: key,
+			Properties: []datastore.Property{
+				{Name: "Inner", Value: "value"},
+				{Name: "Nested", Value: &datastore.Entity{}},
+			},
+		}},
+	}
+
+	data, err := nds.BinaryCodec{}.Marshal(pl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := datastore.PropertyList{}
+	if err := (nds.BinaryCodec{}).Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, pl) {
+		t.Fatalf("incorrect properties\n got %#v\nwant %#v", got, pl)
+	}
+
+	// Data cached by GobCodec can also be read.
+	if data, err = (nds.GobCodec{}).Marshal(pl[:5]); err != nil {
+		t.Fatal(err)
+	}
+	got = datastore.PropertyList{}
+	if err := (nds.BinaryCodec{}).Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, pl[:5]) {
+		t.Fatal("incorrect properties", got)
+	}
+}
+
+func TestBinaryCodecInvalid(t *testing.T) {
+	if _, err := (nds.BinaryCodec{}).Marshal(datastore.PropertyList{
+		{Name: "Int", Value: 1},
+	}); err == nil {
+		t.Fatal("expected error")
+	}
+
+	data, err := nds.BinaryCodec{}.Marshal(datastore.PropertyList{
+		{Name: "String", Value: "value"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	invalid := [][]byte{
+		{0},
+		{0, 2, 0},
+		data[:len(data)-1],
+		append(data, 0),
+		{0, 1, 0xff, 0xff, 0xff, 0xff, 0x0f},
+	}
+	for i, data := range invalid {
+		pl := datastore.PropertyList{}
+		if err := (nds.BinaryCodec{}).Unmarshal(data, &pl); err == nil {
+			t.Fatal(i, "expected error")
+		}
+	}
+}
+
+func TestSetCodec(t *testing.T) {
+	c := ndstest.NewContext(t)
+	nds.SetCodec(nds.BinaryCodec{})
+	defer nds.SetCodec(nil)
+
+	type entity struct {
+		Time time.Time
+		Key  *datastore.Key
+	}
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	put := &entity{
+		Time: time.Unix(1e9, 1000).UTC(),
+		Key:  datastore.NewKey(c, "Other", "name", 0, nil),
+	}
+	if _, err := nds.Put(c, key, put); err != nil {
+		t.Fatal(err)
+	}
+
+	// The second Get is served from the cache.
+	for i := 0; i < 2; i++ {
+		got := &entity{}
+		if err := nds.Get(c, key, got); err != nil {
+			t.Fatal(err)
+		}
+		if !got.Time.Equal(put.Time) || !got.Key.Equal(put.Key) {
+			t.Fatal("incorrect entity", got)
+		}
+	}
+}
+
+func TestUndecodableItems(t *testing.T) {
+	c := context.Background()
+	d, cache := &countingDatastore{Datastore: ndstest.NewDatastore()},
+		ndstest.NewCache()
+	ndstest.Install(t, d, cache)
+	nds.SetCodec(nds.BinaryCodec{})
+	defer nds.SetCodec(nil)
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(c, key, &textEntity{"text"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A corrupt item cached without a version is decoded by the configured
+	// Codec, which fails.
+	data, err := nds.GobCodec{}.Marshal(datastore.PropertyList{
+		{Name: "Text", Value: "stale", NoIndex: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	memcacheKey := nds.CreateMemcacheKey(key)
+	if err := cache.SetMulti(c, []*nds.Item{{
+		Key:   memcacheKey,
+		Flags: nds.EntityItem,
+		Value: data[:len(data)-1],
+	}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The item is replaced so only the first Get loads the entity.
+	for i := 0; i < 2; i++ {
+		entity := &textEntity{}
+		if err := nds.Get(c, key, entity); err != nil {
+			t.Fatal(err)
+		} else if entity.Text != "text" {
+			t.Fatal("incorrect entity", entity)
+		}
+	}
+	if d.gets != 1 {
+		t.Fatal("expected item to be replaced", d.gets)
+	}
+	items, err := cache.GetMulti(c, []string{memcacheKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item := items[memcacheKey]; item.Flags&nds.ItemHeaderMask == 0 {
+		t.Fatal("expected versioned item", item.Flags)
+	}
+}
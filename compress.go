@@ -0,0 +1,86 @@
+package nds
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"sync"
+)
+
+const (
+	// compressedFlag is set in the Flags of entity items whose values are
+	// gzip compressed.
+	compressedFlag uint32 = 1 << 8
+
+	// maxEntitySize is the largest marshaled entity nds caches, decompresses
+	// or reassembles from chunks. It leaves room above the datastore's 1MB
+	// entity limit for the overhead of Codecs, while stopping small corrupt
+	// or malicious items in a shared Cache from expanding to fill memory.
+	maxEntitySize = 2 << 20
+)
+
+var errEntityTooLarge = errors.New("nds: marshaled entity too large")
+
+// SetCompression makes the default Client gzip compress entities whose
+// marshaled size is at least threshold bytes before storing them in the Cache.
+// This reduces the memory used by large entities, such as those with long text
+// properties, and allows more of them to fit within memcache's 1MB item limit.
+// Compressed entities are only stored if they are smaller than the original.
+// By default, or if threshold is zero or less, entities are not compressed.
+//
+// Compressed and uncompressed entities are distinguished by their item flags
+// so entities cached before compression was enabled, or by instances with a
+// different threshold, can still be read. SetCompression is not safe to call
+// concurrently with other nds functions and should therefore be called during
+// program initialization.
+func SetCompression(threshold int) {
+	defaultClient.config.CompressionThreshold = threshold
+}
+
+var gzipWriters = sync.Pool{
+	New: func() interface{} {
+		w, _ := gzip.NewWriterLevel(nil, gzip.BestSpeed)
+		return w
+	},
+}
+
+func compressValue(cfg *Config, data []byte) ([]byte, uint32, error) {
+	if cfg.CompressionThreshold <= 0 || len(data) < cfg.CompressionThreshold {
+		return data, 0, nil
+	}
+
+	buf := &bytes.Buffer{}
+	w := gzipWriters.Get().(*gzip.Writer)
+	defer gzipWriters.Put(w)
+	w.Reset(buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, 0, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, 0, err
+	}
+
+	if buf.Len() >= len(data) {
+		return data, 0, nil
+	}
+	return buf.Bytes(), compressedFlag, nil
+}
+
+func decompressValue(flags uint32, value []byte) ([]byte, error) {
+	if flags&compressedFlag == 0 {
+		return value, nil
+	}
+	r, err := gzip.NewReader(bytes.NewReader(value))
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(io.LimitReader(r, maxEntitySize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxEntitySize {
+		return nil, errEntityTooLarge
+	}
+	return data, nil
+}
@@ -0,0 +1,126 @@
+package nds_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"strings"
+	"testing"
+
+	"github.com/qedus/nds"
+	"github.com/qedus/nds/ndstest"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+type textEntity struct {
+	Text string `datastore:",noindex"`
+}
+
+func TestCompression(t *testing.T) {
+	c := context.Background()
+	d, cache := &countingDatastore{Datastore: ndstest.NewDatastore()},
+		ndstest.NewCache()
+	ndstest.Install(t, d, cache)
+
+	small := datastore.NewKey(c, "Entity", "", 1, nil)
+	large := datastore.NewKey(c, "Entity", "", 2, nil)
+	keys := []*datastore.Key{small, large}
+	entities := []textEntity{{"small"}, {strings.Repeat("large", 1000)}}
+	if _, err := nds.PutMulti(c, keys, entities); err != nil {
+		t.Fatal(err)
+	}
+
+	// Cache the small entity before compression is enabled.
+	if err := nds.Get(c, small, &textEntity{}); err != nil {
+		t.Fatal(err)
+	}
+
+	nds.SetCompression(1000)
+	defer nds.SetCompression(0)
+
+	for i := 0; i < 2; i++ {
+		got := make([]textEntity, 2)
+		if err := nds.GetMulti(c, keys, got); err != nil {
+			t.Fatal(err)
+		}
+		for j := range got {
+			if got[j] != entities[j] {
+				t.Fatal("incorrect entity", j)
+			}
+		}
+	}
+	if d.gets != 2 {
+		t.Fatal("expected entities to be cached", d.gets)
+	}
+
+	items, err := cache.GetMulti(c, []string{
+		nds.CreateMemcacheKey(small),
+		nds.CreateMemcacheKey(large),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	item := items[nds.CreateMemcacheKey(small)]
+	flags := item.Flags &^ nds.ItemHeaderMask
+	if flags != nds.EntityItem|nds.EpochFlag {
+		t.Fatal("expected uncompressed item", item.Flags)
+	}
+	item = items[nds.CreateMemcacheKey(large)]
+	flags = item.Flags &^ nds.ItemHeaderMask
+	if flags != nds.EntityItem|nds.CompressedFlag|nds.EpochFlag {
+		t.Fatal("expected compressed item", item.Flags)
+	}
+	if len(item.Value) > 1000 {
+		t.Fatal("item not compressed", len(item.Value))
+	}
+}
+
+func gzipValue(t *testing.T, data []byte) []byte {
+	buf := &bytes.Buffer{}
+	w := gzip.NewWriter(buf)
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecompressionLimit(t *testing.T) {
+	value := gzipValue(t, make([]byte, nds.MaxEntitySize))
+	if data, err := nds.DecompressValue(nds.CompressedFlag,
+		value); err != nil {
+		t.Fatal(err)
+	} else if len(data) != nds.MaxEntitySize {
+		t.Fatal("incorrect size", len(data))
+	}
+
+	// Larger values are corrupt and never fully decompressed.
+	value = gzipValue(t, make([]byte, nds.MaxEntitySize+1))
+	if _, err := nds.DecompressValue(nds.CompressedFlag,
+		value); err == nil {
+		t.Fatal("expected error")
+	}
+
+	// Entities are loaded from the datastore instead.
+	c, cache := context.Background(), ndstest.NewCache()
+	ndstest.Install(t, ndstest.NewDatastore(), cache)
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(c, key, &textEntity{"text"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.SetMulti(c, []*nds.Item{{
+		Key:   nds.CreateMemcacheKey(key),
+		Flags: nds.EntityItem | nds.CompressedFlag,
+		Value: value,
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	entity := &textEntity{}
+	if err := nds.Get(c, key, entity); err != nil {
+		t.Fatal(err)
+	} else if entity.Text != "text" {
+		t.Fatal("incorrect entity", entity)
+	}
+}
@@ -0,0 +1,326 @@
+package nds
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+var configKey = "used for *Config"
+
+// Config tunes how a Client uses its Cache and Datastore. The zero value of
+// each field selects its default so a Config only needs to set the fields it
+// changes. Services sharing a Cache can be isolated from each other by giving
+// them different Prefixes or, with App Engine memcache, Namespaces.
+type Config struct {
+	// LockTime is the maximum length of time an entity is locked in the Cache
+	// while it is being changed. It must be longer than any datastore write
+	// can take, including retries. The default is 32 seconds as 30 seconds is
+	// the maximum amount of time an underlying datastore call will retry even
+	// if the API reports a success to the user.
+	LockTime time.Duration
+
+	// Prefix is prepended to every cache key nds uses. The default is
+	// "NDS1:".
+	Prefix string
+
+	// InvalidatePrefixes are the Prefixes of other services or application
+	// versions that cache the same entities. Put, Delete and
+	// RunInTransaction lock changed entities under these Prefixes as well as
+	// Prefix so that they never return stale entities.
+	InvalidatePrefixes []string
+
+	// Namespace is the App Engine namespace of the memcache used when no
+	// Cache has been set. The default is the empty namespace.
+	Namespace string
+
+	// MaxKeySize is the maximum size of a cache key. Longer keys are hashed.
+	// The default is 250 bytes, the memcache limit.
+	MaxKeySize int
+
+	// GetMultiLimit, PutMultiLimit and DeleteMultiLimit are the maximum
+	// numbers of entities got, put or deleted by a single datastore call.
+	// Larger GetMulti, PutMulti and DeleteMulti calls are split into
+	// concurrent batches of these sizes. The defaults are the App Engine
+	// datastore limits of 1000, 500 and 500.
+	GetMultiLimit    int
+	PutMultiLimit    int
+	DeleteMultiLimit int
+
+	// WarmConcurrency is the maximum number of batches Warm loads at once.
+	// The default is 4.
+	WarmConcurrency int
+
+	// LockWait is the maximum length of time Get and GetMulti wait for
+	// entities locked by calls on other instances to be cached, polling the
+	// Cache, before loading them from the datastore themselves. The default
+	// is not to wait. Calls on the same instance always wait for each other
+	// so that concurrent misses of an entity share a single datastore read.
+	// Entities locked by Put, Delete, RunInTransaction or the Invalidate
+	// functions are never waited for.
+	LockWait time.Duration
+
+	// Expiration is the maximum length of time entities are cached for. The
+	// default, or a negative Expiration, is no expiration, leaving the Cache
+	// to evict entities.
+	Expiration time.Duration
+
+	// NegativeExpiration is the maximum length of time the absence of an
+	// entity is cached for. The default is Expiration and a negative
+	// NegativeExpiration is no expiration.
+	NegativeExpiration time.Duration
+
+	// KindExpirations override Expiration and NegativeExpiration for the
+	// entities of the kinds they are keyed by. Zero fields of a
+	// KindExpiration leave the corresponding Config field in effect.
+	KindExpirations map[string]KindExpiration
+
+	// Policy, if not nil, returns the Policy applied to the entity of key,
+	// for example to stop the entities of a kind from being cached.
+	Policy func(key *datastore.Key) Policy
+
+	// Logger logs errors that nds recovers from, such as Cache failures. The
+	// default is App Engine logging, which only works with App Engine
+	// contexts.
+	Logger func(c context.Context, format string, args ...interface{})
+
+	// Codec stores entities in the Cache. The default is GobCodec. See
+	// SetCodec.
+	Codec Codec
+
+	// CompressionThreshold is the marshaled size at or above which entities
+	// are compressed. The default is not to compress entities. See
+	// SetCompression.
+	CompressionThreshold int
+
+	// KeyProvider, if not nil, supplies the keys used to encrypt cached
+	// entities. See SetKeyProvider.
+	KeyProvider KeyProvider
+
+	// LocalCache, if not nil, is consulted before the Cache. It is only
+	// invalidated by changes made with a Config using it. Clients sharing a
+	// LocalCache hold their entities in it separately. See SetLocalCache.
+	LocalCache *LocalCache
+}
+
+// KindExpiration overrides the expirations of a Config for the entities of a
+// kind.
+type KindExpiration struct {
+	Expiration         time.Duration
+	NegativeExpiration time.Duration
+}
+
+// SetConfig sets the Config of the default Client, which is used by nds calls
+// whose contexts have no Client. It replaces any settings made by SetLogger,
+// SetCachePrefix, SetCodec, SetCompression, SetKeyProvider or SetLocalCache.
+// SetConfig is not safe to call concurrently with other nds functions and
+// should therefore be called during program initialization.
+func SetConfig(cfg Config) {
+	defaultClient.config = &cfg
+}
+
+// WithConfig returns a context that makes nds calls use cfg in place of the
+// Config of their Client. Zero fields of cfg are taken from the Client's
+// Config so that, for example, a context that only changes the LockTime still
+// uses the Client's Prefix.
+func WithConfig(c context.Context, cfg Config) context.Context {
+	return context.WithValue(c, &configKey, &cfg)
+}
+
+func configFromContext(c context.Context) *Config {
+	cfg := clientFromContext(c).config
+	if override, ok := c.Value(&configKey).(*Config); ok {
+		return override.merge(cfg)
+	}
+	return cfg
+}
+
+// merge returns cfg with its zero fields taken from base.
+func (cfg *Config) merge(base *Config) *Config {
+	merged := *cfg
+	if merged.LockTime == 0 {
+		merged.LockTime = base.LockTime
+	}
+	if merged.Prefix == "" {
+		merged.Prefix = base.Prefix
+	}
+	if merged.InvalidatePrefixes == nil {
+		merged.InvalidatePrefixes = base.InvalidatePrefixes
+	}
+	if merged.Namespace == "" {
+		merged.Namespace = base.Namespace
+	}
+	if merged.MaxKeySize == 0 {
+		merged.MaxKeySize = base.MaxKeySize
+	}
+	if merged.GetMultiLimit == 0 {
+		merged.GetMultiLimit = base.GetMultiLimit
+	}
+	if merged.PutMultiLimit == 0 {
+		merged.PutMultiLimit = base.PutMultiLimit
+	}
+	if merged.DeleteMultiLimit == 0 {
+		merged.DeleteMultiLimit = base.DeleteMultiLimit
+	}
+	if merged.WarmConcurrency == 0 {
+		merged.WarmConcurrency = base.WarmConcurrency
+	}
+	if merged.LockWait == 0 {
+		merged.LockWait = base.LockWait
+	}
+	if merged.Expiration == 0 {
+		merged.Expiration = base.Expiration
+	}
+	if merged.NegativeExpiration == 0 {
+		merged.NegativeExpiration = base.NegativeExpiration
+	}
+	if merged.KindExpirations == nil {
+		merged.KindExpirations = base.KindExpirations
+	}
+	if merged.Policy == nil {
+		merged.Policy = base.Policy
+	}
+	if merged.Logger == nil {
+		merged.Logger = base.Logger
+	}
+	if merged.Codec == nil {
+		merged.Codec = base.Codec
+	}
+	if merged.CompressionThreshold == 0 {
+		merged.CompressionThreshold = base.CompressionThreshold
+	}
+	if merged.KeyProvider == nil {
+		merged.KeyProvider = base.KeyProvider
+	}
+	if merged.LocalCache == nil {
+		merged.LocalCache = base.LocalCache
+	}
+	return &merged
+}
+
+func (cfg *Config) lockTime() time.Duration {
+	if cfg.LockTime <= 0 {
+		return memcacheLockTime
+	}
+	return cfg.LockTime
+}
+
+func (cfg *Config) prefix() string {
+	if cfg.Prefix == "" {
+		return defaultMemcachePrefix
+	}
+	return cfg.Prefix
+}
+
+// lockPrefixes returns the prefixes under which entities are locked when
+// they change.
+func (cfg *Config) lockPrefixes() []string {
+	prefixes := []string{cfg.prefix()}
+	for _, prefix := range cfg.InvalidatePrefixes {
+		if prefix != "" && prefix != cfg.prefix() {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	return prefixes
+}
+
+// codec returns the Codec of cfg, or GobCodec if it has none.
+func (cfg *Config) codec() Codec {
+	if cfg.Codec == nil {
+		return GobCodec{}
+	}
+	return cfg.Codec
+}
+
+// marshal marshals pl with the Codec of cfg.
+func (cfg *Config) marshal(pl datastore.PropertyList) ([]byte, error) {
+	if cfg.Codec == nil {
+		return marshal(pl)
+	}
+	return cfg.Codec.Marshal(pl)
+}
+
+// unmarshal unmarshals data with the Codec of cfg.
+func (cfg *Config) unmarshal(data []byte,
+	pl *datastore.PropertyList) error {
+
+	if cfg.Codec == nil {
+		return unmarshal(data, pl)
+	}
+	return cfg.Codec.Unmarshal(data, pl)
+}
+
+func (cfg *Config) maxKeySize() int {
+	if cfg.MaxKeySize <= 0 {
+		return memcacheMaxKeySize
+	}
+	return cfg.MaxKeySize
+}
+
+func (cfg *Config) getMultiLimit() int {
+	if cfg.GetMultiLimit <= 0 {
+		return getMultiLimit
+	}
+	return cfg.GetMultiLimit
+}
+
+func (cfg *Config) putMultiLimit() int {
+	if cfg.PutMultiLimit <= 0 {
+		return putMultiLimit
+	}
+	return cfg.PutMultiLimit
+}
+
+func (cfg *Config) deleteMultiLimit() int {
+	if cfg.DeleteMultiLimit <= 0 {
+		return deleteMultiLimit
+	}
+	return cfg.DeleteMultiLimit
+}
+
+func (cfg *Config) warmConcurrency() int {
+	if cfg.WarmConcurrency <= 0 {
+		return warmConcurrency
+	}
+	return cfg.WarmConcurrency
+}
+
+// entityExpiration returns the expiration of the cached entity of key.
+func (cfg *Config) entityExpiration(key *datastore.Key) time.Duration {
+	expiration := cfg.Expiration
+	if e := cfg.KindExpirations[key.Kind()].Expiration; e != 0 {
+		expiration = e
+	}
+	if expiration < 0 {
+		return 0
+	}
+	return expiration
+}
+
+// negativeExpiration returns the expiration of the cached absence of the
+// entity of key.
+func (cfg *Config) negativeExpiration(key *datastore.Key) time.Duration {
+	expiration := cfg.NegativeExpiration
+	if e := cfg.KindExpirations[key.Kind()].NegativeExpiration; e != 0 {
+		expiration = e
+	}
+	if expiration == 0 {
+		return cfg.entityExpiration(key)
+	}
+	if expiration < 0 {
+		return 0
+	}
+	return expiration
+}
+
+// warningf logs errors that nds recovers from, such as Cache failures, with
+// the Logger of c's Config.
+func warningf(c context.Context, format string, args ...interface{}) {
+	if logger := configFromContext(c).Logger; logger != nil {
+		logger(c, format, args...)
+		return
+	}
+	log.Warningf(c, format, args...)
+}
@@ -0,0 +1,182 @@
+package nds_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/qedus/nds"
+	"github.com/qedus/nds/ndstest"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// testLogger returns a Config Logger that logs with t.Logf.
+func testLogger(t *testing.T) func(context.Context, string, ...interface{}) {
+	return func(_ context.Context, format string, args ...interface{}) {
+		t.Logf(format, args...)
+	}
+}
+
+func TestWithConfig(t *testing.T) {
+	d, cache := &countingDatastore{Datastore: ndstest.NewDatastore()},
+		ndstest.NewCache()
+	ndstest.Install(t, d, cache)
+
+	c := nds.WithConfig(context.Background(), nds.Config{
+		Logger:        testLogger(t),
+		Prefix:        "svc:",
+		LockTime:      time.Second,
+		GetMultiLimit: 2,
+		Expiration:    time.Minute,
+	})
+
+	keys := make([]*datastore.Key, 5)
+	entities := make([]textEntity, len(keys))
+	for i := range keys {
+		keys[i] = datastore.NewKey(c, "Entity", "", int64(i+1), nil)
+		entities[i].Text = "text"
+	}
+	if _, err := nds.PutMulti(c, keys, entities); err != nil {
+		t.Fatal(err)
+	}
+
+	getAll := func(gets int) {
+		t.Helper()
+		got := make([]textEntity, len(keys))
+		if err := nds.GetMulti(c, keys, got); err != nil {
+			t.Fatal(err)
+		}
+		if d.gets != gets {
+			t.Fatal("incorrect gets", d.gets)
+		}
+	}
+
+	// Datastore calls are split into batches of GetMultiLimit.
+	getAll(5)
+	if d.maxGets != 2 {
+		t.Fatal("incorrect batch size", d.maxGets)
+	}
+	getAll(5)
+
+	// Entities are cached under the Config's Prefix.
+	items, err := cache.GetMulti(c, []string{"svc:" + keys[0].Encode()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 {
+		t.Fatal("entity not cached under prefix")
+	}
+
+	// Entities expire after Expiration.
+	cache.Advance(2 * time.Minute)
+	getAll(10)
+	getAll(10)
+
+	// Locks expire after LockTime.
+	if err := nds.Delete(c, keys[0]); err != nil {
+		t.Fatal(err)
+	}
+	cache.Advance(2 * time.Second)
+	for i := 0; i < 2; i++ {
+		err := nds.Get(c, keys[0], &textEntity{})
+		if err != datastore.ErrNoSuchEntity {
+			t.Fatal("expected ErrNoSuchEntity", err)
+		}
+	}
+	if d.gets != 11 {
+		t.Fatal("incorrect gets", d.gets)
+	}
+}
+
+func TestExpirations(t *testing.T) {
+	d, cache := &countingDatastore{Datastore: ndstest.NewDatastore()},
+		ndstest.NewCache()
+	ndstest.Install(t, d, cache)
+
+	c := nds.WithConfig(context.Background(), nds.Config{
+		Logger:             testLogger(t),
+		Expiration:         10 * time.Minute,
+		NegativeExpiration: time.Minute,
+		KindExpirations: map[string]nds.KindExpiration{
+			"Rare": {Expiration: 2 * time.Minute},
+		},
+	})
+
+	entityKey := datastore.NewKey(c, "Entity", "", 1, nil)
+	rareKey := datastore.NewKey(c, "Rare", "", 1, nil)
+	missingKey := datastore.NewKey(c, "Entity", "", 2, nil)
+	keys := []*datastore.Key{entityKey, rareKey}
+	if _, err := nds.PutMulti(c, keys,
+		[]textEntity{{"text"}, {"text"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(key *datastore.Key, gets int) {
+		t.Helper()
+		err := nds.Get(c, key, &textEntity{})
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			t.Fatal(err)
+		}
+		if d.gets != gets {
+			t.Fatal("incorrect gets", d.gets)
+		}
+	}
+
+	get(entityKey, 1)
+	get(rareKey, 2)
+	get(missingKey, 3)
+
+	// Negative results expire after NegativeExpiration.
+	cache.Advance(90 * time.Second)
+	get(entityKey, 3)
+	get(rareKey, 3)
+	get(missingKey, 4)
+
+	// Entities of kinds with a KindExpiration expire after it.
+	cache.Advance(time.Minute)
+	get(entityKey, 4)
+	get(rareKey, 5)
+}
+
+func TestWithConfigClient(t *testing.T) {
+	d, cache := &countingDatastore{Datastore: ndstest.NewDatastore()},
+		ndstest.NewCache()
+	cl := nds.NewClient(d, cache, nds.Config{
+		Prefix: "APP:",
+		Logger: testLogger(t),
+	})
+	c := ndstest.NewContext(t)
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := cl.Put(c, key, &textEntity{"one"}); err != nil {
+		t.Fatal(err)
+	}
+	entity := &textEntity{}
+	if err := cl.Get(c, key, entity); err != nil {
+		t.Fatal(err)
+	}
+
+	// Fields a Config passed to WithConfig leaves zero are the Client's, so
+	// the change invalidates the entity under the Client's Prefix.
+	lc := nds.WithConfig(c, nds.Config{LockTime: time.Second})
+	if _, err := cl.Put(lc, key, &textEntity{"two"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []context.Context{c, lc} {
+		if err := cl.Get(c, key, entity); err != nil {
+			t.Fatal(err)
+		} else if entity.Text != "two" {
+			t.Fatal("incorrect entity", entity)
+		}
+	}
+
+	items, err := cache.GetMulti(c, []string{"APP:" + key.Encode()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 {
+		t.Fatal("entity not cached under the Client's prefix")
+	}
+	if d.gets != 2 {
+		t.Fatal("incorrect gets", d.gets)
+	}
+}
@@ -0,0 +1,174 @@
+package nds
+
+import (
+	"sync"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+var contextCacheKey = "used for *contextCache"
+
+// contextCache holds the entities loaded or saved through a context created
+// by WithContextCache. A nil PropertyList records that an entity does not
+// exist, so the PropertyLists of entities, even those without properties, are
+// never nil.
+type contextCache struct {
+	sync.Mutex
+	entities map[contextCacheEntity]datastore.PropertyList
+}
+
+// contextCacheEntity identifies an entity in a contextCache. Clients have
+// their own Datastores so their entities are held separately.
+type contextCacheEntity struct {
+	client *Client
+	key    string
+}
+
+// WithContextCache returns a context that caches every entity got, put or
+// deleted through it, in a similar way to Python ndb's context cache.
+// Subsequent Get and GetMulti calls with the returned context, or contexts
+// derived from it, are served from the context cache without any RPCs.
+//
+// The context cache is not shared with any other context so it should be
+// created at the start of each request and discarded at the end of it. Within
+// that request changes made through the returned context are always visible
+// but changes made by other requests are not. Each Client using the context
+// has its own entities in the context cache.
+func WithContextCache(c context.Context) context.Context {
+	return context.WithValue(c, &contextCacheKey, &contextCache{
+		entities: map[contextCacheEntity]datastore.PropertyList{},
+	})
+}
+
+func contextCacheFromContext(c context.Context) (*contextCache, bool) {
+	cc, ok := c.Value(&contextCacheKey).(*contextCache)
+	return cc, ok
+}
+
+func (cc *contextCache) get(cl *Client, key *datastore.Key) (
+	datastore.PropertyList, bool) {
+
+	cc.Lock()
+	defer cc.Unlock()
+	pl, ok := cc.entities[contextCacheEntity{cl, key.Encode()}]
+	if !ok || pl == nil {
+		return nil, ok
+	}
+	// Copy the properties so callers never share them.
+	return append(datastore.PropertyList{}, pl...), true
+}
+
+func (cc *contextCache) set(cl *Client, key *datastore.Key,
+	pl datastore.PropertyList) {
+
+	pl = append(datastore.PropertyList{}, pl...)
+
+	cc.Lock()
+	defer cc.Unlock()
+	cc.entities[contextCacheEntity{cl, key.Encode()}] = pl
+}
+
+// setMissing records that the entity of key does not exist.
+func (cc *contextCache) setMissing(cl *Client, key *datastore.Key) {
+	cc.Lock()
+	defer cc.Unlock()
+	cc.entities[contextCacheEntity{cl, key.Encode()}] = nil
+}
+
+func (cc *contextCache) delete(cl *Client, keys []*datastore.Key) {
+	cc.Lock()
+	defer cc.Unlock()
+	for _, key := range keys {
+		if key != nil && !key.Incomplete() {
+			delete(cc.entities, contextCacheEntity{cl, key.Encode()})
+		}
+	}
+}
+
+func (cc *contextCache) flush() {
+	cc.Lock()
+	defer cc.Unlock()
+	cc.entities = map[contextCacheEntity]datastore.PropertyList{}
+}
+
+// loadContextCache loads entities from the context cache, if c has one.
+func loadContextCache(c context.Context, cacheItems []cacheItem) {
+	cc, ok := contextCacheFromContext(c)
+	if !ok {
+		return
+	}
+
+	cl := clientFromContext(c)
+	for i, cacheItem := range cacheItems {
+		if cacheItem.policy&SkipCacheRead != 0 {
+			continue
+		}
+		pl, ok := cc.get(cl, cacheItem.key)
+		if !ok {
+			continue
+		}
+
+		if pl == nil {
+			cacheItems[i].state = done
+			cacheItems[i].err = datastore.ErrNoSuchEntity
+			continue
+		}
+
+		if err := setValue(cacheItems[i].val, pl); err == nil {
+			cacheItems[i].state = done
+			cacheItems[i].pl = pl
+		}
+	}
+}
+
+// saveContextCache stores entities that were successfully loaded in the
+// context cache, if c has one.
+func saveContextCache(c context.Context, cacheItems []cacheItem) {
+	cc, ok := contextCacheFromContext(c)
+	if !ok {
+		return
+	}
+
+	cl := clientFromContext(c)
+	for _, cacheItem := range cacheItems {
+		if cacheItem.policy&SkipCacheWrite != 0 {
+			continue
+		}
+		switch cacheItem.err {
+		case nil:
+			cc.set(cl, cacheItem.key, cacheItem.pl)
+		case datastore.ErrNoSuchEntity:
+			cc.setMissing(cl, cacheItem.key)
+		}
+	}
+}
+
+// putContextCache stores the entities just put to the datastore in the
+// context cache, if c has one. putKeys are the keys returned by the datastore
+// and are only used if err is nil.
+func putContextCache(c context.Context, keys, putKeys []*datastore.Key,
+	pls []datastore.PropertyList, err error) {
+
+	cc, ok := contextCacheFromContext(c)
+	if !ok {
+		return
+	}
+
+	// Entities put within a transaction are not visible until it commits and
+	// entities that failed to put are in an unknown state.
+	cl := clientFromContext(c)
+	if _, ok := transactionFromContext(c); ok || err != nil {
+		cc.delete(cl, keys)
+		return
+	}
+
+	cfg := configFromContext(c)
+	for i, key := range putKeys {
+		if keyPolicy(c, cfg, key)&SkipCacheWrite != 0 {
+			cc.delete(cl, []*datastore.Key{key})
+			continue
+		}
+		cc.set(cl, key, pls[i])
+	}
+}
@@ -0,0 +1,206 @@
+package nds_test
+
+import (
+	"testing"
+
+	"github.com/qedus/nds"
+	"github.com/qedus/nds/ndstest"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// putBehind puts src to d without going through nds, so that tests can tell
+// where Get loads entities from.
+func putBehind(t *testing.T, d *ndstest.Datastore, key *datastore.Key,
+	src interface{}) {
+
+	props, err := datastore.SaveStruct(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.PutMulti(context.Background(), []*datastore.Key{key},
+		[]datastore.PropertyList{props}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestContextCache(t *testing.T) {
+	d := ndstest.NewDatastore()
+	ndstest.Install(t, d, ndstest.NewCache())
+	c := context.Background()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	cc := nds.WithContextCache(c)
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(cc, key, &testEntity{42}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Change the entity behind nds' back so we can tell where Get loads from.
+	putBehind(t, d, key, &testEntity{43})
+
+	entity := &testEntity{}
+	if err := nds.Get(cc, key, entity); err != nil {
+		t.Fatal(err)
+	}
+	if entity.IntVal != 42 {
+		t.Fatal("expected entity from context cache", entity.IntVal)
+	}
+
+	// Other contexts never see the context cache.
+	entity = &testEntity{}
+	if err := nds.Get(nds.WithContextCache(c), key, entity); err != nil {
+		t.Fatal(err)
+	}
+	if entity.IntVal != 43 {
+		t.Fatal("expected entity from datastore", entity.IntVal)
+	}
+
+	if err := nds.Delete(cc, key); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := nds.Get(cc, key, &testEntity{}); err != datastore.ErrNoSuchEntity {
+		t.Fatal("expected datastore.ErrNoSuchEntity", err)
+	}
+
+	// The missing entity is now cached too.
+	putBehind(t, d, key, &testEntity{44})
+	if err := nds.Get(cc, key, &testEntity{}); err != datastore.ErrNoSuchEntity {
+		t.Fatal("expected datastore.ErrNoSuchEntity", err)
+	}
+}
+
+func TestContextCacheIncompleteKey(t *testing.T) {
+	d := ndstest.NewDatastore()
+	ndstest.Install(t, d, ndstest.NewCache())
+	c := context.Background()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	cc := nds.WithContextCache(c)
+
+	keys, err := nds.PutMulti(cc,
+		[]*datastore.Key{datastore.NewIncompleteKey(c, "Entity", nil)},
+		[]testEntity{{42}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.DeleteMulti(c, keys); err != nil {
+		t.Fatal(err)
+	}
+
+	entities := make([]testEntity, 1)
+	if err := nds.GetMulti(cc, keys, entities); err != nil {
+		t.Fatal(err)
+	}
+	if entities[0].IntVal != 42 {
+		t.Fatal("expected entity from context cache", entities[0].IntVal)
+	}
+}
+
+func TestContextCacheEmptyEntity(t *testing.T) {
+	d := &countingDatastore{Datastore: ndstest.NewDatastore()}
+	ndstest.Install(t, d, ndstest.NewCache())
+	c := context.Background()
+
+	type emptyEntity struct{}
+
+	cc := nds.WithContextCache(c)
+
+	// Entities without properties are not mistaken for missing ones, whether
+	// they are put or got through the context cache.
+	putKey := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(cc, putKey, &emptyEntity{}); err != nil {
+		t.Fatal(err)
+	}
+	getKey := datastore.NewKey(c, "Entity", "", 2, nil)
+	putBehind(t, d.Datastore, getKey, &emptyEntity{})
+
+	for i := 0; i < 2; i++ {
+		for _, key := range []*datastore.Key{putKey, getKey} {
+			if err := nds.Get(cc, key, &emptyEntity{}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if d.gets != 1 {
+		t.Fatal("incorrect gets", d.gets)
+	}
+}
+
+func TestContextCacheTransaction(t *testing.T) {
+	c := ndstest.NewContext(t)
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	cc := nds.WithContextCache(c)
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(cc, key, &testEntity{42}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := nds.RunInTransaction(cc, func(tc context.Context) error {
+		_, err := nds.Put(tc, key, &testEntity{43})
+		return err
+	}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	entity := &testEntity{}
+	if err := nds.Get(cc, key, entity); err != nil {
+		t.Fatal(err)
+	}
+	if entity.IntVal != 43 {
+		t.Fatal("expected committed entity", entity.IntVal)
+	}
+}
+
+func TestContextCacheClients(t *testing.T) {
+	cl1, cl2 := ndstest.NewClient(t), ndstest.NewClient(t)
+	cc := nds.WithContextCache(context.Background())
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	key := datastore.NewKey(cc, "Entity", "", 1, nil)
+	if _, err := cl1.Put(cc, key, &testEntity{42}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each Client only sees the entities of its own Datastore.
+	if err := cl2.Get(cc, key, &testEntity{}); err != datastore.ErrNoSuchEntity {
+		t.Fatal("expected datastore.ErrNoSuchEntity", err)
+	}
+	entity := &testEntity{}
+	if err := cl1.Get(cc, key, entity); err != nil {
+		t.Fatal(err)
+	} else if entity.IntVal != 42 {
+		t.Fatal("incorrect IntVal", entity.IntVal)
+	}
+
+	// Deletes only remove the entities of their Client.
+	if _, err := cl2.Put(cc, key, &testEntity{43}); err != nil {
+		t.Fatal(err)
+	}
+	if err := cl1.Delete(cc, key); err != nil {
+		t.Fatal(err)
+	}
+	entity = &testEntity{}
+	if err := cl2.Get(cc, key, entity); err != nil {
+		t.Fatal(err)
+	} else if entity.IntVal != 43 {
+		t.Fatal("incorrect IntVal", entity.IntVal)
+	}
+}
@@ -0,0 +1,143 @@
+package nds
+
+import (
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+// The variables in this block are here so that we can test all error code
+// paths by substituting them with error producing ones.
+var (
+	datastoreDeleteMulti      = datastore.DeleteMulti
+	datastoreGetMulti         = datastore.GetMulti
+	datastorePutMulti         = datastore.PutMulti
+	datastoreRunInTransaction = datastore.RunInTransaction
+)
+
+// Datastore is the interface nds uses to store entities. Each method must
+// behave like its google.golang.org/appengine/datastore equivalent, including
+// returning an appengine.MultiError containing datastore.ErrNoSuchEntity for
+// missing entities. Entities are always passed as PropertyLists; nds converts
+// them to and from the values its callers use.
+type Datastore interface {
+	GetMulti(c context.Context,
+		keys []*datastore.Key, vals []datastore.PropertyList) error
+	PutMulti(c context.Context, keys []*datastore.Key,
+		vals []datastore.PropertyList) ([]*datastore.Key, error)
+	DeleteMulti(c context.Context, keys []*datastore.Key) error
+
+	// QueryKeys runs a keys-only query. It must return q.Limit keys unless
+	// there are fewer results, along with a cursor positioned after the last
+	// key returned or, if no keys are returned, after the q.Offset keys
+	// skipped.
+	QueryKeys(c context.Context, q *KeysQuery) ([]*datastore.Key, Cursor,
+		error)
+
+	// RunInTransaction runs f in a transaction. GetMulti, PutMulti and
+	// DeleteMulti calls made with the context passed to f must be part of
+	// the transaction. PutMulti must return complete keys for incomplete keys
+	// even within a transaction.
+	RunInTransaction(c context.Context, f func(tc context.Context) error,
+		opts *datastore.TransactionOptions) error
+}
+
+// SetDatastore sets the Datastore of the default Client, which is used by nds
+// calls whose contexts have no Client. By default, or if d is nil, the App
+// Engine datastore is used. SetDatastore is not safe to call concurrently with
+// other nds functions and should therefore be called during program
+// initialization.
+func SetDatastore(d Datastore) {
+	if d == nil {
+		d = appengineDatastore{}
+	}
+	defaultClient.datastore = d
+}
+
+// appengineDatastore is the default Datastore and uses the App Engine
+// datastore.
+type appengineDatastore struct{}
+
+func (appengineDatastore) GetMulti(c context.Context,
+	keys []*datastore.Key, vals []datastore.PropertyList) error {
+	return datastoreGetMulti(c, keys, vals)
+}
+
+func (appengineDatastore) PutMulti(c context.Context, keys []*datastore.Key,
+	vals []datastore.PropertyList) ([]*datastore.Key, error) {
+	return datastorePutMulti(c, keys, vals)
+}
+
+func (appengineDatastore) DeleteMulti(c context.Context,
+	keys []*datastore.Key) error {
+	return datastoreDeleteMulti(c, keys)
+}
+
+func (appengineDatastore) RunInTransaction(c context.Context,
+	f func(tc context.Context) error,
+	opts *datastore.TransactionOptions) error {
+	return datastoreRunInTransaction(c, f, opts)
+}
+
+func (appengineDatastore) QueryKeys(c context.Context,
+	kq *KeysQuery) ([]*datastore.Key, Cursor, error) {
+
+	q := datastore.NewQuery(kq.Kind).KeysOnly().
+		Offset(kq.Offset).Limit(kq.Limit)
+	if kq.Ancestor != nil {
+		q = q.Ancestor(kq.Ancestor)
+	}
+	for _, f := range kq.Filters {
+		q = q.Filter(f.Property+" "+f.Operator, f.Value)
+	}
+	for _, o := range kq.Orders {
+		if o.Descending {
+			q = q.Order("-" + o.Property)
+		} else {
+			q = q.Order(o.Property)
+		}
+	}
+	if kq.EventualConsistency {
+		q = q.EventualConsistency()
+	}
+	if kq.Start != "" {
+		cursor, err := datastore.DecodeCursor(string(kq.Start))
+		if err != nil {
+			return nil, "", err
+		}
+		q = q.Start(cursor)
+	}
+	if kq.End != "" {
+		cursor, err := datastore.DecodeCursor(string(kq.End))
+		if err != nil {
+			return nil, "", err
+		}
+		q = q.End(cursor)
+	}
+
+	if kq.Namespace != "" {
+		var err error
+		if c, err = appengine.Namespace(c, kq.Namespace); err != nil {
+			return nil, "", err
+		}
+	}
+
+	keys := []*datastore.Key{}
+	t := q.Run(c)
+	for {
+		key, err := t.Next(nil)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		keys = append(keys, key)
+	}
+
+	cursor, err := t.Cursor()
+	if err != nil {
+		return nil, "", err
+	}
+	return keys, Cursor(cursor.String()), nil
+}
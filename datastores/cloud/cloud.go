@@ -0,0 +1,415 @@
+// Package cloud provides an nds.Datastore that stores entities using a
+// cloud.google.com/go/datastore Client. This allows nds to be used outside of
+// App Engine, for example on Cloud Run, while keeping the same caching
+// semantics:
+//
+//	client, err := datastore.NewClient(ctx, projectID)
+//	...
+//	nds.SetDatastore(cloud.NewDatastore(client, projectID))
+//	nds.SetCache(redis.NewCache(pool))
+//	nds.SetLogger(func(c context.Context, format string, args ...interface{}) {
+//		log.Printf(format, args...)
+//	})
+//
+// nds continues to use google.golang.org/appengine/datastore keys and
+// properties. Outside of App Engine, datastore.NewKey needs an application ID
+// which can be provided with the GAE_APPLICATION environment variable.
+// Alternatively NewKey and AppEngineKey create keys without one.
+package cloud
+
+import (
+	"strings"
+
+	"cloud.google.com/go/datastore"
+	"github.com/qedus/nds"
+	"github.com/qedus/nds/internal/keys"
+	"golang.org/x/net/context"
+	"google.golang.org/api/iterator"
+	"google.golang.org/appengine"
+	aedatastore "google.golang.org/appengine/datastore"
+)
+
+var transactionKey = "used for *datastore.Transaction"
+
+func transactionFromContext(c context.Context) (*datastore.Transaction, bool) {
+	tx, ok := c.Value(&transactionKey).(*datastore.Transaction)
+	return tx, ok
+}
+
+// Datastore is an nds.Datastore that uses a Cloud Datastore client.
+type Datastore struct {
+	client *datastore.Client
+	appID  string
+}
+
+var _ nds.Datastore = (*Datastore)(nil)
+
+// NewDatastore returns a Datastore that uses client. appID is the
+// application ID given to keys created by the Datastore, usually the Google
+// Cloud project ID.
+func NewDatastore(client *datastore.Client, appID string) *Datastore {
+	return &Datastore{
+		client: client,
+		appID:  appID,
+	}
+}
+
+// NewKey creates an App Engine datastore key for use with nds without
+// needing an App Engine context.
+func (d *Datastore) NewKey(namespace, kind, stringID string, intID int64,
+	parent *aedatastore.Key) *aedatastore.Key {
+	return keys.New(d.appID, namespace, kind, stringID, intID, parent)
+}
+
+// GetMulti loads the entities for keys into vals.
+func (d *Datastore) GetMulti(c context.Context,
+	keys []*aedatastore.Key, vals []aedatastore.PropertyList) error {
+
+	cloudKeys := CloudKeys(keys)
+	cloudVals := make([]datastore.PropertyList, len(keys))
+
+	var err error
+	if tx, ok := transactionFromContext(c); ok {
+		err = tx.GetMulti(cloudKeys, cloudVals)
+	} else {
+		err = d.client.GetMulti(c, cloudKeys, cloudVals)
+	}
+
+	me, isMultiErr := err.(datastore.MultiError)
+	if err != nil && !isMultiErr {
+		return convertError(err)
+	}
+
+	for i := range cloudVals {
+		if isMultiErr && me[i] != nil {
+			continue
+		}
+		vals[i] = toAppEngineProperties(cloudVals[i], "", keys[i])
+	}
+	return convertError(err)
+}
+
+// PutMulti saves vals for keys. Incomplete keys are allocated IDs before the
+// entities are saved so that complete keys can be returned within
+// transactions.
+func (d *Datastore) PutMulti(c context.Context, keys []*aedatastore.Key,
+	vals []aedatastore.PropertyList) ([]*aedatastore.Key, error) {
+
+	cloudKeys := CloudKeys(keys)
+	cloudVals := make([]datastore.PropertyList, len(vals))
+	for i, pl := range vals {
+		cloudVals[i] = toCloudProperties(pl)
+	}
+
+	tx, inTransaction := transactionFromContext(c)
+	if inTransaction {
+		if err := d.allocateIDs(c, cloudKeys); err != nil {
+			return nil, err
+		}
+		if _, err := tx.PutMulti(cloudKeys, cloudVals); err != nil {
+			return nil, convertError(err)
+		}
+	} else {
+		var err error
+		cloudKeys, err = d.client.PutMulti(c, cloudKeys, cloudVals)
+		if err != nil {
+			return nil, convertError(err)
+		}
+	}
+
+	putKeys := make([]*aedatastore.Key, len(keys))
+	for i, key := range keys {
+		if key.Incomplete() {
+			putKeys[i] = AppEngineKey(cloudKeys[i], key.AppID())
+		} else {
+			putKeys[i] = key
+		}
+	}
+	return putKeys, nil
+}
+
+func (d *Datastore) allocateIDs(c context.Context,
+	cloudKeys []*datastore.Key) error {
+
+	incompleteKeys := []*datastore.Key{}
+	incompleteIndexes := []int{}
+	for i, key := range cloudKeys {
+		if key != nil && key.Incomplete() {
+			incompleteKeys = append(incompleteKeys, key)
+			incompleteIndexes = append(incompleteIndexes, i)
+		}
+	}
+	if len(incompleteKeys) == 0 {
+		return nil
+	}
+
+	allocatedKeys, err := d.client.AllocateIDs(c, incompleteKeys)
+	if err != nil {
+		return convertError(err)
+	}
+	for i, index := range incompleteIndexes {
+		cloudKeys[index] = allocatedKeys[i]
+	}
+	return nil
+}
+
+// DeleteMulti deletes the entities for keys.
+func (d *Datastore) DeleteMulti(c context.Context,
+	keys []*aedatastore.Key) error {
+
+	cloudKeys := CloudKeys(keys)
+	if tx, ok := transactionFromContext(c); ok {
+		return convertError(tx.DeleteMulti(cloudKeys))
+	}
+	return convertError(d.client.DeleteMulti(c, cloudKeys))
+}
+
+// QueryKeys runs a keys-only query. The query's namespace defaults to the
+// default namespace as Cloud Datastore contexts do not have one.
+func (d *Datastore) QueryKeys(c context.Context,
+	kq *nds.KeysQuery) ([]*aedatastore.Key, nds.Cursor, error) {
+
+	// Cloud Datastore iterators do not skip offsets for queries with a zero
+	// limit, so fetch a key that is then ignored.
+	limit := kq.Limit
+	if limit == 0 {
+		limit = 1
+	}
+
+	q := datastore.NewQuery(kq.Kind).KeysOnly().Namespace(kq.Namespace).
+		Offset(kq.Offset).Limit(limit)
+	if kq.Ancestor != nil {
+		q = q.Ancestor(CloudKey(kq.Ancestor))
+	}
+	for _, f := range kq.Filters {
+		q = q.FilterField(f.Property, f.Operator, toCloudValue(f.Value))
+	}
+	for _, o := range kq.Orders {
+		if o.Descending {
+			q = q.Order("-" + o.Property)
+		} else {
+			q = q.Order(o.Property)
+		}
+	}
+	if kq.EventualConsistency {
+		q = q.EventualConsistency()
+	}
+	if kq.Start != "" {
+		cursor, err := datastore.DecodeCursor(string(kq.Start))
+		if err != nil {
+			return nil, "", err
+		}
+		q = q.Start(cursor)
+	}
+	if kq.End != "" {
+		cursor, err := datastore.DecodeCursor(string(kq.End))
+		if err != nil {
+			return nil, "", err
+		}
+		q = q.End(cursor)
+	}
+	if tx, ok := transactionFromContext(c); ok {
+		q = q.Transaction(tx)
+	}
+
+	keys := []*aedatastore.Key{}
+	t := d.client.Run(c, q)
+	for len(keys) < kq.Limit {
+		key, err := t.Next(nil)
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, "", convertError(err)
+		}
+		keys = append(keys, AppEngineKey(key, d.appID))
+	}
+
+	cursor, err := t.Cursor()
+	if err != nil {
+		return nil, "", convertError(err)
+	}
+	return keys, nds.Cursor(cursor.String()), nil
+}
+
+// RunInTransaction runs f in a Cloud Datastore transaction. opts.XG is
+// ignored as Cloud Datastore transactions can always span entity groups.
+func (d *Datastore) RunInTransaction(c context.Context,
+	f func(tc context.Context) error,
+	opts *aedatastore.TransactionOptions) error {
+
+	txOpts := []datastore.TransactionOption{}
+	if opts != nil {
+		if opts.Attempts > 0 {
+			txOpts = append(txOpts, datastore.MaxAttempts(opts.Attempts))
+		}
+		if opts.ReadOnly {
+			txOpts = append(txOpts, datastore.ReadOnly)
+		}
+	}
+
+	_, err := d.client.RunInTransaction(c, func(tx *datastore.Transaction) error {
+		return f(context.WithValue(c, &transactionKey, tx))
+	}, txOpts...)
+	return convertError(err)
+}
+
+// CloudKey converts an App Engine datastore key into a Cloud Datastore key.
+func CloudKey(key *aedatastore.Key) *datastore.Key {
+	if key == nil {
+		return nil
+	}
+	return &datastore.Key{
+		Kind:      key.Kind(),
+		ID:        key.IntID(),
+		Name:      key.StringID(),
+		Parent:    CloudKey(key.Parent()),
+		Namespace: key.Namespace(),
+	}
+}
+
+// CloudKeys converts App Engine datastore keys into Cloud Datastore keys.
+func CloudKeys(keys []*aedatastore.Key) []*datastore.Key {
+	cloudKeys := make([]*datastore.Key, len(keys))
+	for i, key := range keys {
+		cloudKeys[i] = CloudKey(key)
+	}
+	return cloudKeys
+}
+
+// AppEngineKey converts a Cloud Datastore key into an App Engine datastore
+// key with the given application ID.
+func AppEngineKey(key *datastore.Key, appID string) *aedatastore.Key {
+	if key == nil {
+		return nil
+	}
+	return keys.New(appID, key.Namespace, key.Kind, key.Name, key.ID,
+		AppEngineKey(key.Parent, appID))
+}
+
+func toCloudProperties(pl aedatastore.PropertyList) datastore.PropertyList {
+	cloudPL := make(datastore.PropertyList, 0, len(pl))
+	multiple := map[string]int{}
+	for _, p := range pl {
+		value := toCloudValue(p.Value)
+		if !p.Multiple {
+			cloudPL = append(cloudPL, datastore.Property{
+				Name:    p.Name,
+				Value:   value,
+				NoIndex: p.NoIndex,
+			})
+			continue
+		}
+
+		// Cloud Datastore represents multiple values as a single property
+		// holding a slice.
+		if i, ok := multiple[p.Name]; ok {
+			values := cloudPL[i].Value.([]interface{})
+			cloudPL[i].Value = append(values, value)
+			continue
+		}
+		multiple[p.Name] = len(cloudPL)
+		cloudPL = append(cloudPL, datastore.Property{
+			Name:    p.Name,
+			Value:   []interface{}{value},
+			NoIndex: p.NoIndex,
+		})
+	}
+	return cloudPL
+}
+
+func toCloudValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case *aedatastore.Key:
+		return CloudKey(v)
+	case aedatastore.ByteString:
+		return []byte(v)
+	case appengine.BlobKey:
+		return string(v)
+	case appengine.GeoPoint:
+		return datastore.GeoPoint{Lat: v.Lat, Lng: v.Lng}
+	default:
+		return v
+	}
+}
+
+// toAppEngineProperties converts Cloud Datastore properties. Nested entities
+// are flattened using dotted property names in the same way the App Engine
+// datastore stores nested structs.
+func toAppEngineProperties(cloudPL datastore.PropertyList, prefix string,
+	key *aedatastore.Key) aedatastore.PropertyList {
+
+	pl := aedatastore.PropertyList{}
+	for _, p := range cloudPL {
+		name := prefix + p.Name
+		if values, ok := p.Value.([]interface{}); ok {
+			for _, value := range values {
+				pl = appendAppEngineProperty(pl, name, value, p.NoIndex,
+					true, key)
+			}
+			continue
+		}
+		pl = appendAppEngineProperty(pl, name, p.Value, p.NoIndex, false, key)
+	}
+	return pl
+}
+
+func appendAppEngineProperty(pl aedatastore.PropertyList, name string,
+	value interface{}, noIndex, multiple bool,
+	key *aedatastore.Key) aedatastore.PropertyList {
+
+	switch v := value.(type) {
+	case *datastore.Entity:
+		sub := toAppEngineProperties(datastore.PropertyList(v.Properties),
+			name+".", key)
+		for i := range sub {
+			sub[i].Multiple = sub[i].Multiple || multiple
+		}
+		return append(pl, sub...)
+	case *datastore.Key:
+		value = AppEngineKey(v, key.AppID())
+	case []byte:
+		if !noIndex {
+			value = aedatastore.ByteString(v)
+		}
+	case datastore.GeoPoint:
+		value = appengine.GeoPoint{Lat: v.Lat, Lng: v.Lng}
+	}
+
+	return append(pl, aedatastore.Property{
+		Name:     name,
+		Value:    value,
+		NoIndex:  noIndex,
+		Multiple: multiple,
+	})
+}
+
+// convertError converts Cloud Datastore errors into their App Engine
+// equivalents as nds expects.
+func convertError(err error) error {
+	if me, ok := err.(datastore.MultiError); ok {
+		converted := make(appengine.MultiError, len(me))
+		for i, e := range me {
+			converted[i] = convertError(e)
+		}
+		return converted
+	}
+
+	switch err {
+	case datastore.ErrNoSuchEntity:
+		return aedatastore.ErrNoSuchEntity
+	case datastore.ErrInvalidEntityType:
+		return aedatastore.ErrInvalidEntityType
+	case datastore.ErrInvalidKey:
+		return aedatastore.ErrInvalidKey
+	case datastore.ErrConcurrentTransaction:
+		return aedatastore.ErrConcurrentTransaction
+	}
+
+	// Cloud Datastore wraps ErrInvalidKey with more detail.
+	if err != nil && strings.HasPrefix(err.Error(),
+		datastore.ErrInvalidKey.Error()) {
+		return aedatastore.ErrInvalidKey
+	}
+	return err
+}
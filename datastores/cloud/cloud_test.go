@@ -0,0 +1,479 @@
+package cloud_test
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/alicebob/miniredis/v2"
+	redigo "github.com/gomodule/redigo/redis"
+	"github.com/qedus/nds"
+	"github.com/qedus/nds/cachers/redis"
+	"github.com/qedus/nds/datastores/cloud"
+	"github.com/qedus/nds/internal/keys"
+	"github.com/qedus/nds/ndstest"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	aedatastore "google.golang.org/appengine/datastore"
+)
+
+func TestPropertiesRoundTrip(t *testing.T) {
+	key := keys.New("app", "ns", "Entity", "name", 0,
+		keys.New("app", "ns", "Parent", "", 7, nil))
+	now := time.Unix(1234, 5000).UTC()
+
+	pl := aedatastore.PropertyList{
+		{Name: "Int", Value: int64(1)},
+		{Name: "Bool", Value: true},
+		{Name: "String", Value: "s", NoIndex: true},
+		{Name: "Float", Value: 1.5},
+		{Name: "Key", Value: key},
+		{Name: "Time", Value: now},
+		{Name: "ByteString", Value: aedatastore.ByteString("bs")},
+		{Name: "Bytes", Value: []byte("b"), NoIndex: true},
+		{Name: "GeoPoint", Value: appengine.GeoPoint{Lat: 1, Lng: 2}},
+		{Name: "Nil", Value: nil},
+		{Name: "Multi", Value: int64(1), Multiple: true},
+		{Name: "Multi", Value: int64(2), Multiple: true},
+		{Name: "Nested.Val", Value: "n"},
+	}
+
+	cloudPL := cloud.ToCloudProperties(pl)
+	if len(cloudPL) != len(pl)-1 {
+		t.Fatal("expected multiple values to be combined", len(cloudPL))
+	}
+	for _, p := range cloudPL {
+		switch p.Name {
+		case "Key":
+			if k := p.Value.(*datastore.Key); k.Name != "name" ||
+				k.Namespace != "ns" || k.Parent.ID != 7 {
+				t.Fatal("incorrect key", k)
+			}
+		case "Multi":
+			if !reflect.DeepEqual(p.Value,
+				[]interface{}{int64(1), int64(2)}) {
+				t.Fatal("incorrect multiple values", p.Value)
+			}
+		}
+	}
+
+	got := cloud.ToAppEngineProperties(cloudPL, "", key)
+	if len(got) != len(pl) {
+		t.Fatal("incorrect property count", len(got))
+	}
+	for i := range pl {
+		if pl[i].Name == "Key" {
+			if !got[i].Value.(*aedatastore.Key).Equal(key) {
+				t.Fatal("keys not equal", got[i].Value)
+			}
+			continue
+		}
+		if !reflect.DeepEqual(got[i], pl[i]) {
+			t.Fatalf("property %d not equal: %#v vs %#v", i, got[i], pl[i])
+		}
+	}
+}
+
+func TestNestedEntity(t *testing.T) {
+	key := keys.New("app", "", "Entity", "", 1, nil)
+	cloudPL := datastore.PropertyList{
+		{Name: "Outer", Value: &datastore.Entity{
+			Properties: []datastore.Property{
+				{Name: "Inner", Value: int64(3)},
+			},
+		}},
+	}
+
+	got := cloud.ToAppEngineProperties(cloudPL, "", key)
+	expected := aedatastore.PropertyList{
+		{Name: "Outer.Inner", Value: int64(3)},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("incorrect flattened entity %#v", got)
+	}
+}
+
+func TestConvertError(t *testing.T) {
+	err := cloud.ConvertError(datastore.MultiError{
+		nil, datastore.ErrNoSuchEntity,
+	})
+	me, ok := err.(appengine.MultiError)
+	if !ok {
+		t.Fatal("expected appengine.MultiError", err)
+	}
+	if me[0] != nil || me[1] != aedatastore.ErrNoSuchEntity {
+		t.Fatal("incorrect errors", me)
+	}
+
+	if err := cloud.ConvertError(datastore.ErrConcurrentTransaction); err !=
+		aedatastore.ErrConcurrentTransaction {
+		t.Fatal("expected ErrConcurrentTransaction", err)
+	}
+}
+
+func TestGetPutDeleteMulti(t *testing.T) {
+	client, _ := newFakeClient(t)
+	d := cloud.NewDatastore(client, "nds-test")
+	c := context.Background()
+
+	putKeys, err := d.PutMulti(c, []*aedatastore.Key{
+		d.NewKey("ns", "Entity", "one", 0, nil),
+		d.NewKey("ns", "Entity", "", 0, nil),
+	}, []aedatastore.PropertyList{
+		{{Name: "Val", Value: int64(1)}},
+		{{Name: "Val", Value: int64(2)}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if putKeys[0].StringID() != "one" || putKeys[1].Incomplete() ||
+		putKeys[1].Namespace() != "ns" || putKeys[1].AppID() != "nds-test" {
+		t.Fatal("incorrect keys", putKeys)
+	}
+
+	missingKey := d.NewKey("ns", "Entity", "missing", 0, nil)
+	vals := make([]aedatastore.PropertyList, 3)
+	err = d.GetMulti(c, append(putKeys, missingKey), vals)
+	me, ok := err.(appengine.MultiError)
+	if !ok || me[0] != nil || me[1] != nil ||
+		me[2] != aedatastore.ErrNoSuchEntity {
+		t.Fatal("expected ErrNoSuchEntity for missing key", err)
+	}
+	for i, pl := range vals[:2] {
+		if len(pl) != 1 || pl[0].Value != int64(i+1) {
+			t.Fatal("incorrect properties", i, pl)
+		}
+	}
+
+	if err := d.DeleteMulti(c, putKeys); err != nil {
+		t.Fatal(err)
+	}
+	err = d.GetMulti(c, putKeys, make([]aedatastore.PropertyList, 2))
+	if me, ok := err.(appengine.MultiError); !ok ||
+		me[0] != aedatastore.ErrNoSuchEntity ||
+		me[1] != aedatastore.ErrNoSuchEntity {
+		t.Fatal("expected ErrNoSuchEntity", err)
+	}
+}
+
+func TestQueryKeys(t *testing.T) {
+	client, s := newFakeClient(t)
+	d := cloud.NewDatastore(client, "nds-test")
+	c := context.Background()
+
+	keys := make([]*aedatastore.Key, 6)
+	pls := make([]aedatastore.PropertyList, len(keys))
+	for i := range keys {
+		keys[i] = d.NewKey("ns", "Entity", "", int64(i+1), nil)
+		pls[i] = aedatastore.PropertyList{
+			{Name: "Val", Value: int64(i % 3)},
+			{Name: "Name", Value: string(rune('f' - i))},
+		}
+	}
+	if _, err := d.PutMulti(c, keys, pls); err != nil {
+		t.Fatal(err)
+	}
+
+	query := func(kq nds.KeysQuery, want ...int) nds.Cursor {
+		t.Helper()
+		kq.Kind, kq.Namespace = "Entity", "ns"
+		got, cursor, err := d.QueryKeys(c, &kq)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != len(want) {
+			t.Fatal("incorrect keys", got)
+		}
+		for i, j := range want {
+			if !got[i].Equal(keys[j]) {
+				t.Fatal("incorrect key", i, got[i])
+			}
+		}
+		return cursor
+	}
+
+	// Filters and orders.
+	query(nds.KeysQuery{
+		Filters: []nds.Filter{{Property: "Val", Operator: "=", Value: 1}},
+		Limit:   10,
+	}, 1, 4)
+	query(nds.KeysQuery{
+		Filters: []nds.Filter{
+			{Property: "Val", Operator: ">=", Value: int64(1)},
+			{Property: "Name", Operator: "<", Value: "e"},
+		},
+		Orders: []nds.Order{{Property: "Name"}},
+		Limit:  10,
+	}, 5, 4, 2)
+	query(nds.KeysQuery{
+		Orders: []nds.Order{{Property: "Val", Descending: true}},
+		Limit:  3,
+	}, 2, 5, 1)
+
+	// Limits, offsets and cursors.
+	cursor := query(nds.KeysQuery{Offset: 1, Limit: 2}, 1, 2)
+	end := query(nds.KeysQuery{Start: cursor, Limit: 2}, 3, 4)
+	query(nds.KeysQuery{Start: cursor, End: end, Limit: 10}, 3, 4)
+
+	// Queries with zero limits return cursors positioned after their offsets.
+	cursor = query(nds.KeysQuery{Offset: 4})
+	query(nds.KeysQuery{Start: cursor, Limit: 10}, 4, 5)
+
+	// Ancestor queries only return the descendants of their ancestor.
+	parent := d.NewKey("ns", "Parent", "", 1, nil)
+	child, err := d.PutMulti(c, []*aedatastore.Key{
+		d.NewKey("ns", "Entity", "", 1, parent),
+	}, pls[:1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys = append(keys, child...)
+	query(nds.KeysQuery{Ancestor: parent, Limit: 10}, len(keys)-1)
+
+	if s.queries == 0 {
+		t.Fatal("expected queries")
+	}
+}
+
+func TestRunInTransaction(t *testing.T) {
+	client, s := newFakeClient(t)
+	d := cloud.NewDatastore(client, "nds-test")
+	c := context.Background()
+
+	key := d.NewKey("", "Entity", "", 1, nil)
+	var newKey *aedatastore.Key
+	if err := d.RunInTransaction(c, func(tc context.Context) error {
+		err := d.GetMulti(tc, []*aedatastore.Key{key},
+			make([]aedatastore.PropertyList, 1))
+		if me, ok := err.(appengine.MultiError); !ok ||
+			me[0] != aedatastore.ErrNoSuchEntity {
+			t.Fatal("expected ErrNoSuchEntity", err)
+		}
+
+		// Incomplete keys are allocated IDs so that complete keys can be
+		// returned before the transaction commits.
+		putKeys, err := d.PutMulti(tc, []*aedatastore.Key{
+			key, d.NewKey("", "Entity", "", 0, nil),
+		}, []aedatastore.PropertyList{
+			{{Name: "Val", Value: int64(1)}},
+			{{Name: "Val", Value: int64(2)}},
+		})
+		if err != nil {
+			return err
+		}
+		newKey = putKeys[1]
+		return nil
+	}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if newKey.Incomplete() || s.allocations != 1 {
+		t.Fatal("expected allocated key", newKey, s.allocations)
+	}
+
+	vals := make([]aedatastore.PropertyList, 2)
+	if err := d.GetMulti(c, []*aedatastore.Key{key, newKey},
+		vals); err != nil {
+		t.Fatal(err)
+	}
+	if vals[1][0].Value != int64(2) {
+		t.Fatal("incorrect properties", vals[1])
+	}
+
+	// Failed transactions are rolled back.
+	errFailed := errors.New("failed")
+	if err := d.RunInTransaction(c, func(tc context.Context) error {
+		if err := d.DeleteMulti(tc,
+			[]*aedatastore.Key{key}); err != nil {
+			return err
+		}
+		return errFailed
+	}, nil); err != errFailed {
+		t.Fatal("expected errFailed", err)
+	}
+	if s.rollbacks != 1 {
+		t.Fatal("expected rollback", s.rollbacks)
+	}
+	if err := d.GetMulti(c, []*aedatastore.Key{key},
+		make([]aedatastore.PropertyList, 1)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestClient runs nds with a Cloud Datastore client.
+func TestClient(t *testing.T) {
+	client, _ := newFakeClient(t)
+	d := cloud.NewDatastore(client, "nds-test")
+	cl := nds.NewClient(d, ndstest.NewCache(), nds.Config{
+		Logger: func(_ context.Context, format string,
+			args ...interface{}) {
+			t.Logf(format, args...)
+		},
+	})
+	c := context.Background()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	key, err := cl.Put(c, d.NewKey("", "Entity", "", 0, nil),
+		&testEntity{42})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Load from the datastore then the cache.
+	for i := 0; i < 2; i++ {
+		entity := &testEntity{}
+		if err := cl.Get(c, key, entity); err != nil {
+			t.Fatal(err)
+		}
+		if entity.IntVal != 42 {
+			t.Fatal("incorrect IntVal", entity.IntVal)
+		}
+	}
+
+	if err := cl.RunInTransaction(c, func(tc context.Context) error {
+		entity := &testEntity{}
+		if err := cl.Get(tc, key, entity); err != nil {
+			return err
+		}
+		entity.IntVal++
+		_, err := cl.Put(tc, key, entity)
+		return err
+	}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	entity := &testEntity{}
+	if err := cl.Get(c, key, entity); err != nil {
+		t.Fatal(err)
+	}
+	if entity.IntVal != 43 {
+		t.Fatal("incorrect IntVal", entity.IntVal)
+	}
+
+	if err := cl.Delete(c, key); err != nil {
+		t.Fatal(err)
+	}
+	if err := cl.Get(c, key, &testEntity{}); err !=
+		aedatastore.ErrNoSuchEntity {
+		t.Fatal("expected ErrNoSuchEntity", err)
+	}
+}
+
+// TestEmulator runs nds against the Cloud Datastore emulator, started with
+// "gcloud beta emulators datastore start", and a Redis cache.
+func TestEmulator(t *testing.T) {
+	if os.Getenv("DATASTORE_EMULATOR_HOST") == "" {
+		t.Skip("DATASTORE_EMULATOR_HOST not set")
+	}
+
+	const projectID = "nds-test"
+
+	c := context.Background()
+	client, err := datastore.NewClient(c, projectID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	ds := cloud.NewDatastore(client, projectID)
+	t.Cleanup(func() {
+		nds.SetDatastore(nil)
+		nds.SetCache(nil)
+		nds.SetLogger(nil)
+	})
+	nds.SetDatastore(ds)
+	nds.SetCache(redis.NewCache(&redigo.Pool{
+		Dial: func() (redigo.Conn, error) {
+			return redigo.Dial("tcp", s.Addr())
+		},
+	}))
+	nds.SetLogger(func(c context.Context, format string,
+		args ...interface{}) {
+		t.Logf(format, args...)
+	})
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	key, err := nds.Put(c, ds.NewKey("", "Entity", "", 0, nil),
+		&testEntity{42})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.Incomplete() {
+		t.Fatal("expected complete key")
+	}
+
+	// Load from the datastore then the cache.
+	for i := 0; i < 2; i++ {
+		entity := &testEntity{}
+		if err := nds.Get(c, key, entity); err != nil {
+			t.Fatal(err)
+		}
+		if entity.IntVal != 42 {
+			t.Fatal("incorrect IntVal", entity.IntVal)
+		}
+	}
+
+	if err := nds.RunInTransaction(c, func(tc context.Context) error {
+		entity := &testEntity{}
+		if err := nds.Get(tc, key, entity); err != nil {
+			return err
+		}
+		entity.IntVal++
+		if _, err := nds.Put(tc, key, entity); err != nil {
+			return err
+		}
+
+		// Incomplete keys are allocated within transactions.
+		newKey, err := nds.Put(tc, ds.NewKey("", "Entity", "", 0, nil),
+			&testEntity{1})
+		if err != nil {
+			return err
+		}
+		if newKey.Incomplete() {
+			t.Fatal("expected complete key")
+		}
+		return nil
+	}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	entity := &testEntity{}
+	if err := nds.Get(c, key, entity); err != nil {
+		t.Fatal(err)
+	}
+	if entity.IntVal != 43 {
+		t.Fatal("incorrect IntVal", entity.IntVal)
+	}
+
+	entities := []testEntity{}
+	keys, err := nds.NewQuery("Entity").Filter("IntVal =", 43).
+		GetAll(c, &entities)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || !keys[0].Equal(key) || entities[0].IntVal != 43 {
+		t.Fatal("incorrect query results", keys, entities)
+	}
+
+	if err := nds.Delete(c, key); err != nil {
+		t.Fatal(err)
+	}
+	if err := nds.Get(c, key, &testEntity{}); err !=
+		aedatastore.ErrNoSuchEntity {
+		t.Fatal("expected ErrNoSuchEntity", err)
+	}
+}
@@ -0,0 +1,7 @@
+package cloud
+
+var (
+	ToCloudProperties     = toCloudProperties
+	ToAppEngineProperties = toAppEngineProperties
+	ConvertError          = convertError
+)
@@ -0,0 +1,368 @@
+package cloud_test
+
+import (
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+	"golang.org/x/net/context"
+	"google.golang.org/api/option"
+	pb "google.golang.org/genproto/googleapis/datastore/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
+)
+
+// fakeServer is an in-memory Cloud Datastore gRPC server covering the calls
+// made by cloud.Datastore. Transactions are applied when they commit and are
+// not isolated from each other. Queries support equality and inequality
+// filters on integer, double, boolean and string properties, composite AND
+// filters, ancestors and orders, and return all their results in one batch.
+type fakeServer struct {
+	pb.UnimplementedDatastoreServer
+
+	sync.Mutex
+	entities     map[string]*pb.Entity
+	nextID       int64
+	transactions int
+	allocations  int
+	rollbacks    int
+	queries      int
+}
+
+// newFakeClient returns a Cloud Datastore client connected to a new
+// fakeServer, which are both stopped when t completes.
+func newFakeClient(t *testing.T) (*datastore.Client, *fakeServer) {
+	s := &fakeServer{entities: map[string]*pb.Entity{}}
+	lis := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer()
+	pb.RegisterDatastoreServer(srv, s)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(c context.Context,
+			_ string) (net.Conn, error) {
+			return lis.DialContext(c)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := datastore.NewClient(context.Background(), "nds-test",
+		option.WithGRPCConn(conn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client, s
+}
+
+func fakeKey(key *pb.Key) string {
+	parts := []string{key.GetPartitionId().GetNamespaceId()}
+	for _, e := range key.Path {
+		parts = append(parts, e.Kind, strconv.FormatInt(e.GetId(), 10),
+			e.GetName())
+	}
+	return strings.Join(parts, "/")
+}
+
+// complete allocates an ID to key if it is incomplete and reports whether it
+// did.
+func (s *fakeServer) complete(key *pb.Key) bool {
+	e := key.Path[len(key.Path)-1]
+	if e.IdType != nil {
+		return false
+	}
+	s.nextID++
+	e.IdType = &pb.Key_PathElement_Id{Id: s.nextID}
+	return true
+}
+
+func (s *fakeServer) Lookup(c context.Context,
+	req *pb.LookupRequest) (*pb.LookupResponse, error) {
+
+	s.Lock()
+	defer s.Unlock()
+	res := &pb.LookupResponse{}
+	for _, key := range req.Keys {
+		if entity, ok := s.entities[fakeKey(key)]; ok {
+			res.Found = append(res.Found, &pb.EntityResult{
+				Entity:  proto.Clone(entity).(*pb.Entity),
+				Version: 1,
+			})
+		} else {
+			res.Missing = append(res.Missing, &pb.EntityResult{
+				Entity:  &pb.Entity{Key: key},
+				Version: 1,
+			})
+		}
+	}
+	return res, nil
+}
+
+func (s *fakeServer) BeginTransaction(c context.Context,
+	req *pb.BeginTransactionRequest) (*pb.BeginTransactionResponse, error) {
+
+	s.Lock()
+	defer s.Unlock()
+	s.transactions++
+	return &pb.BeginTransactionResponse{
+		Transaction: []byte(strconv.Itoa(s.transactions)),
+	}, nil
+}
+
+func (s *fakeServer) Rollback(c context.Context,
+	req *pb.RollbackRequest) (*pb.RollbackResponse, error) {
+
+	s.Lock()
+	defer s.Unlock()
+	s.rollbacks++
+	return &pb.RollbackResponse{}, nil
+}
+
+func (s *fakeServer) AllocateIds(c context.Context,
+	req *pb.AllocateIdsRequest) (*pb.AllocateIdsResponse, error) {
+
+	s.Lock()
+	defer s.Unlock()
+	s.allocations++
+	for _, key := range req.Keys {
+		s.complete(key)
+	}
+	return &pb.AllocateIdsResponse{Keys: req.Keys}, nil
+}
+
+func (s *fakeServer) Commit(c context.Context,
+	req *pb.CommitRequest) (*pb.CommitResponse, error) {
+
+	s.Lock()
+	defer s.Unlock()
+	res := &pb.CommitResponse{}
+	for _, m := range req.Mutations {
+		result := &pb.MutationResult{Version: 1}
+		var entity *pb.Entity
+		switch op := m.Operation.(type) {
+		case *pb.Mutation_Insert:
+			entity = op.Insert
+		case *pb.Mutation_Update:
+			entity = op.Update
+		case *pb.Mutation_Upsert:
+			entity = op.Upsert
+		case *pb.Mutation_Delete:
+			delete(s.entities, fakeKey(op.Delete))
+		}
+		if entity != nil {
+			if s.complete(entity.Key) {
+				result.Key = entity.Key
+			}
+			s.entities[fakeKey(entity.Key)] = entity
+		}
+		res.MutationResults = append(res.MutationResults, result)
+	}
+	return res, nil
+}
+
+func (s *fakeServer) RunQuery(c context.Context,
+	req *pb.RunQueryRequest) (*pb.RunQueryResponse, error) {
+
+	q := req.GetQuery()
+	if q == nil || len(q.Kind) != 1 {
+		return nil, status.Error(codes.Unimplemented, "unsupported query")
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	s.queries++
+
+	keys := []*pb.Key{}
+	for _, entity := range s.entities {
+		path := entity.Key.Path
+		if path[len(path)-1].Kind != q.Kind[0].Name ||
+			entity.Key.GetPartitionId().GetNamespaceId() !=
+				req.GetPartitionId().GetNamespaceId() {
+			continue
+		}
+		ok, err := matchesFilter(entity, q.Filter)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			keys = append(keys, entity.Key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := s.entities[fakeKey(keys[i])], s.entities[fakeKey(keys[j])]
+		for _, o := range q.Order {
+			name := o.Property.Name
+			cmp, _ := compareValues(a.Properties[name], b.Properties[name])
+			if o.Direction == pb.PropertyOrder_DESCENDING {
+				cmp = -cmp
+			}
+			if cmp != 0 {
+				return cmp < 0
+			}
+		}
+		return compareKeys(keys[i], keys[j]) < 0
+	})
+
+	// Cursors are the positions in the results they are after.
+	start, end := fakePosition(q.StartCursor), len(keys)
+	if q.EndCursor != nil {
+		end = fakePosition(q.EndCursor)
+	}
+	if end > len(keys) {
+		end = len(keys)
+	}
+	if start > end {
+		start = end
+	}
+
+	batch := &pb.QueryResultBatch{
+		EntityResultType: pb.EntityResult_KEY_ONLY,
+		MoreResults:      pb.QueryResultBatch_NO_MORE_RESULTS,
+	}
+	skipped := int(q.Offset)
+	if skipped > end-start {
+		skipped = end - start
+	}
+	pos := start + skipped
+	batch.SkippedResults = int32(skipped)
+	batch.SkippedCursor = fakeCursor(pos)
+	for pos < end && (q.Limit == nil || len(batch.EntityResults) <
+		int(q.Limit.Value)) {
+
+		batch.EntityResults = append(batch.EntityResults, &pb.EntityResult{
+			Entity: &pb.Entity{Key: proto.Clone(keys[pos]).(*pb.Key)},
+			Cursor: fakeCursor(pos + 1),
+		})
+		pos++
+	}
+	batch.EndCursor = fakeCursor(pos)
+	return &pb.RunQueryResponse{Batch: batch}, nil
+}
+
+func fakeCursor(pos int) []byte {
+	return []byte(strconv.Itoa(pos))
+}
+
+func fakePosition(cursor []byte) int {
+	pos, _ := strconv.Atoi(string(cursor))
+	return pos
+}
+
+func compareKeys(a, b *pb.Key) int {
+	for i := 0; i < len(a.Path) && i < len(b.Path); i++ {
+		ea, eb := a.Path[i], b.Path[i]
+		switch {
+		case ea.Kind != eb.Kind:
+			return strings.Compare(ea.Kind, eb.Kind)
+		case ea.GetId() != eb.GetId():
+			if ea.GetId() < eb.GetId() {
+				return -1
+			}
+			return 1
+		case ea.GetName() != eb.GetName():
+			return strings.Compare(ea.GetName(), eb.GetName())
+		}
+	}
+	return len(a.Path) - len(b.Path)
+}
+
+// compareValues compares two values of the same type, reporting false if
+// they cannot be compared.
+func compareValues(a, b *pb.Value) (int, bool) {
+	switch av := a.GetValueType().(type) {
+	case *pb.Value_IntegerValue:
+		if bv, ok := b.GetValueType().(*pb.Value_IntegerValue); ok {
+			switch {
+			case av.IntegerValue < bv.IntegerValue:
+				return -1, true
+			case av.IntegerValue > bv.IntegerValue:
+				return 1, true
+			}
+			return 0, true
+		}
+	case *pb.Value_DoubleValue:
+		if bv, ok := b.GetValueType().(*pb.Value_DoubleValue); ok {
+			switch {
+			case av.DoubleValue < bv.DoubleValue:
+				return -1, true
+			case av.DoubleValue > bv.DoubleValue:
+				return 1, true
+			}
+			return 0, true
+		}
+	case *pb.Value_StringValue:
+		if bv, ok := b.GetValueType().(*pb.Value_StringValue); ok {
+			return strings.Compare(av.StringValue, bv.StringValue), true
+		}
+	case *pb.Value_BooleanValue:
+		if bv, ok := b.GetValueType().(*pb.Value_BooleanValue); ok {
+			switch {
+			case av.BooleanValue == bv.BooleanValue:
+				return 0, true
+			case bv.BooleanValue:
+				return -1, true
+			}
+			return 1, true
+		}
+	}
+	return 0, false
+}
+
+func matchesFilter(entity *pb.Entity, filter *pb.Filter) (bool, error) {
+	switch f := filter.GetFilterType().(type) {
+	case nil:
+		return true, nil
+	case *pb.Filter_CompositeFilter:
+		if f.CompositeFilter.Op != pb.CompositeFilter_AND {
+			break
+		}
+		for _, filter := range f.CompositeFilter.Filters {
+			if ok, err := matchesFilter(entity, filter); !ok || err != nil {
+				return false, err
+			}
+		}
+		return true, nil
+	case *pb.Filter_PropertyFilter:
+		pf := f.PropertyFilter
+		if pf.Op == pb.PropertyFilter_HAS_ANCESTOR {
+			ancestor := pf.Value.GetKeyValue()
+			if ancestor == nil || len(ancestor.Path) > len(entity.Key.Path) {
+				return false, nil
+			}
+			prefix := &pb.Key{
+				PartitionId: entity.Key.PartitionId,
+				Path:        entity.Key.Path[:len(ancestor.Path)],
+			}
+			return fakeKey(prefix) == fakeKey(ancestor), nil
+		}
+		cmp, ok := compareValues(entity.Properties[pf.Property.Name],
+			pf.Value)
+		if !ok {
+			return false, nil
+		}
+		switch pf.Op {
+		case pb.PropertyFilter_EQUAL:
+			return cmp == 0, nil
+		case pb.PropertyFilter_LESS_THAN:
+			return cmp < 0, nil
+		case pb.PropertyFilter_LESS_THAN_OR_EQUAL:
+			return cmp <= 0, nil
+		case pb.PropertyFilter_GREATER_THAN:
+			return cmp > 0, nil
+		case pb.PropertyFilter_GREATER_THAN_OR_EQUAL:
+			return cmp >= 0, nil
+		}
+	}
+	return false, status.Error(codes.Unimplemented, "unsupported filter")
+}
@@ -6,7 +6,6 @@ import (
 	"golang.org/x/net/context"
 	"google.golang.org/appengine"
 	"google.golang.org/appengine/datastore"
-	"google.golang.org/appengine/memcache"
 )
 
 // deleteMultiLimit is the App Engine datastore limit for the maximum number
@@ -19,14 +18,15 @@ const deleteMultiLimit = 500
 // to put all the keys. It does this efficiently and concurrently.
 func DeleteMulti(c context.Context, keys []*datastore.Key) error {
 
-	callCount := (len(keys)-1)/deleteMultiLimit + 1
+	limit := configFromContext(c).deleteMultiLimit()
+	callCount := (len(keys)-1)/limit + 1
 	errs := make([]error, callCount)
 
 	var wg sync.WaitGroup
 	wg.Add(callCount)
 	for i := 0; i < callCount; i++ {
-		lo := i * deleteMultiLimit
-		hi := (i + 1) * deleteMultiLimit
+		lo := i * limit
+		hi := (i + 1) * limit
 		if hi > len(keys) {
 			hi = len(keys)
 		}
@@ -42,7 +42,7 @@ func DeleteMulti(c context.Context, keys []*datastore.Key) error {
 		return nil
 	}
 
-	return groupErrors(errs, len(keys), deleteMultiLimit)
+	return groupErrors(errs, len(keys), limit)
 }
 
 // Delete deletes the entity for the given key.
@@ -56,38 +56,38 @@ func Delete(c context.Context, key *datastore.Key) error {
 
 func deleteMulti(c context.Context, keys []*datastore.Key) error {
 
-	lockMemcacheItems := []*memcache.Item{}
-	for _, key := range keys {
-		// Worst case scenario is that we lock the entity for memcacheLockTime.
-		// datastore.Delete will raise the appropriate error.
-		if key == nil || key.Incomplete() {
-			continue
-		}
-
-		item := &memcache.Item{
-			Key:        createMemcacheKey(key),
-			Flags:      lockItem,
-			Value:      itemLock(),
-			Expiration: memcacheLockTime,
-		}
-		lockMemcacheItems = append(lockMemcacheItems, item)
-	}
+	// Worst case scenario is that we lock the entities for memcacheLockTime.
+	// datastore.Delete will raise the appropriate error for invalid keys.
+	cl, cfg := clientFromContext(c), configFromContext(c)
+	lockMemcacheItems := append(entityLockItems(cfg, keys),
+		generationLockItems(cfg, keys)...)
 
-	memcacheCtx, err := memcacheContext(c)
+	memcacheCtx, err := cl.cache.NewContext(c)
 	if err != nil {
 		return err
 	}
 
+	invalidateLocalCache(c, lockMemcacheItems)
+
+	if cc, ok := contextCacheFromContext(c); ok {
+		defer cc.delete(cl, keys)
+	}
+
 	// Make sure we can lock memcache with no errors before deleting.
 	if tx, ok := transactionFromContext(c); ok {
 		tx.Lock()
 		tx.lockMemcacheItems = append(tx.lockMemcacheItems,
 			lockMemcacheItems...)
 		tx.Unlock()
-	} else if err := memcacheSetMulti(memcacheCtx,
+		return cl.datastore.DeleteMulti(c, keys)
+	} else if err := cl.cache.SetMulti(memcacheCtx,
 		lockMemcacheItems); err != nil {
 		return err
 	}
 
-	return datastoreDeleteMulti(c, keys)
+	// Entities could have been loaded into the local cache while the
+	// datastore was being written to.
+	defer invalidateLocalCache(c, lockMemcacheItems)
+
+	return cl.datastore.DeleteMulti(c, keys)
 }
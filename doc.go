@@ -27,5 +27,77 @@ Converting Legacy Code
 To convert legacy code you will need to find and replace all invocations of
 datastore.Get, datastore.Put, datastore.Delete, datastore.RunInTransaction with
 nds.Get, nds.Put, nds.Delete and nds.RunInTransaction respectively.
+
+Queries
+
+NewQuery creates a Query that is used in the same way as datastore.Query.
+Queries are run as keys-only queries against the datastore and the resulting
+entities are then loaded through the cache in the same way as GetMulti.
+Query.CacheKeys additionally caches the keys of a query's results until an
+entity of the query's kind is changed.
+
+Cache Backends
+
+By default nds caches entities in App Engine memcache. Any other store that
+implements the Cache interface can be used instead by calling SetCache during
+program initialization. Package github.com/qedus/nds/cachers/redis provides a
+Cache backed by Redis.
+
+Similarly the App Engine datastore can be replaced with any implementation of
+the Datastore interface by calling SetDatastore. Package
+github.com/qedus/nds/datastores/cloud provides a Datastore that uses
+cloud.google.com/go/datastore so that nds can be used outside of App Engine.
+App Engine logging only works with App Engine contexts so SetLogger should also
+be called in that case.
+
+Entities are stored in the cache using encoding/gob by default. SetCodec
+selects BinaryCodec instead, whose compact format is documented so that
+services written in other languages can share the cache. SetCompression
+additionally compresses large entities. Entities too large for a single cache
+item are split across several items. SetKeyProvider encrypts cached entities.
+
+Cached entities record the version of their format so instances running
+different versions of nds can share a cache. SetCachePrefix keeps the
+entities of different application versions apart during deployments.
+
+The lock time, cache key prefix, memcache namespace, batch sizes, cache
+expirations, logger, Codec, compression, KeyProvider and LocalCache are set
+with a Config. SetConfig sets the Config used by default and WithConfig
+overrides fields of it for the calls made with a context.
+
+NewClient returns a Client with its own Datastore, Cache and Config so that
+differently configured Clients can be used in one process. The package level
+functions use a default Client configured by SetDatastore, SetCache and
+SetConfig.
+
+A Policy stops Get and GetMulti from reading entities from, or writing them
+to, the cache. The Policy function of a Config applies Policies by key, for
+example to kinds that should never be cached, and WithPolicy applies a Policy
+to the calls made with a context. Put, Delete and RunInTransaction invalidate
+cached entities whatever their Policy.
+
+Entities changed without nds, for example by other systems, can be evicted
+from the cache with InvalidateMulti, or a whole kind or namespace at once with
+InvalidateKind or InvalidateNamespace.
+
+Warm and Query.Warm load entities into the cache ahead of time, for example to
+prime it after a deployment.
+
+GetMultiAsync, PutMultiAsync and DeleteMultiAsync start calls that run while
+other work is done and return Futures whose Wait methods return the results.
+
+WithBatcher returns a request scoped context that coalesces concurrent Get and
+GetMulti calls into single calls, for example when many resolvers each get a
+single entity.
+
+Concurrent Get and GetMulti calls on an instance that miss the same entity
+share a single datastore read, the others waiting for it to be cached. Setting
+the Config's LockWait makes calls also wait for entities being cached by other
+instances rather than all loading them from the datastore at once.
+
+Testing
+
+Package github.com/qedus/nds/ndstest provides an in-memory Datastore and Cache
+so that code using nds can be tested with a plain context instead of aetest.
 */
 package nds
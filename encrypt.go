@@ -0,0 +1,133 @@
+package nds
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"io"
+
+	"golang.org/x/net/context"
+)
+
+// encryptedFlag is set in the Flags of entity items whose values are
+// encrypted. The value begins with a header holding the length of the key ID,
+// the key ID and the nonce, followed by the AES-GCM sealed entity.
+const encryptedFlag uint32 = 1 << 10
+
+// maxEncryptionOverhead is the most encryptValue adds to a value: the header
+// with the longest key ID and a 12 byte nonce, and a 16 byte AES-GCM tag.
+const maxEncryptionOverhead = 1 + 255 + 12 + 16
+
+var (
+	errNotEncrypted   = errors.New("nds: cached entity is not encrypted")
+	errEncryptedValue = errors.New("nds: invalid encrypted entity")
+	errKeyID          = errors.New("nds: KeyProvider key ID too long")
+)
+
+// KeyProvider supplies the keys used to encrypt cached entities. Keys must
+// be 16, 24 or 32 bytes long to select AES-128, AES-192 or AES-256. Methods
+// must be safe to call concurrently.
+type KeyProvider interface {
+	// CurrentKey returns the key used to encrypt entities and its ID, which
+	// is stored with each encrypted entity and is at most 255 bytes long.
+	CurrentKey(c context.Context) (id string, key []byte, err error)
+
+	// Key returns the key with the given ID, which is used to decrypt
+	// entities.
+	Key(c context.Context, id string) ([]byte, error)
+}
+
+// SetKeyProvider makes the default Client encrypt the entities it stores in
+// the Cache with AES-GCM using keys from p. Each item's cache key is
+// authenticated along with its value so items cannot be swapped between keys.
+// By default, or if p is nil, entities are not encrypted.
+//
+// Keys can be rotated by changing the key returned by CurrentKey as long as
+// Key continues to return the previous key while entities encrypted with it
+// remain cached. Entities that cannot be decrypted are loaded from the
+// datastore instead. Unencrypted entities are never used while a KeyProvider
+// is set and are replaced when next loaded. SetKeyProvider is not safe to
+// call concurrently with other nds functions and should therefore be called
+// during program initialization.
+func SetKeyProvider(p KeyProvider) {
+	defaultClient.config.KeyProvider = p
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptValue encrypts value, which is stored under memcacheKey, if cfg has
+// a KeyProvider and returns the flags to add to its item.
+func encryptValue(c context.Context, cfg *Config, memcacheKey string,
+	value []byte) ([]byte, uint32, error) {
+
+	keyProvider := cfg.KeyProvider
+	if keyProvider == nil {
+		return value, 0, nil
+	}
+
+	id, key, err := keyProvider.CurrentKey(c)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(id) > 255 {
+		return nil, 0, errKeyID
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	headerSize := 1 + len(id) + gcm.NonceSize()
+	data := make([]byte, headerSize, headerSize+len(value)+gcm.Overhead())
+	data[0] = byte(len(id))
+	copy(data[1:], id)
+	nonce := data[1+len(id):]
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, 0, err
+	}
+	return gcm.Seal(data, nonce, value, []byte(memcacheKey)),
+		encryptedFlag, nil
+}
+
+// decryptValue is the inverse of encryptValue.
+func decryptValue(c context.Context, cfg *Config, memcacheKey string,
+	flags uint32, value []byte) ([]byte, error) {
+
+	keyProvider := cfg.KeyProvider
+	if flags&encryptedFlag == 0 {
+		if keyProvider != nil {
+			return nil, errNotEncrypted
+		}
+		return value, nil
+	}
+	if keyProvider == nil {
+		return nil, errUnknownItemFlags
+	}
+
+	if len(value) == 0 || len(value) < 1+int(value[0]) {
+		return nil, errEncryptedValue
+	}
+	id := string(value[1 : 1+value[0]])
+	value = value[1+len(id):]
+
+	key, err := keyProvider.Key(c, id)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(value) < gcm.NonceSize() {
+		return nil, errEncryptedValue
+	}
+	nonce, sealed := value[:gcm.NonceSize()], value[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, sealed, []byte(memcacheKey))
+}
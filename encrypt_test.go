@@ -0,0 +1,112 @@
+package nds_test
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/qedus/nds"
+	"github.com/qedus/nds/ndstest"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// mapKeyProvider provides keys from a map.
+type mapKeyProvider struct {
+	current string
+	keys    map[string][]byte
+}
+
+func (p *mapKeyProvider) CurrentKey(c context.Context) (string, []byte,
+	error) {
+	return p.current, p.keys[p.current], nil
+}
+
+func (p *mapKeyProvider) Key(c context.Context, id string) ([]byte, error) {
+	if key, ok := p.keys[id]; ok {
+		return key, nil
+	}
+	return nil, errors.New("unknown key")
+}
+
+func TestEncryption(t *testing.T) {
+	c := context.Background()
+	d, cache := &countingDatastore{Datastore: ndstest.NewDatastore()},
+		ndstest.NewCache()
+	ndstest.Install(t, d, cache)
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewKey(c, "Entity", "", 2, nil),
+	}
+	entities := []textEntity{{"secret one"}, {"secret two"}}
+	if _, err := nds.PutMulti(c, keys, entities); err != nil {
+		t.Fatal(err)
+	}
+
+	getMulti := func(gets int) {
+		t.Helper()
+		got := make([]textEntity, len(keys))
+		if err := nds.GetMulti(c, keys, got); err != nil {
+			t.Fatal(err)
+		}
+		for i := range got {
+			if got[i] != entities[i] {
+				t.Fatal("incorrect entity", got[i])
+			}
+		}
+		if d.gets != gets {
+			t.Fatal("incorrect gets", d.gets)
+		}
+	}
+
+	// Unencrypted entities are replaced once encryption is enabled.
+	getMulti(2)
+	p := &mapKeyProvider{
+		current: "a",
+		keys:    map[string][]byte{"a": bytes.Repeat([]byte{1}, 32)},
+	}
+	nds.SetKeyProvider(p)
+	defer nds.SetKeyProvider(nil)
+	getMulti(4)
+	getMulti(4)
+
+	memcacheKeys := []string{
+		nds.CreateMemcacheKey(keys[0]),
+		nds.CreateMemcacheKey(keys[1]),
+	}
+	items, err := cache.GetMulti(c, memcacheKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, item := range items {
+		flags := item.Flags &^ nds.ItemHeaderMask
+		if flags != nds.EntityItem|nds.EncryptedFlag|nds.EpochFlag {
+			t.Fatal("expected encrypted item", item.Flags)
+		}
+		if bytes.Contains(item.Value, []byte("secret")) {
+			t.Fatal("item not encrypted")
+		}
+	}
+
+	// Rotated keys can still decrypt entities encrypted with previous keys.
+	p.current = "b"
+	p.keys["b"] = bytes.Repeat([]byte{2}, 16)
+	getMulti(4)
+
+	// Items swapped between keys cannot be decrypted so they are replaced.
+	first, second := *items[memcacheKeys[0]], *items[memcacheKeys[1]]
+	first.Key, second.Key = second.Key, first.Key
+	if err := cache.SetMulti(c, []*nds.Item{&first, &second}); err != nil {
+		t.Fatal(err)
+	}
+	getMulti(6)
+	getMulti(6)
+
+	// As are entities encrypted with unknown keys.
+	p.current = "c"
+	p.keys["c"] = bytes.Repeat([]byte{3}, 32)
+	delete(p.keys, "b")
+	getMulti(8)
+	getMulti(8)
+}
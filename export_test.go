@@ -2,6 +2,7 @@ package nds
 
 import (
 	"reflect"
+	"time"
 
 	"golang.org/x/net/context"
 	"google.golang.org/appengine/datastore"
@@ -14,8 +15,20 @@ var (
 
 	NoneItem   = noneItem
 	EntityItem = entityItem
+	LockItem   = lockItem
 
 	MemcacheMaxKeySize = memcacheMaxKeySize
+	MaxEntitySize      = maxEntitySize
+	MaxChunkExpiration = maxChunkExpiration
+	DecompressValue    = decompressValue
+
+	CompressedFlag = compressedFlag
+	ChunkedFlag    = chunkedFlag
+	EncryptedFlag  = encryptedFlag
+	EpochFlag      = epochFlag
+	ItemTypeMask   = itemTypeMask
+	ItemCodecMask  = itemCodecMask
+	ItemHeaderMask = itemCodecMask | itemVersionMask
 )
 
 func SetMemcacheAddMulti(f func(c context.Context,
@@ -65,9 +78,38 @@ func SetValue(val reflect.Value, pl datastore.PropertyList) error {
 }
 
 func CreateMemcacheKey(key *datastore.Key) string {
-	return createMemcacheKey(key)
+	return createMemcacheKey(defaultClient.config, key)
+}
+
+func ManifestChunkKeys(memcacheKey string, manifest []byte) []string {
+	keys, _, _ := manifestChunkKeys(defaultClient.config.prefix(), memcacheKey,
+		manifest)
+	return keys
 }
 
 func SetMemcacheNamespace(namespace string) {
-	memcacheNamespace = namespace
+	defaultClient.config.Namespace = namespace
+}
+
+func (lc *LocalCache) Get(key string) (uint32, []byte, bool) {
+	return lc.get(defaultClient, key)
+}
+
+func (lc *LocalCache) Set(key string, flags uint32, value []byte) {
+	lc.set(defaultClient, key, flags, value)
+}
+
+func (lc *LocalCache) SetNow(now func() time.Time) {
+	lc.now = now
+}
+
+// BatcherCalls returns the number of calls waiting in c's batcher.
+func BatcherCalls(c context.Context) int {
+	b, _ := batcherFromContext(c)
+	b.Lock()
+	defer b.Unlock()
+	if b.current == nil {
+		return 0
+	}
+	return b.current.calls
 }
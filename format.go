@@ -0,0 +1,156 @@
+package nds
+
+import (
+	"errors"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// An item's Flags form its header and describe how its value is encoded:
+//
+//	bits 0-7   item type, such as entityItem
+//	bits 8-15  encoding flags, such as compressedFlag
+//	bits 16-23 the Codec of entity items, zero if unknown
+//	bits 24-31 the format version of entity items
+//
+// Entity items written before versions were introduced have version zero and
+// were marshaled by the configured Codec. Version 2 added epochFlag.
+const (
+	itemTypeMask     uint32 = 0xff
+	itemCodecShift          = 16
+	itemCodecMask    uint32 = 0xff << itemCodecShift
+	itemVersionShift        = 24
+	itemVersionMask  uint32 = 0xff << itemVersionShift
+
+	// itemVersion is the format version of the entity items nds writes. It
+	// must be incremented whenever the meaning of an entity item changes in a
+	// way older versions of nds cannot read.
+	itemVersion uint32 = 2
+)
+
+// Codec identifiers stored in entity item headers.
+const (
+	codecIDUnknown uint32 = iota
+	codecIDGob
+	codecIDBinary
+)
+
+// defaultMemcachePrefix is the default prefix of all cache keys nds uses.
+const defaultMemcachePrefix = "NDS1:"
+
+var errUnknownItemFlags = errors.New("nds: unknown item flags")
+
+// SetCachePrefix sets the Prefix and InvalidatePrefixes of the default
+// Client's Config. By default, or if prefix is empty, "NDS1:" is used.
+//
+// Instances running different versions of nds, or using different Codecs,
+// can share cached entities. Entities written by newer versions of nds are
+// treated as cache misses by older ones and each entity records the Codec it
+// was written with. However changes to the structs entities are loaded into
+// are not detected, so an application version or deployment generation can
+// be included in the prefix to keep the entities of each version apart while
+// versions run side by side. Each version must then also invalidate the
+// entities cached by the others, otherwise they would return stale entities,
+// so the other versions' prefixes must be listed in invalidate. Put, Delete
+// and RunInTransaction lock changed entities under all of these prefixes.
+//
+// SetCachePrefix is not safe to call concurrently with other nds functions
+// and should therefore be called during program initialization.
+func SetCachePrefix(prefix string, invalidate ...string) {
+	defaultClient.config.Prefix = prefix
+	defaultClient.config.InvalidatePrefixes = invalidate
+}
+
+// codecID returns the identifier of c stored in entity item headers.
+func codecID(c Codec) uint32 {
+	switch c.(type) {
+	case GobCodec:
+		return codecIDGob
+	case BinaryCodec:
+		return codecIDBinary
+	}
+	return codecIDUnknown
+}
+
+// replaceableItem reports whether an entity item, although present, must be
+// treated as missing so that it is replaced. This is the case if it was
+// written by a newer version of nds or with a different encryption setting.
+func replaceableItem(cfg *Config, item *Item) bool {
+	version := (item.Flags & itemVersionMask) >> itemVersionShift
+	if version > itemVersion {
+		return true
+	}
+	if version > 0 {
+		switch (item.Flags & itemCodecMask) >> itemCodecShift {
+		case codecIDUnknown, codecIDGob, codecIDBinary:
+		default:
+			return true
+		}
+	}
+	return (cfg.KeyProvider != nil) != (item.Flags&encryptedFlag != 0)
+}
+
+// marshalItem marshals pl, which is to be stored under memcacheKey in epochs,
+// and returns the Flags and Value of an entity item holding it.
+func marshalItem(c context.Context, memcacheKey string, epochs []byte,
+	pl datastore.PropertyList) (uint32, []byte, error) {
+
+	cfg := configFromContext(c)
+	data, err := cfg.marshal(pl)
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(data) > maxEntitySize {
+		return 0, nil, errEntityTooLarge
+	}
+	data, compressed, err := compressValue(cfg, data)
+	if err != nil {
+		return 0, nil, err
+	}
+	data, encrypted, err := encryptValue(c, cfg, memcacheKey, data)
+	if err != nil {
+		return 0, nil, err
+	}
+	flags := itemVersion<<itemVersionShift |
+		codecID(cfg.codec())<<itemCodecShift |
+		entityItem | compressed | encrypted | epochFlag
+	return flags, addEpochs(epochs, data), nil
+}
+
+// unmarshalItem is the inverse of marshalItem.
+func unmarshalItem(c context.Context, memcacheKey string, flags uint32,
+	value []byte, pl *datastore.PropertyList) error {
+
+	encoding := flags &^ (itemTypeMask | itemCodecMask | itemVersionMask)
+	if encoding&^(compressedFlag|encryptedFlag|epochFlag) != 0 {
+		return errUnknownItemFlags
+	}
+	if flags&epochFlag != 0 {
+		if len(value) < epochsSize {
+			return errUnknownItemFlags
+		}
+		value = value[epochsSize:]
+	}
+	cfg := configFromContext(c)
+	data, err := decryptValue(c, cfg, memcacheKey, flags, value)
+	if err != nil {
+		return err
+	}
+	if data, err = decompressValue(flags, data); err != nil {
+		return err
+	}
+
+	// Entities written by another Codec are read with that Codec.
+	id := (flags & itemCodecMask) >> itemCodecShift
+	if id == codecIDUnknown || id == codecID(cfg.codec()) {
+		return cfg.unmarshal(data, pl)
+	}
+	switch id {
+	case codecIDGob:
+		return GobCodec{}.Unmarshal(data, pl)
+	case codecIDBinary:
+		return BinaryCodec{}.Unmarshal(data, pl)
+	}
+	return errUnknownItemFlags
+}
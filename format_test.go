@@ -0,0 +1,93 @@
+package nds_test
+
+import (
+	"testing"
+
+	"github.com/qedus/nds"
+	"github.com/qedus/nds/ndstest"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+func putTextEntity(t *testing.T) (context.Context, *countingDatastore,
+	*ndstest.Cache, *datastore.Key) {
+
+	c := context.Background()
+	d, cache := &countingDatastore{Datastore: ndstest.NewDatastore()},
+		ndstest.NewCache()
+	ndstest.Install(t, d, cache)
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(c, key, &textEntity{"text"}); err != nil {
+		t.Fatal(err)
+	}
+	return c, d, cache, key
+}
+
+func getTextEntity(t *testing.T, c context.Context, d *countingDatastore,
+	key *datastore.Key, gets int) {
+
+	t.Helper()
+	entity := &textEntity{}
+	if err := nds.Get(c, key, entity); err != nil {
+		t.Fatal(err)
+	}
+	if entity.Text != "text" {
+		t.Fatal("incorrect entity", entity)
+	}
+	if d.gets != gets {
+		t.Fatal("incorrect gets", d.gets)
+	}
+}
+
+func TestItemVersion(t *testing.T) {
+	c, d, cache, key := putTextEntity(t)
+	getTextEntity(t, c, d, key, 1)
+
+	// Entities written by newer versions are replaced.
+	memcacheKey := nds.CreateMemcacheKey(key)
+	items, err := cache.GetMulti(c, []string{memcacheKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	item := items[memcacheKey]
+	item.Flags |= nds.ItemHeaderMask
+	if err := cache.SetMulti(c, []*nds.Item{item}); err != nil {
+		t.Fatal(err)
+	}
+	getTextEntity(t, c, d, key, 2)
+	getTextEntity(t, c, d, key, 2)
+}
+
+func TestItemCodec(t *testing.T) {
+	c, d, _, key := putTextEntity(t)
+
+	nds.SetCodec(nds.BinaryCodec{})
+	defer nds.SetCodec(nil)
+	getTextEntity(t, c, d, key, 1)
+
+	// Entities are read with the Codec that wrote them.
+	nds.SetCodec(nds.GobCodec{})
+	getTextEntity(t, c, d, key, 1)
+}
+
+func TestSetCachePrefix(t *testing.T) {
+	c, d, _, key := putTextEntity(t)
+	defer nds.SetCachePrefix("")
+
+	nds.SetCachePrefix("old:")
+	getTextEntity(t, c, d, key, 1)
+	getTextEntity(t, c, d, key, 1)
+
+	// Entities are cached separately under each prefix.
+	nds.SetCachePrefix("new:", "old:")
+	getTextEntity(t, c, d, key, 2)
+	getTextEntity(t, c, d, key, 2)
+
+	// Changes invalidate entities cached under the other prefixes.
+	if _, err := nds.Put(c, key, &textEntity{"text"}); err != nil {
+		t.Fatal(err)
+	}
+	nds.SetCachePrefix("old:")
+	getTextEntity(t, c, d, key, 3)
+}
@@ -0,0 +1,82 @@
+package nds
+
+import (
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// Future is the result of an asynchronous nds call.
+type Future struct {
+	done chan struct{}
+	err  error
+}
+
+// run starts call in its own goroutine and completes f once it returns.
+func (f *Future) run(call func() error) {
+	f.done = make(chan struct{})
+	go func() {
+		f.err = call()
+		close(f.done)
+	}()
+}
+
+// Done returns a channel that is closed when the call completes.
+func (f *Future) Done() <-chan struct{} {
+	return f.done
+}
+
+// Wait waits for the call to complete and returns its error, which has the
+// same form as the error of the equivalent synchronous call.
+func (f *Future) Wait() error {
+	<-f.done
+	return f.err
+}
+
+// PutFuture is the result of an asynchronous PutMulti call.
+type PutFuture struct {
+	Future
+	keys []*datastore.Key
+}
+
+// Wait waits for the call to complete and returns the keys and error that
+// PutMulti would have returned.
+func (f *PutFuture) Wait() ([]*datastore.Key, error) {
+	<-f.done
+	return f.keys, f.err
+}
+
+// GetMultiAsync starts a GetMulti call and returns immediately so that other
+// work can be done while it runs. vals must not be used until the call has
+// completed. Calls within a transaction must complete before the function
+// passed to RunInTransaction returns.
+func GetMultiAsync(c context.Context,
+	keys []*datastore.Key, vals interface{}) *Future {
+	future := &Future{}
+	future.run(func() error {
+		return GetMulti(c, keys, vals)
+	})
+	return future
+}
+
+// PutMultiAsync starts a PutMulti call and returns immediately in the same
+// way as GetMultiAsync.
+func PutMultiAsync(c context.Context,
+	keys []*datastore.Key, vals interface{}) *PutFuture {
+	future := &PutFuture{}
+	future.run(func() error {
+		var err error
+		future.keys, err = PutMulti(c, keys, vals)
+		return err
+	})
+	return future
+}
+
+// DeleteMultiAsync starts a DeleteMulti call and returns immediately in the
+// same way as GetMultiAsync.
+func DeleteMultiAsync(c context.Context, keys []*datastore.Key) *Future {
+	future := &Future{}
+	future.run(func() error {
+		return DeleteMulti(c, keys)
+	})
+	return future
+}
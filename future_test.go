@@ -0,0 +1,48 @@
+package nds_test
+
+import (
+	"testing"
+
+	"github.com/qedus/nds"
+	"github.com/qedus/nds/ndstest"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestAsync(t *testing.T) {
+	c := ndstest.NewContext(t)
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "one", 0, nil),
+		datastore.NewKey(c, "Entity", "", 0, nil),
+	}
+	putFuture := nds.PutMultiAsync(c, keys,
+		[]textEntity{{"one"}, {"two"}})
+	<-putFuture.Done()
+	putKeys, err := putFuture.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(putKeys) != 2 || putKeys[1].Incomplete() {
+		t.Fatal("incorrect keys", putKeys)
+	}
+
+	entities := make([]textEntity, 2)
+	if err := nds.GetMultiAsync(c, putKeys, entities).Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if entities[0].Text != "one" || entities[1].Text != "two" {
+		t.Fatal("incorrect entities", entities)
+	}
+
+	if err := nds.DeleteMultiAsync(c, putKeys[:1]).Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Errors have the same form as GetMulti's.
+	err = nds.GetMultiAsync(c, putKeys, make([]textEntity, 2)).Wait()
+	me, ok := err.(appengine.MultiError)
+	if !ok || me[0] != datastore.ErrNoSuchEntity || me[1] != nil {
+		t.Fatal("expected MultiError", err)
+	}
+}
@@ -11,8 +11,6 @@ import (
 	"golang.org/x/net/context"
 	"google.golang.org/appengine"
 	"google.golang.org/appengine/datastore"
-	"google.golang.org/appengine/log"
-	"google.golang.org/appengine/memcache"
 )
 
 // getMultiLimit is the App Engine datastore limit for the maximum number
@@ -51,6 +49,10 @@ const getMultiLimit = 1000
 // datastore.PropertyLoadSaver. If an []I, each element must be a valid dst for
 // Get: it must be a struct pointer or implement datastore.PropertyLoadSaver.
 //
+// vals can also be a []datastore.PropertyList, in which case each element is
+// set to its entity's properties. This allows entities to be loaded without
+// knowing their schema at compile time.
+//
 // As a special case, datastore.PropertyList is an invalid type for dst, even
 // though a PropertyList is a slice of structs. It is treated as invalid to
 // avoid being mistakenly passed when []datastore.PropertyList was intended.
@@ -62,21 +64,26 @@ func GetMulti(c context.Context,
 		return err
 	}
 
-	callCount := (len(keys)-1)/getMultiLimit + 1
+	if b, ok := batcherFromContext(c); ok && len(keys) > 0 && b.batches(c) {
+		return b.getMulti(c, keys, v)
+	}
+
+	limit := configFromContext(c).getMultiLimit()
+	callCount := (len(keys)-1)/limit + 1
 	errs := make([]error, callCount)
 
 	var wg sync.WaitGroup
 	wg.Add(callCount)
 	for i := 0; i < callCount; i++ {
-		lo := i * getMultiLimit
-		hi := (i + 1) * getMultiLimit
+		lo := i * limit
+		hi := (i + 1) * limit
 		if hi > len(keys) {
 			hi = len(keys)
 		}
 
 		go func(i int, keys []*datastore.Key, vals reflect.Value) {
 			if _, ok := transactionFromContext(c); ok {
-				errs[i] = datastoreGetMulti(c, keys, vals.Interface())
+				errs[i] = getMultiTransaction(c, keys, vals)
 			} else {
 				errs[i] = getMulti(c, keys, vals)
 			}
@@ -89,12 +96,14 @@ func GetMulti(c context.Context,
 		return nil
 	}
 
-	return groupErrors(errs, len(keys), getMultiLimit)
+	return groupErrors(errs, len(keys), limit)
 }
 
-// Get loads the entity stored for key into val, which must be a struct pointer.
-// Currently PropertyLoadSaver is not implemented. If there is no such entity
-// for the key, Get returns ErrNoSuchEntity.
+// Get loads the entity stored for key into val, which must be a struct
+// pointer, a *datastore.PropertyList or implement PropertyLoadSaver. A
+// *datastore.PropertyList is set to the entity's properties rather than
+// appended to. If there is no such entity for the key, Get returns
+// ErrNoSuchEntity.
 //
 // The values of val's unmatched struct fields are not modified, and matching
 // slice-typed fields are not reset before appending to them. In particular, it
@@ -117,12 +126,46 @@ func Get(c context.Context, key *datastore.Key, val interface{}) error {
 	return err
 }
 
+// getMultiTransaction gets entities directly from the datastore as the cache
+// cannot be used within transactions.
+func getMultiTransaction(c context.Context,
+	keys []*datastore.Key, vals reflect.Value) error {
+
+	ds := clientFromContext(c).datastore
+	pls := make([]datastore.PropertyList, len(keys))
+
+	var me appengine.MultiError
+	if err := ds.GetMulti(c, keys, pls); err == nil {
+		me = make(appengine.MultiError, len(keys))
+	} else if e, ok := err.(appengine.MultiError); ok {
+		me = e
+	} else {
+		return err
+	}
+
+	errsNil := true
+	for i := range keys {
+		if me[i] == nil {
+			me[i] = setValue(vals.Index(i), pls[i])
+		}
+		if me[i] != nil {
+			errsNil = false
+		}
+	}
+
+	if errsNil {
+		return nil
+	}
+	return me
+}
+
 type cacheState byte
 
 const (
 	miss cacheState = iota
 	internalLock
 	externalLock
+	waiting
 	done
 )
 
@@ -133,7 +176,27 @@ type cacheItem struct {
 	val reflect.Value
 	err error
 
-	item *memcache.Item
+	item *Item
+
+	// chunks hold item's value when it is too large for a single item.
+	chunks []*Item
+
+	// pl is the PropertyList val was successfully loaded from.
+	pl datastore.PropertyList
+
+	policy Policy
+
+	// epochKeys are the keys of the epochs of key's namespace and kind, and
+	// epochs their values when the entity was locked.
+	epochKeys []string
+	epochs    []byte
+
+	// lock is the value of another call's lock on the entity. wait is the
+	// flight of that call if it is on this instance, and flight the flight of
+	// this call if it holds the lock.
+	lock   []byte
+	wait   *flight
+	flight *flight
 
 	state cacheState
 }
@@ -147,29 +210,68 @@ type cacheItem struct {
 func getMulti(c context.Context,
 	keys []*datastore.Key, vals reflect.Value) error {
 
+	cfg := configFromContext(c)
 	cacheItems := make([]cacheItem, len(keys))
+	bypass := len(keys) > 0
 	for i, key := range keys {
 		cacheItems[i].key = key
-		cacheItems[i].memcacheKey = createMemcacheKey(key)
+		cacheItems[i].memcacheKey = createMemcacheKey(cfg, key)
+		cacheItems[i].epochKeys = createEpochKeys(cfg, key)
 		cacheItems[i].val = vals.Index(i)
 		cacheItems[i].state = miss
+		cacheItems[i].policy = keyPolicy(c, cfg, key)
+		if cacheItems[i].policy&BypassCache != BypassCache {
+			bypass = false
+		}
+	}
+
+	// Entities that bypass the cache are got as they are in transactions.
+	if bypass {
+		return getMultiTransaction(c, keys, vals)
 	}
 
-	memcacheCtx, err := memcacheContext(c)
+	memcacheCtx, err := clientFromContext(c).cache.NewContext(c)
 	if err != nil {
 		return err
 	}
 
+	defer finishFlights(memcacheCtx, cacheItems)
+
+	loadContextCache(c, cacheItems)
+
+	loadLocalCache(c, cacheItems)
+
 	loadMemcache(memcacheCtx, cacheItems)
 
 	lockMemcache(memcacheCtx, cacheItems)
 
+	// Entities being loaded by other calls are waited for instead of being
+	// loaded as well, avoiding a stampede on the datastore when a popular
+	// entity is evicted.
+	wait := waitLocked(memcacheCtx, cacheItems,
+		configFromContext(c).LockWait > 0)
+
 	if err := loadDatastore(c, cacheItems, vals.Type()); err != nil {
 		return err
 	}
 
 	saveMemcache(memcacheCtx, cacheItems)
 
+	// Calls only wait once the entities they locked are cached, so they never
+	// wait for each other.
+	if wait {
+		finishFlights(memcacheCtx, cacheItems)
+		if waitMemcache(memcacheCtx, cacheItems) {
+			lockMemcache(memcacheCtx, cacheItems)
+			if err := loadDatastore(c, cacheItems, vals.Type()); err != nil {
+				return err
+			}
+			saveMemcache(memcacheCtx, cacheItems)
+		}
+	}
+
+	saveContextCache(c, cacheItems)
+
 	me, errsNil := make(appengine.MultiError, len(cacheItems)), true
 	for i, cacheItem := range cacheItems {
 		if cacheItem.err != nil {
@@ -184,45 +286,113 @@ func getMulti(c context.Context,
 	return me
 }
 
+// loadLocalCache loads entities from the LocalCache, if one has been set.
+func loadLocalCache(c context.Context, cacheItems []cacheItem) {
+	cl, localCache := clientFromContext(c), configFromContext(c).LocalCache
+	if localCache == nil {
+		return
+	}
+
+	for i, cacheItem := range cacheItems {
+		if cacheItem.state != miss || cacheItem.policy&SkipCacheRead != 0 {
+			continue
+		}
+		flags, value, ok := localCache.get(cl, cacheItem.memcacheKey)
+		if !ok {
+			continue
+		}
+
+		switch flags & itemTypeMask {
+		case noneItem:
+			cacheItems[i].state = done
+			cacheItems[i].err = datastore.ErrNoSuchEntity
+		case entityItem:
+			pl := datastore.PropertyList{}
+			if err := unmarshalItem(c, cacheItem.memcacheKey, flags, value,
+				&pl); err != nil {
+				warningf(c, "nds:loadLocalCache unmarshal %s", err)
+				break
+			}
+			if err := setValue(cacheItems[i].val, pl); err == nil {
+				cacheItems[i].state = done
+				cacheItems[i].pl = pl
+			} else {
+				warningf(c, "nds:loadLocalCache setValue %s", err)
+			}
+		}
+	}
+}
+
 func loadMemcache(c context.Context, cacheItems []cacheItem) {
 
-	memcacheKeys := make([]string, len(cacheItems))
+	memcacheKeys := make([]string, 0, len(cacheItems))
+	cacheItemsIndex := make([]int, 0, len(cacheItems))
 	for i, cacheItem := range cacheItems {
-		memcacheKeys[i] = cacheItem.memcacheKey
+		if cacheItem.state == miss && cacheItem.policy&SkipCacheRead == 0 {
+			memcacheKeys = append(memcacheKeys, cacheItem.memcacheKey)
+			cacheItemsIndex = append(cacheItemsIndex, i)
+		}
+	}
+
+	if len(cacheItems) > 0 && len(memcacheKeys) == 0 {
+		return
 	}
 
-	items, err := memcacheGetMulti(c, memcacheKeys)
+	items, err := clientFromContext(c).cache.GetMulti(c,
+		append(epochKeys(cacheItems, cacheItemsIndex), memcacheKeys...))
 	if err != nil {
-		for i := range cacheItems {
+		for _, i := range cacheItemsIndex {
 			cacheItems[i].state = externalLock
 		}
-		log.Warningf(c, "nds:loadMemcache GetMulti %s", err)
+		warningf(c, "nds:loadMemcache GetMulti %s", err)
 		return
 	}
-
-	for i, memcacheKey := range memcacheKeys {
+	missingChunks := loadChunks(c, items)
+
+	cl, cfg := clientFromContext(c), configFromContext(c)
+	localCache := cfg.LocalCache
+	for j, memcacheKey := range memcacheKeys {
+		i := cacheItemsIndex[j]
+		epochs := itemEpochs(items, cacheItems[i])
+		cacheItems[i].epochs = epochs
 		if item, ok := items[memcacheKey]; ok {
-			switch item.Flags {
+			switch item.Flags & itemTypeMask {
 			case lockItem:
 				cacheItems[i].state = externalLock
+				cacheItems[i].lock = loadLock(item)
 			case noneItem:
+				if !currentItem(item, epochs) {
+					break
+				}
 				cacheItems[i].state = done
 				cacheItems[i].err = datastore.ErrNoSuchEntity
+				if cacheItems[i].policy&SkipCacheWrite == 0 {
+					localCache.set(cl, memcacheKey, item.Flags, item.Value)
+				}
 			case entityItem:
+				if missingChunks[memcacheKey] || replaceableItem(cfg, item) ||
+					!currentItem(item, epochs) {
+					break
+				}
+				// Items that cannot be unmarshaled are misses, which
+				// lockMemcache replaces.
 				pl := datastore.PropertyList{}
-				if err := unmarshal(item.Value, &pl); err != nil {
-					log.Warningf(c, "nds:loadMemcache unmarshal %s", err)
-					cacheItems[i].state = externalLock
+				if err := unmarshalItem(c, memcacheKey, item.Flags,
+					item.Value, &pl); err != nil {
 					break
 				}
 				if err := setValue(cacheItems[i].val, pl); err == nil {
 					cacheItems[i].state = done
+					cacheItems[i].pl = pl
+					if cacheItems[i].policy&SkipCacheWrite == 0 {
+						localCache.set(cl, memcacheKey, item.Flags, item.Value)
+					}
 				} else {
-					log.Warningf(c, "nds:loadMemcache setValue %s", err)
+					warningf(c, "nds:loadMemcache setValue %s", err)
 					cacheItems[i].state = externalLock
 				}
 			default:
-				log.Warningf(c, "nds:loadMemcache unknown item.Flags %d", item.Flags)
+				warningf(c, "nds:loadMemcache unknown item.Flags %d", item.Flags)
 				cacheItems[i].state = externalLock
 			}
 		}
@@ -247,30 +417,47 @@ func init() {
 
 func lockMemcache(c context.Context, cacheItems []cacheItem) {
 
-	lockItems := make([]*memcache.Item, 0, len(cacheItems))
+	cl, cfg := clientFromContext(c), configFromContext(c)
+	lockTime := cfg.lockTime()
+	lockItems := make([]*Item, 0, len(cacheItems))
 	lockMemcacheKeys := make([]string, 0, len(cacheItems))
+	cacheItemsIndex := make([]int, 0, len(cacheItems))
 	for i, cacheItem := range cacheItems {
 		if cacheItem.state == miss {
+			// Entities that are not to be cached are loaded without a lock.
+			if cacheItem.policy&SkipCacheWrite != 0 {
+				cacheItems[i].state = externalLock
+				continue
+			}
 
-			item := &memcache.Item{
+			item := &Item{
 				Key:        cacheItem.memcacheKey,
-				Flags:      lockItem,
+				Flags:      lockItem | loadLockFlag,
 				Value:      itemLock(),
-				Expiration: memcacheLockTime,
+				Expiration: lockTime,
 			}
 			cacheItems[i].item = item
 			lockItems = append(lockItems, item)
 			lockMemcacheKeys = append(lockMemcacheKeys, cacheItem.memcacheKey)
+			if cacheItem.epochs == nil {
+				cacheItemsIndex = append(cacheItemsIndex, i)
+			}
 		}
 	}
 
+	// Epochs that were not found have not started yet, or were evicted, so
+	// they are started along with the locks.
+	epochMemcacheKeys := epochKeys(cacheItems, cacheItemsIndex)
+	lockItems = append(newEpochItems(epochMemcacheKeys), lockItems...)
+
 	// We don't care if there are errors here.
-	if err := memcacheAddMulti(c, lockItems); err != nil {
-		log.Warningf(c, "nds:lockMemcache AddMulti %s", err)
+	if err := cl.cache.AddMulti(c, lockItems); err != nil {
+		warningf(c, "nds:lockMemcache AddMulti %s", err)
 	}
 
 	// Get the items again so we can use CAS when updating the cache.
-	items, err := memcacheGetMulti(c, lockMemcacheKeys)
+	items, err := cl.cache.GetMulti(c,
+		append(epochMemcacheKeys, lockMemcacheKeys...))
 
 	// Cache failed so forget about it and just use the datastore.
 	if err != nil {
@@ -279,40 +466,66 @@ func lockMemcache(c context.Context, cacheItems []cacheItem) {
 				cacheItems[i].state = externalLock
 			}
 		}
-		log.Warningf(c, "nds:lockMemcache GetMulti %s", err)
+		warningf(c, "nds:lockMemcache GetMulti %s", err)
 		return
 	}
+	missingChunks := loadChunks(c, items)
 
 	// Cache worked so figure out what items we got.
 	for i, cacheItem := range cacheItems {
 		if cacheItem.state == miss {
+			if cacheItem.epochs == nil {
+				cacheItems[i].epochs = itemEpochs(items, cacheItem)
+			}
 			if item, ok := items[cacheItem.memcacheKey]; ok {
-				switch item.Flags {
+				switch item.Flags & itemTypeMask {
 				case lockItem:
 					if bytes.Equal(item.Value, cacheItem.item.Value) {
 						cacheItems[i].item = item
 						cacheItems[i].state = internalLock
+						cacheItems[i].flight = startFlight(c,
+							cacheItem.memcacheKey, item.Value)
 					} else {
 						cacheItems[i].state = externalLock
+						cacheItems[i].lock = loadLock(item)
 					}
 				case noneItem:
+					if !currentItem(item, cacheItems[i].epochs) ||
+						cacheItem.policy&SkipCacheRead != 0 {
+						cacheItems[i].item = item
+						cacheItems[i].state = internalLock
+						break
+					}
 					cacheItems[i].state = done
 					cacheItems[i].err = datastore.ErrNoSuchEntity
 				case entityItem:
+					// The entity cannot be used so replace it as if it were
+					// our lock. CAS ensures it has not changed since.
+					if missingChunks[cacheItem.memcacheKey] ||
+						replaceableItem(cfg, item) ||
+						!currentItem(item, cacheItems[i].epochs) ||
+						cacheItem.policy&SkipCacheRead != 0 {
+						cacheItems[i].item = item
+						cacheItems[i].state = internalLock
+						break
+					}
 					pl := datastore.PropertyList{}
-					if err := unmarshal(item.Value, &pl); err != nil {
-						log.Warningf(c, "nds:lockMemcache unmarshal %s", err)
-						cacheItems[i].state = externalLock
+					if err := unmarshalItem(c, cacheItem.memcacheKey,
+						item.Flags, item.Value, &pl); err != nil {
+						warningf(c, "nds:lockMemcache unmarshal %s", err)
+						cacheItems[i].item = item
+						cacheItems[i].state = internalLock
 						break
 					}
 					if err := setValue(cacheItems[i].val, pl); err == nil {
 						cacheItems[i].state = done
+						cacheItems[i].pl = pl
 					} else {
-						log.Warningf(c, "nds:lockMemcache setValue %s", err)
+						warningf(c, "nds:lockMemcache setValue %s", err)
 						cacheItems[i].state = externalLock
 					}
 				default:
-					log.Warningf(c, "nds:lockMemcache unknown item.Flags %d",
+					warningf(c, "nds:lockMemcache unknown item.Flags %d",
 						item.Flags)
 					cacheItems[i].state = externalLock
 				}
@@ -328,6 +541,7 @@ func lockMemcache(c context.Context, cacheItems []cacheItem) {
 func loadDatastore(c context.Context, cacheItems []cacheItem,
 	valsType reflect.Type) error {
 
+	ds, cfg := clientFromContext(c).datastore, configFromContext(c)
 	keys := make([]*datastore.Key, 0, len(cacheItems))
 	vals := make([]datastore.PropertyList, 0, len(cacheItems))
 	cacheItemsIndex := make([]int, 0, len(cacheItems))
@@ -342,7 +556,7 @@ func loadDatastore(c context.Context, cacheItems []cacheItem,
 	}
 
 	var me appengine.MultiError
-	if err := datastoreGetMulti(c, keys, vals); err == nil {
+	if err := ds.GetMulti(c, keys, vals); err == nil {
 		me = make(appengine.MultiError, len(keys))
 	} else if e, ok := err.(appengine.MultiError); ok {
 		me = e
@@ -357,23 +571,37 @@ func loadDatastore(c context.Context, cacheItems []cacheItem,
 			val := cacheItems[index].val
 			if err := setValue(val, pl); err != nil {
 				cacheItems[index].err = err
+			} else {
+				cacheItems[index].pl = pl
 			}
 
 			if cacheItems[index].state == internalLock {
-				cacheItems[index].item.Flags = entityItem
-				cacheItems[index].item.Expiration = 0
-				if data, err := marshal(pl); err == nil {
+				expiration := cfg.entityExpiration(cacheItems[index].key)
+				cacheItems[index].item.Expiration = expiration
+				if flags, data, err := marshalItem(c,
+					cacheItems[index].memcacheKey,
+					cacheItems[index].epochs, pl); err == nil {
+					if len(data) > chunkSize {
+						data, cacheItems[index].chunks = splitValue(
+							cfg.prefix(), cacheItems[index].memcacheKey,
+							data, chunkExpiration(cfg, expiration))
+						flags |= chunkedFlag
+					}
+					cacheItems[index].item.Flags = flags
 					cacheItems[index].item.Value = data
 				} else {
 					cacheItems[index].state = externalLock
-					log.Warningf(c, "nds:loadDatastore marshal %s", err)
+					warningf(c, "nds:loadDatastore marshal %s", err)
 				}
 			}
 		case datastore.ErrNoSuchEntity:
 			if cacheItems[index].state == internalLock {
-				cacheItems[index].item.Flags = noneItem
-				cacheItems[index].item.Expiration = 0
-				cacheItems[index].item.Value = []byte{}
+				cacheItems[index].item.Flags = itemVersion<<itemVersionShift |
+					noneItem | epochFlag
+				cacheItems[index].item.Expiration = cfg.negativeExpiration(
+					cacheItems[index].key)
+				cacheItems[index].item.Value = addEpochs(
+					cacheItems[index].epochs, nil)
 			}
 			cacheItems[index].err = datastore.ErrNoSuchEntity
 		default:
@@ -386,14 +614,44 @@ func loadDatastore(c context.Context, cacheItems []cacheItem,
 
 func saveMemcache(c context.Context, cacheItems []cacheItem) {
 
-	saveItems := make([]*memcache.Item, 0, len(cacheItems))
+	saveItems := make([]*Item, 0, len(cacheItems))
+	chunks, chunkOwners := []*Item{}, []int{}
 	for _, cacheItem := range cacheItems {
 		if cacheItem.state == internalLock {
+			for _, chunk := range cacheItem.chunks {
+				chunks = append(chunks, chunk)
+				chunkOwners = append(chunkOwners, len(saveItems))
+			}
 			saveItems = append(saveItems, cacheItem.item)
 		}
 	}
 
-	if err := memcacheCompareAndSwapMulti(c, saveItems); err != nil {
-		log.Warningf(c, "nds:saveMemcache CompareAndSwapMulti %s", err)
+	// Chunks must be stored before the items that refer to them.
+	saveItems = saveChunks(c, saveItems, chunks, chunkOwners)
+
+	cl := clientFromContext(c)
+	err := cl.cache.CompareAndSwapMulti(c, saveItems)
+	if err != nil {
+		warningf(c, "nds:saveMemcache CompareAndSwapMulti %s", err)
+	}
+
+	// Only entities that made it into the Cache are known not to have been
+	// modified while they were being loaded from the datastore.
+	localCache := configFromContext(c).LocalCache
+	if localCache == nil {
+		return
+	}
+	me, isMultiErr := err.(appengine.MultiError)
+	if err != nil && !isMultiErr {
+		return
+	}
+	for i, item := range saveItems {
+		// Chunked entities are cached locally once read back from the Cache.
+		if item.Flags&chunkedFlag != 0 {
+			continue
+		}
+		if err == nil || me[i] == nil {
+			localCache.set(cl, item.Key, item.Flags, item.Value)
+		}
 	}
 }
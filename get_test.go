@@ -6,6 +6,7 @@ import (
 	"testing"
 
 	"github.com/qedus/nds"
+	"github.com/qedus/nds/ndstest"
 
 	"errors"
 
@@ -1322,3 +1323,65 @@ func TestGetMultiFieldMismatch(t *testing.T) {
 		}
 	}
 }
+
+func TestGetMultiPropertyList(t *testing.T) {
+	c := ndstest.NewContext(t)
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewKey(c, "Entity", "", 2, nil),
+	}
+	pls := []datastore.PropertyList{
+		{{Name: "IntVal", Value: int64(1)}},
+		{{Name: "StringVal", Value: "two"}},
+	}
+	if _, err := nds.PutMulti(c, keys, pls); err != nil {
+		t.Fatal(err)
+	}
+
+	// Load from the datastore, the cache and then the context cache.
+	cc := nds.WithContextCache(c)
+	for i := 0; i < 3; i++ {
+		// Existing properties are replaced rather than appended to.
+		got := []datastore.PropertyList{
+			{{Name: "Old", Value: "old"}},
+			nil,
+		}
+		if err := nds.GetMulti(cc, keys, got); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, pls) {
+			t.Fatal("incorrect properties", i, got)
+		}
+
+		pl := datastore.PropertyList{{Name: "Old", Value: "old"}}
+		if err := nds.Get(cc, keys[1], &pl); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(pl, pls[1]) {
+			t.Fatal("incorrect properties", i, pl)
+		}
+	}
+
+	if err := nds.RunInTransaction(c, func(tc context.Context) error {
+		got := make([]datastore.PropertyList, 1)
+		if err := nds.GetMulti(tc, keys[:1], got); err != nil {
+			return err
+		}
+		if !reflect.DeepEqual(got[0], pls[0]) {
+			t.Fatal("incorrect properties", got)
+		}
+		return nil
+	}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := nds.Get(c, keys[0],
+		(*datastore.PropertyList)(nil)); err != datastore.ErrInvalidEntityType {
+		t.Fatal("expected ErrInvalidEntityType", err)
+	}
+	if err := nds.GetMulti(c, keys[:1],
+		datastore.PropertyList{}); err == nil {
+		t.Fatal("expected PropertyList to be rejected")
+	}
+}
@@ -1,8 +1,15 @@
 module github.com/qedus/nds
 
+go 1.16
+
 require (
+	cloud.google.com/go/datastore v1.15.0
+	github.com/alicebob/miniredis/v2 v2.30.0
+	github.com/gomodule/redigo v1.8.9
 	golang.org/x/net v0.20.0
+	google.golang.org/api v0.128.0
 	google.golang.org/appengine v1.6.7
+	google.golang.org/genproto v0.0.0-20230821184602-ccc8af3d0e93
+	google.golang.org/grpc v1.57.0
+	google.golang.org/protobuf v1.31.0
 )
-
-require github.com/golang/protobuf v1.3.1 // indirect
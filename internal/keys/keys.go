@@ -0,0 +1,66 @@
+// Package keys creates App Engine datastore keys without an App Engine
+// context.
+package keys
+
+import (
+	"bytes"
+	"encoding/gob"
+
+	"google.golang.org/appengine/datastore"
+)
+
+// gobKey mirrors the gob encoding of *datastore.Key.
+type gobKey struct {
+	Kind      string
+	StringID  string
+	IntID     int64
+	Parent    *gobKey
+	AppID     string
+	Namespace string
+}
+
+// New creates a key in the same way as datastore.NewKey except that the
+// application ID and namespace are given explicitly rather than being taken
+// from an App Engine context. It returns nil if the key cannot be created.
+func New(appID, namespace, kind, stringID string, intID int64,
+	parent *datastore.Key) *datastore.Key {
+
+	gk := &gobKey{
+		Kind:      kind,
+		StringID:  stringID,
+		IntID:     intID,
+		AppID:     appID,
+		Namespace: namespace,
+	}
+	if parent != nil {
+		// The parent's application ID and namespace always take precedence.
+		gk.AppID = parent.AppID()
+		gk.Namespace = parent.Namespace()
+		gk.Parent = toGobKey(parent)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := gob.NewEncoder(buf).Encode(gk); err != nil {
+		return nil
+	}
+
+	key := &datastore.Key{}
+	if err := key.GobDecode(buf.Bytes()); err != nil {
+		return nil
+	}
+	return key
+}
+
+func toGobKey(key *datastore.Key) *gobKey {
+	if key == nil {
+		return nil
+	}
+	return &gobKey{
+		Kind:      key.Kind(),
+		StringID:  key.StringID(),
+		IntID:     key.IntID(),
+		Parent:    toGobKey(key.Parent()),
+		AppID:     key.AppID(),
+		Namespace: key.Namespace(),
+	}
+}
@@ -0,0 +1,35 @@
+package keys_test
+
+import (
+	"testing"
+
+	"github.com/qedus/nds/internal/keys"
+)
+
+func TestNew(t *testing.T) {
+	parent := keys.New("s~app", "ns", "Parent", "name", 0, nil)
+	if parent == nil {
+		t.Fatal("expected parent key")
+	}
+	if parent.AppID() != "s~app" || parent.Namespace() != "ns" ||
+		parent.Kind() != "Parent" || parent.StringID() != "name" {
+		t.Fatal("incorrect parent key", parent)
+	}
+
+	child := keys.New("other", "", "Child", "", 3, parent)
+	if child == nil {
+		t.Fatal("expected child key")
+	}
+	if child.AppID() != "s~app" || child.Namespace() != "ns" ||
+		child.IntID() != 3 || !child.Parent().Equal(parent) {
+		t.Fatal("incorrect child key", child)
+	}
+
+	// Keys must survive being encoded and decoded.
+	if _, err := child.GobEncode(); err != nil {
+		t.Fatal(err)
+	}
+	if child.Encode() == "" {
+		t.Fatal("expected encoded key")
+	}
+}
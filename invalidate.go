@@ -0,0 +1,215 @@
+package nds
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"strconv"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+const (
+	// epochFlag is set in the Flags of entity and none items whose values
+	// begin with the epochs of the entity's namespace and kind at the time it
+	// was cached. Items cached in earlier epochs are treated as missing.
+	epochFlag uint32 = 1 << 11
+
+	// epochsSize is the size of the epochs at the start of an item's value:
+	// the namespace epoch followed by the kind epoch.
+	epochsSize = 2 * generationSize
+)
+
+// InvalidateMulti makes Get and GetMulti load the entities of keys from the
+// datastore again. It is for entities changed without nds, for example by
+// other systems or the datastore admin console. Like Delete it locks the
+// entities in the cache for the Config's LockTime, during which they are
+// loaded from the datastore without being cached. Cached query results of
+// the entities' kinds are invalidated too.
+func InvalidateMulti(c context.Context, keys []*datastore.Key) error {
+	cl, cfg := clientFromContext(c), configFromContext(c)
+	lockMemcacheItems := append(entityLockItems(cfg, keys),
+		generationLockItems(cfg, keys)...)
+
+	memcacheCtx, err := cl.cache.NewContext(c)
+	if err != nil {
+		return err
+	}
+
+	invalidateLocalCache(c, lockMemcacheItems)
+
+	if cc, ok := contextCacheFromContext(c); ok {
+		cc.delete(cl, keys)
+	}
+
+	if tx, ok := transactionFromContext(c); ok {
+		tx.Lock()
+		tx.lockMemcacheItems = append(tx.lockMemcacheItems,
+			lockMemcacheItems...)
+		tx.Unlock()
+		return nil
+	}
+	return cl.cache.SetMulti(memcacheCtx, lockMemcacheItems)
+}
+
+// InvalidateKind makes Get and GetMulti load every entity of kind in
+// namespace from the datastore again, as InvalidateMulti does for individual
+// entities. The entities are not locked; instead a new epoch of the kind is
+// started and entities cached in earlier epochs are no longer used. Cached
+// query results of the kind are invalidated too.
+//
+// The LocalCache, if one has been set, is cleared on this instance only so
+// other instances may return entities from their LocalCaches until they
+// expire. Entities cached by versions of nds that did not record epochs are
+// not invalidated.
+func InvalidateKind(c context.Context, namespace, kind string) error {
+	cfg := configFromContext(c)
+	items := []*Item{}
+	for _, prefix := range cfg.lockPrefixes() {
+		items = append(items, &Item{
+			Key:   createKindEpochKey(cfg, prefix, namespace, kind),
+			Flags: generationItem,
+			Value: newGeneration(),
+		}, &Item{
+			Key:        createGenerationKey(cfg, prefix, namespace, kind),
+			Flags:      lockItem,
+			Value:      itemLock(),
+			Expiration: cfg.lockTime(),
+		})
+	}
+	return setEpochItems(c, items)
+}
+
+// InvalidateNamespace makes Get and GetMulti load every entity in namespace
+// from the datastore again, in the same way as InvalidateKind. Cached query
+// results are not invalidated, so InvalidateKind should also be called for
+// kinds whose queries are cached.
+func InvalidateNamespace(c context.Context, namespace string) error {
+	cfg := configFromContext(c)
+	items := []*Item{}
+	for _, prefix := range cfg.lockPrefixes() {
+		items = append(items, &Item{
+			Key:   createNamespaceEpochKey(cfg, prefix, namespace),
+			Flags: generationItem,
+			Value: newGeneration(),
+		})
+	}
+	return setEpochItems(c, items)
+}
+
+// setEpochItems stores items, which start new epochs, and clears the caches
+// that do not record epochs.
+func setEpochItems(c context.Context, items []*Item) error {
+	cl := clientFromContext(c)
+	memcacheCtx, err := cl.cache.NewContext(c)
+	if err != nil {
+		return err
+	}
+
+	configFromContext(c).LocalCache.flush()
+
+	if cc, ok := contextCacheFromContext(c); ok {
+		cc.flush()
+	}
+
+	if tx, ok := transactionFromContext(c); ok {
+		tx.Lock()
+		tx.lockMemcacheItems = append(tx.lockMemcacheItems, items...)
+		tx.Unlock()
+		return nil
+	}
+	return cl.cache.SetMulti(memcacheCtx, items)
+}
+
+func hashEpochKey(cfg *Config, epochKey string) string {
+	if len(epochKey) > cfg.maxKeySize() {
+		hash := sha1.Sum([]byte(epochKey))
+		epochKey = hex.EncodeToString(hash[:])
+	}
+	return epochKey
+}
+
+// createNamespaceEpochKey returns the cache key of the item whose value
+// identifies the current epoch of namespace.
+func createNamespaceEpochKey(cfg *Config, prefix, namespace string) string {
+	return hashEpochKey(cfg, prefix+"E:"+strconv.Quote(namespace))
+}
+
+// createKindEpochKey returns the cache key of the item whose value
+// identifies the current epoch of kind in namespace.
+func createKindEpochKey(cfg *Config, prefix, namespace, kind string) string {
+	return hashEpochKey(cfg, prefix+"E:"+strconv.Quote(namespace)+
+		strconv.Quote(kind))
+}
+
+// createEpochKeys returns the cache keys of the namespace and kind epochs of
+// key.
+func createEpochKeys(cfg *Config, key *datastore.Key) []string {
+	return []string{
+		createNamespaceEpochKey(cfg, cfg.prefix(), key.Namespace()),
+		createKindEpochKey(cfg, cfg.prefix(), key.Namespace(), key.Kind()),
+	}
+}
+
+// epochKeys returns the distinct epoch keys of the cacheItems at indexes.
+func epochKeys(cacheItems []cacheItem, indexes []int) []string {
+	keys := []string{}
+	seen := map[string]bool{}
+	for _, i := range indexes {
+		for _, key := range cacheItems[i].epochKeys {
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+	return keys
+}
+
+// newEpochItems returns items that start the epochs of keys, which are added
+// to the cache if the epochs have not started yet.
+func newEpochItems(keys []string) []*Item {
+	items := make([]*Item, len(keys))
+	for i, key := range keys {
+		items[i] = &Item{
+			Key:   key,
+			Flags: generationItem,
+			Value: newGeneration(),
+		}
+	}
+	return items
+}
+
+// itemEpochs returns the epochs of cacheItem from items, or nil if they are
+// not all there.
+func itemEpochs(items map[string]*Item, cacheItem cacheItem) []byte {
+	epochs := make([]byte, 0, epochsSize)
+	for _, key := range cacheItem.epochKeys {
+		item, ok := items[key]
+		if !ok || item.Flags != generationItem ||
+			len(item.Value) != generationSize {
+			return nil
+		}
+		epochs = append(epochs, item.Value...)
+	}
+	return epochs
+}
+
+// currentItem reports whether item was cached in epochs. Items cached by
+// versions of nds that did not record epochs are always current.
+func currentItem(item *Item, epochs []byte) bool {
+	if item.Flags&epochFlag == 0 {
+		return true
+	}
+	return epochs != nil && len(item.Value) >= epochsSize &&
+		bytes.Equal(item.Value[:epochsSize], epochs)
+}
+
+// addEpochs returns value preceded by epochs. If epochs is nil, because they
+// could not be read, the value is never current.
+func addEpochs(epochs, value []byte) []byte {
+	data := make([]byte, epochsSize, epochsSize+len(value))
+	copy(data, epochs)
+	return append(data, value...)
+}
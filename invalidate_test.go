@@ -0,0 +1,86 @@
+package nds_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/qedus/nds"
+	"github.com/qedus/nds/ndstest"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestInvalidate(t *testing.T) {
+	d, cache := &countingDatastore{Datastore: ndstest.NewDatastore()},
+		ndstest.NewCache()
+	ndstest.Install(t, d, cache)
+	c := context.Background()
+
+	entityKey := datastore.NewKey(c, "Entity", "", 1, nil)
+	otherKey := datastore.NewKey(c, "Other", "", 1, nil)
+	keys := []*datastore.Key{entityKey, otherKey}
+
+	// put changes the entities without nds.
+	put := func(text string) {
+		t.Helper()
+		pl := datastore.PropertyList{{Name: "Text", Value: text,
+			NoIndex: true}}
+		if _, err := d.PutMulti(c, keys,
+			[]datastore.PropertyList{pl, pl}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	get := func(key *datastore.Key, text string, gets int) {
+		t.Helper()
+		entity := &textEntity{}
+		if err := nds.Get(c, key, entity); err != nil {
+			t.Fatal(err)
+		}
+		if entity.Text != text {
+			t.Fatal("incorrect entity", entity)
+		}
+		if d.gets != gets {
+			t.Fatal("incorrect gets", d.gets)
+		}
+	}
+
+	put("one")
+	get(entityKey, "one", 1)
+	get(otherKey, "one", 2)
+
+	// Invalidated entities are loaded from the datastore until their locks
+	// expire, after which they are cached again.
+	put("two")
+	get(entityKey, "one", 2)
+	if err := nds.InvalidateMulti(c, keys[:1]); err != nil {
+		t.Fatal(err)
+	}
+	get(entityKey, "two", 3)
+	get(entityKey, "two", 4)
+	cache.Advance(time.Minute)
+	get(entityKey, "two", 5)
+	get(entityKey, "two", 5)
+
+	// Invalidating a kind leaves other kinds cached.
+	put("three")
+	if err := nds.InvalidateKind(c, "", "Entity"); err != nil {
+		t.Fatal(err)
+	}
+	get(entityKey, "three", 6)
+	get(entityKey, "three", 6)
+	get(otherKey, "one", 6)
+
+	// Invalidating a namespace invalidates all of its kinds.
+	if err := nds.InvalidateNamespace(c, ""); err != nil {
+		t.Fatal(err)
+	}
+	get(entityKey, "three", 7)
+	get(otherKey, "three", 8)
+	get(otherKey, "three", 8)
+
+	// Other namespaces are unaffected.
+	if err := nds.InvalidateNamespace(c, "other"); err != nil {
+		t.Fatal(err)
+	}
+	get(entityKey, "three", 8)
+}
@@ -0,0 +1,186 @@
+package nds
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// maxLocalCacheTTL bounds how long an entity can be served from a LocalCache.
+// Other instances can write entities at any time and a LocalCache has no way of
+// knowing, so this is also the longest a stale entity can be returned for.
+const maxLocalCacheTTL = time.Minute
+
+// LocalCache is a size bounded, least recently used, in-process cache that is
+// consulted before a Client's Cache. It is populated with entities that nds
+// reads from, or successfully writes back to, the Cache and it is invalidated
+// by this instance's Put, Delete and RunInTransaction calls.
+//
+// Unlike the rest of nds a LocalCache is not strongly consistent. Entities
+// written by other instances are not seen until local entries expire, so
+// Get and GetMulti can return entities up to the LocalCache TTL old. Only use
+// a LocalCache for kinds where that is acceptable.
+type LocalCache struct {
+	sync.Mutex
+
+	maxItems int
+	maxBytes int
+	ttl      time.Duration
+
+	bytes int
+	ll    *list.List
+	items map[localCacheKey]*list.Element
+
+	now func() time.Time
+}
+
+// localCacheKey identifies an entity in a LocalCache. Clients have their own
+// Caches and Datastores so their entities are held separately.
+type localCacheKey struct {
+	client *Client
+	key    string
+}
+
+type localCacheEntry struct {
+	key     localCacheKey
+	flags   uint32
+	value   []byte
+	expires time.Time
+}
+
+func (e *localCacheEntry) size() int {
+	return len(e.key.key) + len(e.value)
+}
+
+// NewLocalCache creates a LocalCache holding at most maxItems entities and
+// maxBytes bytes of cached entity data. Entities are served for at most ttl
+// after they were cached. ttl is capped at one minute.
+func NewLocalCache(maxItems, maxBytes int, ttl time.Duration) *LocalCache {
+	if ttl > maxLocalCacheTTL {
+		ttl = maxLocalCacheTTL
+	}
+	return &LocalCache{
+		maxItems: maxItems,
+		maxBytes: maxBytes,
+		ttl:      ttl,
+		ll:       list.New(),
+		items:    map[localCacheKey]*list.Element{},
+		now:      time.Now,
+	}
+}
+
+// SetLocalCache enables an in-process cache in front of the default Client's
+// Cache. Passing nil, the default, disables it. SetLocalCache is not safe to
+// call concurrently with other nds functions and should therefore be called
+// during program initialization.
+func SetLocalCache(lc *LocalCache) {
+	defaultClient.config.LocalCache = lc
+}
+
+// invalidateLocalCache removes the keys of lockItems from the LocalCache of
+// c's Config.
+func invalidateLocalCache(c context.Context, lockItems []*Item) {
+	lc := configFromContext(c).LocalCache
+	if lc == nil {
+		return
+	}
+
+	keys := make([]string, len(lockItems))
+	for i, item := range lockItems {
+		keys[i] = item.Key
+	}
+	lc.delete(clientFromContext(c), keys)
+}
+
+func (lc *LocalCache) get(cl *Client, key string) (uint32, []byte, bool) {
+	if lc == nil {
+		return 0, nil, false
+	}
+
+	lc.Lock()
+	defer lc.Unlock()
+
+	elem, ok := lc.items[localCacheKey{cl, key}]
+	if !ok {
+		return 0, nil, false
+	}
+
+	entry := elem.Value.(*localCacheEntry)
+	if !lc.now().Before(entry.expires) {
+		lc.removeElement(elem)
+		return 0, nil, false
+	}
+
+	lc.ll.MoveToFront(elem)
+	return entry.flags, entry.value, true
+}
+
+func (lc *LocalCache) set(cl *Client, key string, flags uint32,
+	value []byte) {
+
+	if lc == nil || lc.ttl <= 0 {
+		return
+	}
+
+	entry := &localCacheEntry{
+		key:     localCacheKey{cl, key},
+		flags:   flags,
+		value:   value,
+		expires: lc.now().Add(lc.ttl),
+	}
+	if entry.size() > lc.maxBytes {
+		lc.delete(cl, []string{key})
+		return
+	}
+
+	lc.Lock()
+	defer lc.Unlock()
+
+	if elem, ok := lc.items[entry.key]; ok {
+		lc.removeElement(elem)
+	}
+
+	lc.items[entry.key] = lc.ll.PushFront(entry)
+	lc.bytes += entry.size()
+
+	for lc.ll.Len() > lc.maxItems || lc.bytes > lc.maxBytes {
+		lc.removeElement(lc.ll.Back())
+	}
+}
+
+func (lc *LocalCache) delete(cl *Client, keys []string) {
+	if lc == nil {
+		return
+	}
+
+	lc.Lock()
+	defer lc.Unlock()
+
+	for _, key := range keys {
+		if elem, ok := lc.items[localCacheKey{cl, key}]; ok {
+			lc.removeElement(elem)
+		}
+	}
+}
+
+func (lc *LocalCache) flush() {
+	if lc == nil {
+		return
+	}
+
+	lc.Lock()
+	defer lc.Unlock()
+
+	lc.bytes = 0
+	lc.ll.Init()
+	lc.items = map[localCacheKey]*list.Element{}
+}
+
+func (lc *LocalCache) removeElement(elem *list.Element) {
+	entry := elem.Value.(*localCacheEntry)
+	lc.ll.Remove(elem)
+	delete(lc.items, entry.key)
+	lc.bytes -= entry.size()
+}
@@ -0,0 +1,135 @@
+package nds_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/qedus/nds"
+	"github.com/qedus/nds/ndstest"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestLocalCacheMaxItems(t *testing.T) {
+	lc := nds.NewLocalCache(2, 1024, time.Second)
+
+	lc.Set("one", nds.EntityItem, []byte("1"))
+	lc.Set("two", nds.EntityItem, []byte("2"))
+
+	// Make "one" the most recently used.
+	if _, _, ok := lc.Get("one"); !ok {
+		t.Fatal("expected one")
+	}
+
+	lc.Set("three", nds.EntityItem, []byte("3"))
+
+	if _, _, ok := lc.Get("two"); ok {
+		t.Fatal("expected two to be evicted")
+	}
+	if _, value, ok := lc.Get("one"); !ok || string(value) != "1" {
+		t.Fatal("expected one")
+	}
+	if _, value, ok := lc.Get("three"); !ok || string(value) != "3" {
+		t.Fatal("expected three")
+	}
+}
+
+func TestLocalCacheMaxBytes(t *testing.T) {
+	lc := nds.NewLocalCache(100, 10, time.Second)
+
+	// Each entry is a 1 byte key plus a 4 byte value.
+	lc.Set("a", nds.EntityItem, []byte("aaaa"))
+	lc.Set("b", nds.EntityItem, []byte("bbbb"))
+	lc.Set("c", nds.EntityItem, []byte("cccc"))
+
+	if _, _, ok := lc.Get("a"); ok {
+		t.Fatal("expected a to be evicted")
+	}
+	if _, _, ok := lc.Get("c"); !ok {
+		t.Fatal("expected c")
+	}
+
+	// Entries larger than the cache are never stored.
+	lc.Set("b", nds.EntityItem, make([]byte, 20))
+	if _, _, ok := lc.Get("b"); ok {
+		t.Fatal("expected b to be removed")
+	}
+}
+
+func TestLocalCacheTTL(t *testing.T) {
+	now := time.Now()
+	lc := nds.NewLocalCache(100, 1024, time.Hour)
+	lc.SetNow(func() time.Time { return now })
+
+	lc.Set("one", nds.NoneItem, []byte{})
+	if _, _, ok := lc.Get("one"); !ok {
+		t.Fatal("expected one")
+	}
+
+	// The TTL is capped so stale entities are never served for long.
+	now = now.Add(time.Minute)
+	if _, _, ok := lc.Get("one"); ok {
+		t.Fatal("expected one to expire")
+	}
+}
+
+func TestLocalCacheGet(t *testing.T) {
+	d, cache := ndstest.NewDatastore(), ndstest.NewCache()
+	ndstest.Install(t, d, cache)
+	c := context.Background()
+
+	nds.SetLocalCache(nds.NewLocalCache(100, 1<<20, time.Minute))
+	defer nds.SetLocalCache(nil)
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(c, key, &testEntity{42}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Populate the cache and the local cache.
+	if err := nds.Get(c, key, &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The entity is only left in the local cache.
+	cache.Flush()
+	if err := d.DeleteMulti(c, []*datastore.Key{key}); err != nil {
+		t.Fatal(err)
+	}
+
+	entity := &testEntity{}
+	if err := nds.Get(c, key, entity); err != nil {
+		t.Fatal(err)
+	}
+	if entity.IntVal != 42 {
+		t.Fatal("incorrect IntVal", entity.IntVal)
+	}
+
+	// Puts from this instance invalidate the local cache.
+	if _, err := nds.Put(c, key, &testEntity{43}); err != nil {
+		t.Fatal(err)
+	}
+
+	entity = &testEntity{}
+	if err := nds.Get(c, key, entity); err != nil {
+		t.Fatal(err)
+	}
+	if entity.IntVal != 43 {
+		t.Fatal("incorrect IntVal", entity.IntVal)
+	}
+
+	// As do transactions.
+	if err := nds.RunInTransaction(c, func(tc context.Context) error {
+		return nds.Delete(tc, key)
+	}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := nds.Get(c, key, &testEntity{}); err != datastore.ErrNoSuchEntity {
+		t.Fatal("expected datastore.ErrNoSuchEntity", err)
+	}
+}
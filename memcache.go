@@ -0,0 +1,121 @@
+package nds
+
+import (
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/memcache"
+)
+
+// The variables in this block are here so that we can test all error code
+// paths by substituting them with error producing ones.
+var (
+	memcacheAddMulti            = memcache.AddMulti
+	memcacheCompareAndSwapMulti = memcache.CompareAndSwapMulti
+	memcacheDeleteMulti         = memcache.DeleteMulti
+	memcacheGetMulti            = memcache.GetMulti
+	memcacheSetMulti            = memcache.SetMulti
+)
+
+// memcacheCache is the default Cache and uses App Engine memcache.
+type memcacheCache struct{}
+
+func (memcacheCache) NewContext(c context.Context) (context.Context, error) {
+	return appengine.Namespace(c, configFromContext(c).Namespace)
+}
+
+func (memcacheCache) GetMulti(c context.Context,
+	keys []string) (map[string]*Item, error) {
+
+	memcacheItems, err := memcacheGetMulti(c, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	items := make(map[string]*Item, len(memcacheItems))
+	for key, memcacheItem := range memcacheItems {
+		items[key] = &Item{
+			Key:        memcacheItem.Key,
+			Value:      memcacheItem.Value,
+			Flags:      memcacheItem.Flags,
+			Expiration: memcacheItem.Expiration,
+			CAS:        memcacheItem,
+		}
+	}
+	return items, nil
+}
+
+func (memcacheCache) AddMulti(c context.Context, items []*Item) error {
+	return convertMemcacheError(memcacheAddMulti(c, toMemcacheItems(items)))
+}
+
+func (memcacheCache) SetMulti(c context.Context, items []*Item) error {
+	return convertMemcacheError(memcacheSetMulti(c, toMemcacheItems(items)))
+}
+
+func (memcacheCache) CompareAndSwapMulti(c context.Context,
+	items []*Item) error {
+
+	memcacheItems := make([]*memcache.Item, len(items))
+	for i, item := range items {
+		// Items must have been retrieved by GetMulti so that memcache can
+		// use the hidden CAS ID.
+		memcacheItem, ok := item.CAS.(*memcache.Item)
+		if !ok {
+			memcacheItem = &memcache.Item{}
+		}
+		memcacheItem.Key = item.Key
+		memcacheItem.Value = item.Value
+		memcacheItem.Flags = item.Flags
+		memcacheItem.Expiration = item.Expiration
+		memcacheItems[i] = memcacheItem
+	}
+	return convertMemcacheError(memcacheCompareAndSwapMulti(c, memcacheItems))
+}
+
+func (memcacheCache) DeleteMulti(c context.Context, keys []string) error {
+	err := memcacheDeleteMulti(c, keys)
+	if me, ok := err.(appengine.MultiError); ok {
+		for _, e := range me {
+			if e != nil && e != memcache.ErrCacheMiss {
+				return convertMemcacheError(err)
+			}
+		}
+		return nil
+	}
+	return err
+}
+
+func toMemcacheItems(items []*Item) []*memcache.Item {
+	memcacheItems := make([]*memcache.Item, len(items))
+	for i, item := range items {
+		memcacheItems[i] = &memcache.Item{
+			Key:        item.Key,
+			Value:      item.Value,
+			Flags:      item.Flags,
+			Expiration: item.Expiration,
+		}
+	}
+	return memcacheItems
+}
+
+// convertMemcacheError converts memcache package errors into their nds
+// equivalents so that callers do not need to know which Cache is in use.
+func convertMemcacheError(err error) error {
+	me, ok := err.(appengine.MultiError)
+	if !ok {
+		return err
+	}
+
+	converted := make(appengine.MultiError, len(me))
+	for i, e := range me {
+		switch e {
+		case memcache.ErrNotStored:
+			converted[i] = ErrNotStored
+		case memcache.ErrCASConflict:
+			converted[i] = ErrCASConflict
+		default:
+			converted[i] = e
+		}
+	}
+	return converted
+}
@@ -1,9 +1,7 @@
 package nds
 
 import (
-	"bytes"
 	"crypto/sha1"
-	"encoding/gob"
 	"encoding/hex"
 	"errors"
 	"reflect"
@@ -12,21 +10,18 @@ import (
 	"golang.org/x/net/context"
 	"google.golang.org/appengine"
 	"google.golang.org/appengine/datastore"
-	"google.golang.org/appengine/memcache"
 )
 
 const (
-	// memcachePrefix is the namespace memcache uses to store entities.
-	memcachePrefix = "NDS1:"
-
-	// memcacheLockTime is the maximum length of time a memcache lock will be
-	// held for. 32 seconds is chosen as 30 seconds is the maximum amount of
+	// memcacheLockTime is the default maximum length of time a memcache lock
+	// will be held for. 32 seconds is chosen as 30 seconds is the maximum amount of
 	// time an underlying datastore call will retry even if the API reports a
 	// success to the user.
 	memcacheLockTime = 32 * time.Second
 
-	// memcacheMaxKeySize is the maximum size a memcache item key can be. Keys
-	// greater than this size are automatically hashed to a smaller size.
+	// memcacheMaxKeySize is the default maximum size a memcache item key can
+	// be. Keys greater than this size are automatically hashed to a smaller
+	// size.
 	memcacheMaxKeySize = 250
 )
 
@@ -39,42 +34,33 @@ var (
 // The variables in this block are here so that we can test all error code
 // paths by substituting them with error producing ones.
 var (
-	datastoreDeleteMulti = datastore.DeleteMulti
-	datastoreGetMulti    = datastore.GetMulti
-	datastorePutMulti    = datastore.PutMulti
-
-	memcacheAddMulti            = memcache.AddMulti
-	memcacheCompareAndSwapMulti = memcache.CompareAndSwapMulti
-	memcacheDeleteMulti         = memcache.DeleteMulti
-	memcacheGetMulti            = memcache.GetMulti
-	memcacheSetMulti            = memcache.SetMulti
-
 	marshal   = marshalPropertyList
 	unmarshal = unmarshalPropertyList
-
-	// memcacheNamespace is the namespace where all memcached entities are
-	// stored.
-	memcacheNamespace = ""
 )
 
+// SetLogger sets the Logger of the default Client's Config. By default App
+// Engine logging is used, which only works with App Engine contexts. Passing
+// nil restores App Engine logging. SetLogger is not safe to call concurrently
+// with other nds functions and should therefore be called during program
+// initialization.
+func SetLogger(f func(c context.Context, format string, args ...interface{})) {
+	defaultClient.config.Logger = f
+}
+
 const (
 	noneItem uint32 = iota
 	entityItem
 	lockItem
+	generationItem
+	queryItem
+	chunkItem
 )
 
-func init() {
-	gob.Register(time.Time{})
-	gob.Register(datastore.ByteString{})
-	gob.Register(&datastore.Key{})
-	gob.Register(appengine.BlobKey(""))
-	gob.Register(appengine.GeoPoint{})
-}
-
 type valueType int
 
 const (
 	valueTypeInvalid valueType = iota
+	valueTypePropertyList
 	valueTypePropertyLoadSaver
 	valueTypeStruct
 	valueTypeStructPtr
@@ -83,6 +69,10 @@ const (
 
 func checkValueType(valType reflect.Type) valueType {
 
+	if valType == typeOfPropertyList {
+		return valueTypePropertyList
+	}
+
 	if reflect.PtrTo(valType).Implements(typeOfPropertyLoadSaver) {
 		return valueTypePropertyLoadSaver
 	}
@@ -131,35 +121,67 @@ func checkKeysValues(keys []*datastore.Key, values reflect.Value) error {
 	return nil
 }
 
-func createMemcacheKey(key *datastore.Key) string {
-	memcacheKey := memcachePrefix + key.Encode()
-	if len(memcacheKey) > memcacheMaxKeySize {
+func createMemcacheKey(cfg *Config, key *datastore.Key) string {
+	return createPrefixedMemcacheKey(cfg, cfg.prefix(), key)
+}
+
+func createPrefixedMemcacheKey(cfg *Config, prefix string,
+	key *datastore.Key) string {
+
+	memcacheKey := prefix + key.Encode()
+	if len(memcacheKey) > cfg.maxKeySize() {
 		hash := sha1.Sum([]byte(memcacheKey))
 		memcacheKey = hex.EncodeToString(hash[:])
 	}
 	return memcacheKey
 }
 
-func memcacheContext(c context.Context) (context.Context, error) {
-	return appengine.Namespace(c, memcacheNamespace)
+// entityLockItems returns lock items for the entities of keys, which must be
+// set before any of the entities are changed. Incomplete keys are skipped.
+func entityLockItems(cfg *Config, keys []*datastore.Key) []*Item {
+	items := make([]*Item, 0, len(keys))
+	for _, prefix := range cfg.lockPrefixes() {
+		for _, key := range keys {
+			if key == nil || key.Incomplete() {
+				continue
+			}
+			items = append(items, &Item{
+				Key:        createPrefixedMemcacheKey(cfg, prefix, key),
+				Flags:      lockItem,
+				Value:      itemLock(),
+				Expiration: cfg.lockTime(),
+			})
+		}
+	}
+	return items
 }
 
 func marshalPropertyList(pl datastore.PropertyList) ([]byte, error) {
-	buf := bytes.Buffer{}
-	if err := gob.NewEncoder(&buf).Encode(&pl); err != nil {
-		return nil, err
-	}
-	return buf.Bytes(), nil
+	return GobCodec{}.Marshal(pl)
 }
 
 func unmarshalPropertyList(data []byte, pl *datastore.PropertyList) error {
-	return gob.NewDecoder(bytes.NewBuffer(data)).Decode(pl)
+	return GobCodec{}.Unmarshal(data, pl)
 }
 
 func setValue(val reflect.Value, pl datastore.PropertyList) error {
 
 	valType := checkValueType(val.Type())
 
+	// PropertyLists are set directly rather than appended to, as
+	// PropertyList.Load does.
+	if valType == valueTypePropertyList {
+		val.Set(reflect.ValueOf(pl))
+		return nil
+	}
+	if p, ok := val.Interface().(*datastore.PropertyList); ok {
+		if p == nil {
+			return datastore.ErrInvalidEntityType
+		}
+		*p = pl
+		return nil
+	}
+
 	if valType == valueTypePropertyLoadSaver || valType == valueTypeStruct {
 		val = val.Addr()
 	}
@@ -175,6 +197,55 @@ func setValue(val reflect.Value, pl datastore.PropertyList) error {
 	return datastore.LoadStruct(val.Interface(), pl)
 }
 
+// saveValue is the inverse of setValue and converts a value into a
+// PropertyList.
+func saveValue(val reflect.Value) (datastore.PropertyList, error) {
+
+	if val.Kind() == reflect.Interface {
+		val = val.Elem()
+	}
+
+	switch checkValueType(val.Type()) {
+	case valueTypePropertyList:
+		return val.Interface().(datastore.PropertyList), nil
+	case valueTypePropertyLoadSaver, valueTypeStruct:
+		if val.CanAddr() {
+			val = val.Addr()
+		} else {
+			ptr := reflect.New(val.Type())
+			ptr.Elem().Set(val)
+			val = ptr
+		}
+	}
+
+	if pls, ok := val.Interface().(datastore.PropertyLoadSaver); ok {
+		return pls.Save()
+	}
+
+	return datastore.SaveStruct(val.Interface())
+}
+
+// saveValues converts each element of vals into a PropertyList. If any
+// element cannot be converted an appengine.MultiError is returned.
+func saveValues(vals reflect.Value) ([]datastore.PropertyList, error) {
+	pls := make([]datastore.PropertyList, vals.Len())
+	me, errsNil := make(appengine.MultiError, vals.Len()), true
+	for i := range pls {
+		pl, err := saveValue(vals.Index(i))
+		if err != nil {
+			me[i] = err
+			errsNil = false
+			continue
+		}
+		pls[i] = pl
+	}
+
+	if errsNil {
+		return pls, nil
+	}
+	return nil, me
+}
+
 func isErrorsNil(errs []error) bool {
 	for _, err := range errs {
 		if err != nil {
@@ -0,0 +1,200 @@
+package ndstest
+
+import (
+	"sync"
+	"time"
+
+	"github.com/qedus/nds"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+)
+
+// Cache is an in-memory nds.Cache with the same add, compare-and-swap and
+// expiration semantics as App Engine memcache. Items never get evicted other
+// than by expiring. Time only moves forward when Advance is called so that
+// tests can expire items, such as nds' locks, deterministically.
+type Cache struct {
+	sync.Mutex
+
+	items   map[string]cacheEntry
+	now     time.Time
+	lastCAS uint64
+}
+
+type cacheEntry struct {
+	value   []byte
+	flags   uint32
+	cas     uint64
+	expires time.Time
+}
+
+var _ nds.Cache = (*Cache)(nil)
+
+// NewCache returns an empty Cache.
+func NewCache() *Cache {
+	return &Cache{
+		items: map[string]cacheEntry{},
+		now:   time.Unix(0, 0),
+	}
+}
+
+// Advance moves the Cache's clock forward by d, expiring any items whose
+// expiration time has passed.
+func (c *Cache) Advance(d time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// Flush removes all items from the Cache.
+func (c *Cache) Flush() {
+	c.Lock()
+	defer c.Unlock()
+	c.items = map[string]cacheEntry{}
+}
+
+// Len returns the number of unexpired items in the Cache.
+func (c *Cache) Len() int {
+	c.Lock()
+	defer c.Unlock()
+
+	n := 0
+	for key := range c.items {
+		if _, ok := c.get(key); ok {
+			n++
+		}
+	}
+	return n
+}
+
+// NewContext returns c unchanged.
+func (c *Cache) NewContext(ctx context.Context) (context.Context, error) {
+	return ctx, nil
+}
+
+// get returns the unexpired entry for key. It must be called with c locked.
+func (c *Cache) get(key string) (cacheEntry, bool) {
+	entry, ok := c.items[key]
+	if !ok {
+		return cacheEntry{}, false
+	}
+	if !entry.expires.IsZero() && !c.now.Before(entry.expires) {
+		delete(c.items, key)
+		return cacheEntry{}, false
+	}
+	return entry, true
+}
+
+// set stores item. It must be called with c locked.
+func (c *Cache) set(item *nds.Item) {
+	c.lastCAS++
+	entry := cacheEntry{
+		value: append([]byte(nil), item.Value...),
+		flags: item.Flags,
+		cas:   c.lastCAS,
+	}
+	if item.Expiration > 0 {
+		entry.expires = c.now.Add(item.Expiration)
+	}
+	c.items[item.Key] = entry
+}
+
+// GetMulti returns the unexpired items for keys.
+func (c *Cache) GetMulti(ctx context.Context,
+	keys []string) (map[string]*nds.Item, error) {
+
+	c.Lock()
+	defer c.Unlock()
+
+	items := make(map[string]*nds.Item, len(keys))
+	for _, key := range keys {
+		entry, ok := c.get(key)
+		if !ok {
+			continue
+		}
+		item := &nds.Item{
+			Key:   key,
+			Value: append([]byte(nil), entry.value...),
+			Flags: entry.flags,
+			CAS:   entry.cas,
+		}
+		if !entry.expires.IsZero() {
+			item.Expiration = entry.expires.Sub(c.now)
+		}
+		items[key] = item
+	}
+	return items, nil
+}
+
+// AddMulti stores items whose keys are not already present.
+func (c *Cache) AddMulti(ctx context.Context, items []*nds.Item) error {
+	c.Lock()
+	defer c.Unlock()
+
+	me, errsNil := make(appengine.MultiError, len(items)), true
+	for i, item := range items {
+		if _, ok := c.get(item.Key); ok {
+			me[i] = nds.ErrNotStored
+			errsNil = false
+			continue
+		}
+		c.set(item)
+	}
+
+	if errsNil {
+		return nil
+	}
+	return me
+}
+
+// SetMulti stores items unconditionally.
+func (c *Cache) SetMulti(ctx context.Context, items []*nds.Item) error {
+	c.Lock()
+	defer c.Unlock()
+
+	for _, item := range items {
+		c.set(item)
+	}
+	return nil
+}
+
+// CompareAndSwapMulti stores items that have not been modified or expired
+// since they were returned by GetMulti.
+func (c *Cache) CompareAndSwapMulti(ctx context.Context,
+	items []*nds.Item) error {
+
+	c.Lock()
+	defer c.Unlock()
+
+	me, errsNil := make(appengine.MultiError, len(items)), true
+	for i, item := range items {
+		entry, ok := c.get(item.Key)
+		cas, hasCAS := item.CAS.(uint64)
+		switch {
+		case !ok || !hasCAS:
+			me[i] = nds.ErrNotStored
+			errsNil = false
+		case entry.cas != cas:
+			me[i] = nds.ErrCASConflict
+			errsNil = false
+		default:
+			c.set(item)
+		}
+	}
+
+	if errsNil {
+		return nil
+	}
+	return me
+}
+
+// DeleteMulti removes the items for keys.
+func (c *Cache) DeleteMulti(ctx context.Context, keys []string) error {
+	c.Lock()
+	defer c.Unlock()
+
+	for _, key := range keys {
+		delete(c.items, key)
+	}
+	return nil
+}
@@ -0,0 +1,246 @@
+package ndstest
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/qedus/nds"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// lockExpiry is longer than the time nds locks cache items for.
+const lockExpiry = time.Minute
+
+// CheckOptions configures CheckConsistency.
+type CheckOptions struct {
+	// Goroutines is the number of goroutines concurrently calling nds.
+	Goroutines int
+
+	// Operations is the number of operations each goroutine performs.
+	Operations int
+
+	// Keys is the number of entities the goroutines contend on.
+	Keys int
+
+	// Seed seeds the random choice of operations and faults.
+	Seed int64
+
+	// Faults are injected into the cache being checked.
+	Faults Faults
+
+	// Advance, if not nil, is occasionally called to move the cache's clock
+	// forward past the time nds locks items for, so that the lock expiry path
+	// is checked. Cache.Advance can be used with the in-memory Cache.
+	Advance func(d time.Duration)
+}
+
+// checkEntity is the entity stored by CheckConsistency. Every write stores a
+// unique Version.
+type checkEntity struct {
+	Version int64
+}
+
+type operation struct {
+	read bool
+
+	// version is the version read or written, zero meaning the entity does
+	// not exist.
+	version int64
+
+	// start and end order the operation against all others. A write that
+	// failed has an end of math.MaxInt64 as it may take effect at any point.
+	start, end int64
+}
+
+type history struct {
+	sync.Mutex
+	clock      int64
+	operations [][]operation
+}
+
+func (h *history) tick() int64 {
+	return atomic.AddInt64(&h.clock, 1)
+}
+
+func (h *history) record(key int, op operation) {
+	h.Lock()
+	defer h.Unlock()
+	h.operations[key] = append(h.operations[key], op)
+}
+
+// CheckConsistency runs concurrent nds.Get, nds.Put, nds.Delete and
+// nds.RunInTransaction calls against an in-memory Datastore and cache,
+// wrapped in a FaultCache, and fails t if any read returns an entity that had
+// already been overwritten or deleted when the read started. It can be used to
+// check that nds stays consistent with custom nds.Cache implementations.
+//
+// CheckConsistency installs its Datastore and cache with Install and must not
+// be run in parallel with other tests that use nds.
+func CheckConsistency(t testing.TB, cache nds.Cache, opts CheckOptions) {
+	t.Helper()
+
+	c := context.Background()
+	d := NewDatastore()
+	fc := NewFaultCache(cache, opts.Faults, opts.Seed)
+	Install(t, d, fc)
+
+	keys := make([]*datastore.Key, opts.Keys)
+	for i := range keys {
+		keys[i] = datastore.NewKey(c, "NDSTestCheck", "", int64(i+1), nil)
+	}
+
+	// Every key starts off not existing.
+	h := &history{operations: make([][]operation, len(keys))}
+	for i := range keys {
+		h.record(i, operation{start: 0, end: 0})
+	}
+
+	var versions int64
+	wg := sync.WaitGroup{}
+	for g := 0; g < opts.Goroutines; g++ {
+		r := rand.New(rand.NewSource(opts.Seed + int64(g)))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < opts.Operations; i++ {
+				key := r.Intn(len(keys))
+				runOperation(c, r, h, key, keys[key],
+					atomic.AddInt64(&versions, 1), opts.Advance)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for i, key := range keys {
+		for _, err := range checkHistory(h.operations[i]) {
+			t.Errorf("%s: %s", key, err)
+		}
+	}
+
+	// Whatever happened, the cache must finish consistent with the datastore.
+	fc.SetFaults(Faults{})
+	for _, key := range keys {
+		want := int64(0)
+		pls := []datastore.PropertyList{nil}
+		if err := d.GetMulti(c, []*datastore.Key{key}, pls); err == nil {
+			entity := &checkEntity{}
+			if err := datastore.LoadStruct(entity, pls[0]); err != nil {
+				t.Fatal(err)
+			}
+			want = entity.Version
+		}
+
+		got := int64(0)
+		entity := &checkEntity{}
+		switch err := nds.Get(c, key, entity); err {
+		case nil:
+			got = entity.Version
+		case datastore.ErrNoSuchEntity:
+		default:
+			t.Fatal(err)
+		}
+
+		if got != want {
+			t.Errorf("%s: final version %d, datastore has %d", key, got, want)
+		}
+	}
+}
+
+func runOperation(c context.Context, r *rand.Rand, h *history, index int,
+	key *datastore.Key, version int64, advance func(time.Duration)) {
+
+	op := operation{start: h.tick()}
+
+	var err error
+	switch n := r.Intn(100); {
+	case n < 50:
+		op.read = true
+		entity := &checkEntity{}
+		err = nds.Get(c, key, entity)
+		if err == nil {
+			op.version = entity.Version
+		} else if err == datastore.ErrNoSuchEntity {
+			err = nil
+		}
+	case n < 75:
+		op.version = version
+		_, err = nds.Put(c, key, &checkEntity{version})
+	case n < 85:
+		err = nds.Delete(c, key)
+	case n < 98:
+		op.version = version
+		err = nds.RunInTransaction(c, func(tc context.Context) error {
+			entity := &checkEntity{}
+			if err := nds.Get(tc, key, entity); err != nil &&
+				err != datastore.ErrNoSuchEntity {
+				return err
+			}
+			entity.Version = version
+			_, err := nds.Put(tc, key, entity)
+			return err
+		}, nil)
+	default:
+		if advance != nil {
+			advance(lockExpiry)
+		}
+		return
+	}
+
+	op.end = h.tick()
+	if err != nil {
+		if op.read {
+			return
+		}
+		op.end = math.MaxInt64
+	}
+	h.record(index, op)
+}
+
+// checkHistory returns an error for each read in the operations of a single
+// key that could not have happened in any legal ordering of the operations.
+func checkHistory(ops []operation) []error {
+	writes := map[int64][]operation{}
+	for _, op := range ops {
+		if !op.read {
+			writes[op.version] = append(writes[op.version], op)
+		}
+	}
+
+	// overwritten returns true if w was overwritten before time t.
+	overwritten := func(w operation, t int64) bool {
+		for _, other := range ops {
+			if !other.read && other != w && w.end < other.start &&
+				other.end < t {
+				return true
+			}
+		}
+		return false
+	}
+
+	errs := []error{}
+	for _, r := range ops {
+		if !r.read {
+			continue
+		}
+
+		legal := false
+		for _, w := range writes[r.version] {
+			if w.start < r.end && !overwritten(w, r.start) {
+				legal = true
+				break
+			}
+		}
+		if !legal {
+			errs = append(errs, fmt.Errorf(
+				"stale read of version %d between %d and %d",
+				r.version, r.start, r.end))
+		}
+	}
+	return errs
+}
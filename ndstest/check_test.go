@@ -0,0 +1,55 @@
+package ndstest_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/qedus/nds/ndstest"
+)
+
+func TestCheckConsistency(t *testing.T) {
+	cache := ndstest.NewCache()
+	ndstest.CheckConsistency(t, cache, ndstest.CheckOptions{
+		Goroutines: 8,
+		Operations: 200,
+		Keys:       3,
+		Seed:       1,
+		Advance:    cache.Advance,
+	})
+}
+
+func TestCheckConsistencyFaults(t *testing.T) {
+	cache := ndstest.NewCache()
+	ndstest.CheckConsistency(t, cache, ndstest.CheckOptions{
+		Goroutines: 8,
+		Operations: 200,
+		Keys:       3,
+		Seed:       2,
+		Faults: ndstest.Faults{
+			Fail: map[ndstest.Op]int{
+				ndstest.OpGetMulti:            5,
+				ndstest.OpAddMulti:            5,
+				ndstest.OpSetMulti:            5,
+				ndstest.OpCompareAndSwapMulti: 5,
+				ndstest.OpDeleteMulti:         5,
+			},
+			MaxDelay: 100 * time.Microsecond,
+			DropCAS:  10,
+		},
+		Advance: cache.Advance,
+	})
+}
+
+func TestCheckConsistencyEvictions(t *testing.T) {
+	cache := ndstest.NewCache()
+	ndstest.CheckConsistency(t, cache, ndstest.CheckOptions{
+		Goroutines: 8,
+		Operations: 200,
+		Keys:       3,
+		Seed:       3,
+		Faults: ndstest.Faults{
+			Evict:    10,
+			MaxDelay: 100 * time.Microsecond,
+		},
+	})
+}
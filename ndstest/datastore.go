@@ -0,0 +1,324 @@
+package ndstest
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/qedus/nds"
+	"github.com/qedus/nds/internal/keys"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+// maxEntityGroups is the maximum number of entity groups a cross-group
+// transaction can use.
+const maxEntityGroups = 25
+
+// defaultAttempts is the number of times a transaction is attempted if
+// datastore.TransactionOptions does not specify otherwise.
+const defaultAttempts = 3
+
+var (
+	errCrossGroup = errors.New(
+		"ndstest: cross-group transaction need to be explicitly specified")
+	errTooManyGroups = errors.New(
+		"ndstest: operating on too many entity groups in a single transaction")
+	errNestedTransaction = errors.New(
+		"ndstest: nested transactions are not supported")
+)
+
+var transactionKey = "used for *transaction"
+
+// Datastore is an in-memory nds.Datastore. It behaves like the App Engine
+// datastore, including returning datastore.ErrNoSuchEntity for missing
+// entities, allocating IDs for incomplete keys and failing transactions with
+// datastore.ErrConcurrentTransaction when an entity group they used has been
+// modified before they commit. Unlike the App Engine datastore it is always
+// strongly consistent.
+type Datastore struct {
+	sync.Mutex
+
+	entities map[string]datastore.PropertyList
+
+	// versions holds the version of each entity group, keyed by the encoded
+	// root key, and is incremented every time an entity in the group changes.
+	versions map[string]int64
+
+	lastID int64
+}
+
+var _ nds.Datastore = (*Datastore)(nil)
+
+// NewDatastore returns an empty Datastore.
+func NewDatastore() *Datastore {
+	return &Datastore{
+		entities: map[string]datastore.PropertyList{},
+		versions: map[string]int64{},
+	}
+}
+
+type transaction struct {
+	sync.Mutex
+
+	opts *datastore.TransactionOptions
+
+	// versions holds the entity group versions seen when each group was first
+	// used by the transaction.
+	versions map[string]int64
+
+	puts    map[string]datastore.PropertyList
+	putKeys map[string]*datastore.Key
+	deletes map[string]*datastore.Key
+}
+
+func transactionFromContext(c context.Context) (*transaction, bool) {
+	tx, ok := c.Value(&transactionKey).(*transaction)
+	return tx, ok
+}
+
+func rootKey(key *datastore.Key) *datastore.Key {
+	for key.Parent() != nil {
+		key = key.Parent()
+	}
+	return key
+}
+
+// completeKey returns a copy of the incomplete key with the given ID.
+func completeKey(key *datastore.Key, id int64) *datastore.Key {
+	return keys.New(key.AppID(), key.Namespace(), key.Kind(), "", id,
+		key.Parent())
+}
+
+func copyPropertyList(pl datastore.PropertyList) datastore.PropertyList {
+	return append(datastore.PropertyList{}, pl...)
+}
+
+// use records that tx has used the entity group of key. It must be called
+// with d locked.
+func (d *Datastore) use(tx *transaction, key *datastore.Key) error {
+	group := rootKey(key).Encode()
+
+	tx.Lock()
+	defer tx.Unlock()
+
+	if _, ok := tx.versions[group]; ok {
+		return nil
+	}
+
+	xg := tx.opts != nil && tx.opts.XG
+	if !xg && len(tx.versions) > 0 {
+		return errCrossGroup
+	}
+	if len(tx.versions) >= maxEntityGroups {
+		return errTooManyGroups
+	}
+	tx.versions[group] = d.versions[group]
+	return nil
+}
+
+// GetMulti loads the entities for keys into vals.
+func (d *Datastore) GetMulti(c context.Context,
+	keys []*datastore.Key, vals []datastore.PropertyList) error {
+
+	if len(keys) != len(vals) {
+		return errors.New("ndstest: keys and vals have different lengths")
+	}
+
+	tx, inTransaction := transactionFromContext(c)
+
+	d.Lock()
+	defer d.Unlock()
+
+	me, errsNil := make(appengine.MultiError, len(keys)), true
+	for i, key := range keys {
+		if key == nil || key.Incomplete() {
+			me[i] = datastore.ErrInvalidKey
+			errsNil = false
+			continue
+		}
+
+		if inTransaction {
+			if err := d.use(tx, key); err != nil {
+				return err
+			}
+		}
+
+		// Like the App Engine datastore, transactions do not see their own
+		// uncommitted writes.
+		pl, ok := d.entities[key.Encode()]
+		if !ok {
+			me[i] = datastore.ErrNoSuchEntity
+			errsNil = false
+			continue
+		}
+		vals[i] = copyPropertyList(pl)
+	}
+
+	if errsNil {
+		return nil
+	}
+	return me
+}
+
+// PutMulti saves vals for keys, allocating IDs for incomplete keys.
+func (d *Datastore) PutMulti(c context.Context, keys []*datastore.Key,
+	vals []datastore.PropertyList) ([]*datastore.Key, error) {
+
+	if len(keys) != len(vals) {
+		return nil, errors.New("ndstest: keys and vals have different lengths")
+	}
+
+	me, errsNil := make(appengine.MultiError, len(keys)), true
+	for i, key := range keys {
+		if key == nil {
+			me[i] = datastore.ErrInvalidKey
+			errsNil = false
+		}
+	}
+	if !errsNil {
+		return nil, me
+	}
+
+	tx, inTransaction := transactionFromContext(c)
+
+	d.Lock()
+	defer d.Unlock()
+
+	putKeys := make([]*datastore.Key, len(keys))
+	for i, key := range keys {
+		if key.Incomplete() {
+			d.lastID++
+			key = completeKey(key, d.lastID)
+		}
+		putKeys[i] = key
+
+		if !inTransaction {
+			d.entities[key.Encode()] = copyPropertyList(vals[i])
+			d.versions[rootKey(key).Encode()]++
+			continue
+		}
+
+		if err := d.use(tx, key); err != nil {
+			return nil, err
+		}
+		tx.Lock()
+		encoded := key.Encode()
+		delete(tx.deletes, encoded)
+		tx.puts[encoded] = copyPropertyList(vals[i])
+		tx.putKeys[encoded] = key
+		tx.Unlock()
+	}
+	return putKeys, nil
+}
+
+// DeleteMulti deletes the entities for keys.
+func (d *Datastore) DeleteMulti(c context.Context,
+	keys []*datastore.Key) error {
+
+	me, errsNil := make(appengine.MultiError, len(keys)), true
+	for i, key := range keys {
+		if key == nil || key.Incomplete() {
+			me[i] = datastore.ErrInvalidKey
+			errsNil = false
+		}
+	}
+	if !errsNil {
+		return me
+	}
+
+	tx, inTransaction := transactionFromContext(c)
+
+	d.Lock()
+	defer d.Unlock()
+
+	for _, key := range keys {
+		encoded := key.Encode()
+		if !inTransaction {
+			delete(d.entities, encoded)
+			d.versions[rootKey(key).Encode()]++
+			continue
+		}
+
+		if err := d.use(tx, key); err != nil {
+			return err
+		}
+		tx.Lock()
+		delete(tx.puts, encoded)
+		delete(tx.putKeys, encoded)
+		tx.deletes[encoded] = key
+		tx.Unlock()
+	}
+	return nil
+}
+
+// RunInTransaction runs f in a transaction. The transaction fails with
+// datastore.ErrConcurrentTransaction if any entity group it used is modified
+// before it commits, in which case f is retried up to opts.Attempts times.
+func (d *Datastore) RunInTransaction(c context.Context,
+	f func(tc context.Context) error,
+	opts *datastore.TransactionOptions) error {
+
+	if _, ok := transactionFromContext(c); ok {
+		return errNestedTransaction
+	}
+
+	attempts := defaultAttempts
+	if opts != nil && opts.Attempts > 0 {
+		attempts = opts.Attempts
+	}
+
+	for i := 0; i < attempts; i++ {
+		tx := &transaction{
+			opts:     opts,
+			versions: map[string]int64{},
+			puts:     map[string]datastore.PropertyList{},
+			putKeys:  map[string]*datastore.Key{},
+			deletes:  map[string]*datastore.Key{},
+		}
+		if err := f(context.WithValue(c, &transactionKey, tx)); err != nil {
+			return err
+		}
+
+		if err := d.commit(tx); err != datastore.ErrConcurrentTransaction {
+			return err
+		}
+	}
+	return datastore.ErrConcurrentTransaction
+}
+
+func (d *Datastore) commit(tx *transaction) error {
+	d.Lock()
+	defer d.Unlock()
+
+	tx.Lock()
+	defer tx.Unlock()
+
+	for group, version := range tx.versions {
+		if d.versions[group] != version {
+			return datastore.ErrConcurrentTransaction
+		}
+	}
+
+	if tx.opts != nil && tx.opts.ReadOnly &&
+		(len(tx.puts) > 0 || len(tx.deletes) > 0) {
+		return errors.New("ndstest: read-only transaction cannot write")
+	}
+
+	for encoded, pl := range tx.puts {
+		d.entities[encoded] = pl
+		d.versions[rootKey(tx.putKeys[encoded]).Encode()]++
+	}
+	for encoded, key := range tx.deletes {
+		delete(d.entities, encoded)
+		d.versions[rootKey(key).Encode()]++
+	}
+	return nil
+}
+
+// Len returns the number of entities stored.
+func (d *Datastore) Len() int {
+	d.Lock()
+	defer d.Unlock()
+	return len(d.entities)
+}
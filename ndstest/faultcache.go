@@ -0,0 +1,206 @@
+package ndstest
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/qedus/nds"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+)
+
+// ErrFault is returned by FaultCache calls that have been made to fail.
+var ErrFault = errors.New("ndstest: injected cache fault")
+
+// Op identifies an nds.Cache method.
+type Op int
+
+// The nds.Cache methods that faults can be injected into.
+const (
+	OpGetMulti Op = iota
+	OpAddMulti
+	OpSetMulti
+	OpCompareAndSwapMulti
+	OpDeleteMulti
+)
+
+// Faults configures the faults injected by a FaultCache. All percentages are
+// from 0, never, to 100, always.
+type Faults struct {
+	// Fail holds the percentage of calls to each Op that fail with ErrFault
+	// without reaching the wrapped cache.
+	Fail map[Op]int
+
+	// Evict is the percentage of keys that are evicted from the wrapped cache
+	// immediately before each call that uses them.
+	Evict int
+
+	// MaxDelay is the maximum random delay added before each call.
+	MaxDelay time.Duration
+
+	// DropCAS is the percentage of CompareAndSwapMulti items that are reported
+	// as stored without being written to the wrapped cache.
+	DropCAS int
+}
+
+// FaultCache is an nds.Cache that wraps another nds.Cache and injects faults
+// into its calls. It can be used to check that code stays consistent when the
+// cache is unavailable, evicts items, is slow or loses writes.
+type FaultCache struct {
+	cache nds.Cache
+
+	mu     sync.Mutex
+	faults Faults
+	rand   *rand.Rand
+}
+
+var _ nds.Cache = (*FaultCache)(nil)
+
+// NewFaultCache returns a FaultCache wrapping cache that injects faults. seed
+// seeds the random choice of faults so that failures can be reproduced.
+func NewFaultCache(cache nds.Cache, faults Faults, seed int64) *FaultCache {
+	return &FaultCache{
+		cache:  cache,
+		faults: faults,
+		rand:   rand.New(rand.NewSource(seed)),
+	}
+}
+
+// SetFaults replaces the faults injected by fc.
+func (fc *FaultCache) SetFaults(faults Faults) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.faults = faults
+}
+
+// chance returns true percent percent of the time.
+func (fc *FaultCache) chance(percent int) bool {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	return percent > 0 && fc.rand.Intn(100) < percent
+}
+
+// before injects the faults configured for op on keys. It returns ErrFault if
+// the call should fail.
+func (fc *FaultCache) before(c context.Context, op Op, keys []string) error {
+	fc.mu.Lock()
+	faults := fc.faults
+	var delay time.Duration
+	if faults.MaxDelay > 0 {
+		delay = time.Duration(fc.rand.Int63n(int64(faults.MaxDelay)))
+	}
+	fc.mu.Unlock()
+
+	time.Sleep(delay)
+
+	evictKeys := []string{}
+	for _, key := range keys {
+		if fc.chance(faults.Evict) {
+			evictKeys = append(evictKeys, key)
+		}
+	}
+	if len(evictKeys) > 0 {
+		if err := fc.cache.DeleteMulti(c, evictKeys); err != nil {
+			return err
+		}
+	}
+
+	if fc.chance(faults.Fail[op]) {
+		return ErrFault
+	}
+	return nil
+}
+
+func itemKeys(items []*nds.Item) []string {
+	keys := make([]string, len(items))
+	for i, item := range items {
+		keys[i] = item.Key
+	}
+	return keys
+}
+
+// NewContext calls the wrapped cache's NewContext.
+func (fc *FaultCache) NewContext(c context.Context) (context.Context, error) {
+	return fc.cache.NewContext(c)
+}
+
+// GetMulti calls the wrapped cache's GetMulti.
+func (fc *FaultCache) GetMulti(c context.Context,
+	keys []string) (map[string]*nds.Item, error) {
+
+	if err := fc.before(c, OpGetMulti, keys); err != nil {
+		return nil, err
+	}
+	return fc.cache.GetMulti(c, keys)
+}
+
+// AddMulti calls the wrapped cache's AddMulti.
+func (fc *FaultCache) AddMulti(c context.Context, items []*nds.Item) error {
+	if err := fc.before(c, OpAddMulti, itemKeys(items)); err != nil {
+		return err
+	}
+	return fc.cache.AddMulti(c, items)
+}
+
+// SetMulti calls the wrapped cache's SetMulti.
+func (fc *FaultCache) SetMulti(c context.Context, items []*nds.Item) error {
+	if err := fc.before(c, OpSetMulti, itemKeys(items)); err != nil {
+		return err
+	}
+	return fc.cache.SetMulti(c, items)
+}
+
+// CompareAndSwapMulti calls the wrapped cache's CompareAndSwapMulti, silently
+// dropping a percentage of items.
+func (fc *FaultCache) CompareAndSwapMulti(c context.Context,
+	items []*nds.Item) error {
+
+	if err := fc.before(c, OpCompareAndSwapMulti,
+		itemKeys(items)); err != nil {
+		return err
+	}
+
+	swapItems := make([]*nds.Item, 0, len(items))
+	swapIndexes := make([]int, 0, len(items))
+	for i, item := range items {
+		if !fc.chance(fc.dropCAS()) {
+			swapItems = append(swapItems, item)
+			swapIndexes = append(swapIndexes, i)
+		}
+	}
+	if len(swapItems) == len(items) {
+		return fc.cache.CompareAndSwapMulti(c, items)
+	}
+	if len(swapItems) == 0 {
+		return nil
+	}
+
+	err := fc.cache.CompareAndSwapMulti(c, swapItems)
+	me, ok := err.(appengine.MultiError)
+	if !ok {
+		return err
+	}
+
+	// Map the errors back to the positions of the original items.
+	errs := make(appengine.MultiError, len(items))
+	for i, index := range swapIndexes {
+		errs[index] = me[i]
+	}
+	return errs
+}
+
+func (fc *FaultCache) dropCAS() int {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	return fc.faults.DropCAS
+}
+
+// DeleteMulti calls the wrapped cache's DeleteMulti.
+func (fc *FaultCache) DeleteMulti(c context.Context, keys []string) error {
+	if err := fc.before(c, OpDeleteMulti, keys); err != nil {
+		return err
+	}
+	return fc.cache.DeleteMulti(c, keys)
+}
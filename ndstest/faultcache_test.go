@@ -0,0 +1,84 @@
+package ndstest_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/qedus/nds"
+	"github.com/qedus/nds/ndstest"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestFaultCacheGet(t *testing.T) {
+	c := context.Background()
+	cache := ndstest.NewCache()
+	fc := ndstest.NewFaultCache(cache, ndstest.Faults{}, 1)
+	ndstest.Install(t, ndstest.NewDatastore(), fc)
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(c, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	faults := []ndstest.Faults{
+		{Fail: map[ndstest.Op]int{ndstest.OpGetMulti: 100}},
+		{Fail: map[ndstest.Op]int{ndstest.OpAddMulti: 100}},
+		{Fail: map[ndstest.Op]int{ndstest.OpCompareAndSwapMulti: 100}},
+		{Evict: 100},
+		{DropCAS: 100},
+		{MaxDelay: time.Millisecond},
+	}
+	for i, f := range faults {
+		cache.Flush()
+		fc.SetFaults(f)
+		for j := 0; j < 2; j++ {
+			entity := &testEntity{}
+			if err := nds.Get(c, key, entity); err != nil {
+				t.Fatal(i, err)
+			}
+			if entity.IntVal != 1 {
+				t.Fatal(i, "incorrect IntVal", entity.IntVal)
+			}
+		}
+	}
+
+	// Dropped CAS writes must never leave an entity in the cache.
+	fc.SetFaults(ndstest.Faults{DropCAS: 100})
+	cache.Flush()
+	if err := nds.Get(c, key, &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+	fc.SetFaults(ndstest.Faults{})
+	if _, err := nds.Put(c, key, &testEntity{2}); err != nil {
+		t.Fatal(err)
+	}
+	entity := &testEntity{}
+	if err := nds.Get(c, key, entity); err != nil {
+		t.Fatal(err)
+	}
+	if entity.IntVal != 2 {
+		t.Fatal("incorrect IntVal", entity.IntVal)
+	}
+}
+
+func TestFaultCachePut(t *testing.T) {
+	c := context.Background()
+	d := ndstest.NewDatastore()
+	fc := ndstest.NewFaultCache(ndstest.NewCache(), ndstest.Faults{
+		Fail: map[ndstest.Op]int{ndstest.OpSetMulti: 100},
+	}, 1)
+	ndstest.Install(t, d, fc)
+
+	// Entities must not be put if their cache items cannot be locked.
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(c, key, &testEntity{1}); err != ndstest.ErrFault {
+		t.Fatal("expected ErrFault", err)
+	}
+	if err := nds.Delete(c, key); err != ndstest.ErrFault {
+		t.Fatal("expected ErrFault", err)
+	}
+	if d.Len() != 0 {
+		t.Fatal("expected no entities")
+	}
+}
@@ -0,0 +1,78 @@
+// Package ndstest provides an in-memory Datastore and Cache so that code using
+// nds can be tested without aetest and the App Engine development server.
+//
+//	func TestEntity(t *testing.T) {
+//		c := ndstest.NewContext(t)
+//		key := datastore.NewKey(c, "Entity", "", 1, nil)
+//		if _, err := nds.Put(c, key, &Entity{}); err != nil {
+//			t.Fatal(err)
+//		}
+//		...
+//	}
+//
+// FaultCache injects failures, evictions, delays and lost writes into any
+// nds.Cache, and CheckConsistency uses it to check that concurrent nds calls
+// never return stale entities.
+//
+// The Datastore and Cache replace nds' global backends for the duration of a
+// test so tests using NewContext or Install must not run in parallel. Tests
+// using NewClient can.
+package ndstest
+
+import (
+	"os"
+	"testing"
+
+	"github.com/qedus/nds"
+	"golang.org/x/net/context"
+)
+
+// AppID is the application ID given to keys created with datastore.NewKey in
+// tests using this package, unless the GAE_APPLICATION environment variable is
+// already set.
+const AppID = "ndstest"
+
+// NewContext makes nds use a new Datastore and Cache until t completes and
+// returns a context that can be used with nds and datastore.NewKey.
+func NewContext(t testing.TB) context.Context {
+	Install(t, NewDatastore(), NewCache())
+	return context.Background()
+}
+
+// NewClient returns an nds.Client that uses a new Datastore and Cache and logs
+// nds warnings with t.Logf.
+func NewClient(t testing.TB) *nds.Client {
+	setAppID()
+	return nds.NewClient(NewDatastore(), NewCache(), nds.Config{
+		Logger: func(_ context.Context, format string, args ...interface{}) {
+			t.Logf(format, args...)
+		},
+	})
+}
+
+// setAppID sets the application ID read by datastore.NewKey outside of App
+// Engine.
+func setAppID() {
+	if os.Getenv("GAE_APPLICATION") == "" {
+		os.Setenv("GAE_APPLICATION", AppID)
+	}
+}
+
+// Install makes nds use d and c until t completes, after which the App Engine
+// datastore and memcache are restored. nds warnings are logged with t.Logf.
+func Install(t testing.TB, d nds.Datastore, c nds.Cache) {
+	setAppID()
+
+	nds.SetDatastore(d)
+	nds.SetCache(c)
+	nds.SetLogger(func(_ context.Context, format string,
+		args ...interface{}) {
+		t.Logf(format, args...)
+	})
+
+	t.Cleanup(func() {
+		nds.SetDatastore(nil)
+		nds.SetCache(nil)
+		nds.SetLogger(nil)
+	})
+}
@@ -0,0 +1,247 @@
+package ndstest_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/qedus/nds"
+	"github.com/qedus/nds/ndstest"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+type testEntity struct {
+	IntVal int
+}
+
+func TestNewClient(t *testing.T) {
+	t.Parallel()
+	cl := ndstest.NewClient(t)
+	c := context.Background()
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := cl.Put(c, key, &testEntity{42}); err != nil {
+		t.Fatal(err)
+	}
+	entity := &testEntity{}
+	if err := cl.Get(c, key, entity); err != nil {
+		t.Fatal(err)
+	}
+	if entity.IntVal != 42 {
+		t.Fatal("incorrect IntVal", entity.IntVal)
+	}
+}
+
+func TestPutGetDelete(t *testing.T) {
+	c := ndstest.NewContext(t)
+
+	key := datastore.NewKey(c, "Entity", "", 0, nil)
+	key, err := nds.Put(c, key, &testEntity{42})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.Incomplete() {
+		t.Fatal("expected complete key")
+	}
+
+	// Load from the datastore then the cache.
+	for i := 0; i < 2; i++ {
+		entity := &testEntity{}
+		if err := nds.Get(c, key, entity); err != nil {
+			t.Fatal(err)
+		}
+		if entity.IntVal != 42 {
+			t.Fatal("incorrect IntVal", entity.IntVal)
+		}
+	}
+
+	if err := nds.Delete(c, key); err != nil {
+		t.Fatal(err)
+	}
+	if err := nds.Get(c, key, &testEntity{}); err != datastore.ErrNoSuchEntity {
+		t.Fatal("expected ErrNoSuchEntity", err)
+	}
+}
+
+func TestInvalidKeys(t *testing.T) {
+	c := ndstest.NewContext(t)
+
+	incompleteKey := datastore.NewIncompleteKey(c, "Entity", nil)
+	if err := nds.Get(c, incompleteKey,
+		&testEntity{}); err != datastore.ErrInvalidKey {
+		t.Fatal("expected ErrInvalidKey", err)
+	}
+
+	d := ndstest.NewDatastore()
+	_, err := d.PutMulti(c, []*datastore.Key{nil},
+		[]datastore.PropertyList{{}})
+	if me, ok := err.(appengine.MultiError); !ok ||
+		me[0] != datastore.ErrInvalidKey {
+		t.Fatal("expected ErrInvalidKey", err)
+	}
+}
+
+func TestAllocateIDs(t *testing.T) {
+	c := ndstest.NewContext(t)
+
+	parent := datastore.NewKey(c, "Parent", "p", 0, nil)
+	keys := []*datastore.Key{
+		datastore.NewIncompleteKey(c, "Entity", parent),
+		datastore.NewIncompleteKey(c, "Entity", parent),
+	}
+	keys, err := nds.PutMulti(c, keys, []testEntity{{1}, {2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys[0].Equal(keys[1]) {
+		t.Fatal("expected different keys")
+	}
+	for _, key := range keys {
+		if key.Incomplete() || !key.Parent().Equal(parent) {
+			t.Fatal("incorrect key", key)
+		}
+	}
+}
+
+func TestTransaction(t *testing.T) {
+	c := ndstest.NewContext(t)
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(c, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Transactions do not see their own writes until they commit.
+	if err := nds.RunInTransaction(c, func(tc context.Context) error {
+		if _, err := nds.Put(tc, key, &testEntity{2}); err != nil {
+			return err
+		}
+		entity := &testEntity{}
+		if err := nds.Get(tc, key, entity); err != nil {
+			return err
+		}
+		if entity.IntVal != 1 {
+			t.Fatal("incorrect IntVal", entity.IntVal)
+		}
+		return nil
+	}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	entity := &testEntity{}
+	if err := nds.Get(c, key, entity); err != nil {
+		t.Fatal(err)
+	}
+	if entity.IntVal != 2 {
+		t.Fatal("incorrect IntVal", entity.IntVal)
+	}
+}
+
+func TestTransactionConflict(t *testing.T) {
+	c := ndstest.NewContext(t)
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	childKey := datastore.NewKey(c, "Entity", "", 2, key)
+
+	attempts := 0
+	err := nds.RunInTransaction(c, func(tc context.Context) error {
+		attempts++
+		err := nds.Get(tc, key, &testEntity{})
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+
+		// Modify the same entity group outside of the transaction.
+		if _, err := nds.Put(c, childKey, &testEntity{}); err != nil {
+			return err
+		}
+		_, err = nds.Put(tc, key, &testEntity{})
+		return err
+	}, &datastore.TransactionOptions{Attempts: 2})
+	if err != datastore.ErrConcurrentTransaction {
+		t.Fatal("expected ErrConcurrentTransaction", err)
+	}
+	if attempts != 2 {
+		t.Fatal("incorrect attempts", attempts)
+	}
+	if err := nds.Get(c, key, &testEntity{}); err != datastore.ErrNoSuchEntity {
+		t.Fatal("expected ErrNoSuchEntity", err)
+	}
+}
+
+func TestTransactionCrossGroup(t *testing.T) {
+	c := ndstest.NewContext(t)
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewKey(c, "Entity", "", 2, nil),
+	}
+	entities := []testEntity{{1}, {2}}
+
+	if err := nds.RunInTransaction(c, func(tc context.Context) error {
+		_, err := nds.PutMulti(tc, keys, entities)
+		return err
+	}, nil); err == nil {
+		t.Fatal("expected cross-group error")
+	}
+
+	if err := nds.RunInTransaction(c, func(tc context.Context) error {
+		_, err := nds.PutMulti(tc, keys, entities)
+		return err
+	}, &datastore.TransactionOptions{XG: true}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCache(t *testing.T) {
+	c := context.Background()
+	cache := ndstest.NewCache()
+
+	item := &nds.Item{
+		Key:        "key",
+		Value:      []byte("value"),
+		Expiration: time.Second,
+	}
+	if err := cache.AddMulti(c, []*nds.Item{item}); err != nil {
+		t.Fatal(err)
+	}
+	err := cache.AddMulti(c, []*nds.Item{item})
+	if me, ok := err.(appengine.MultiError); !ok || me[0] != nds.ErrNotStored {
+		t.Fatal("expected ErrNotStored", err)
+	}
+
+	items, err := cache.GetMulti(c, []string{"key"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := items["key"]
+
+	items, err = cache.GetMulti(c, []string{"key"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second := items["key"]
+
+	if err := cache.CompareAndSwapMulti(c,
+		[]*nds.Item{first}); err != nil {
+		t.Fatal(err)
+	}
+	err = cache.CompareAndSwapMulti(c, []*nds.Item{second})
+	if me, ok := err.(appengine.MultiError); !ok ||
+		me[0] != nds.ErrCASConflict {
+		t.Fatal("expected ErrCASConflict", err)
+	}
+
+	cache.Advance(time.Second)
+	if items, err := cache.GetMulti(c, []string{"key"}); err != nil {
+		t.Fatal(err)
+	} else if len(items) != 0 {
+		t.Fatal("expected expired item")
+	}
+
+	err = cache.CompareAndSwapMulti(c, []*nds.Item{first})
+	if me, ok := err.(appengine.MultiError); !ok || me[0] != nds.ErrNotStored {
+		t.Fatal("expected ErrNotStored", err)
+	}
+}
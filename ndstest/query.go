@@ -0,0 +1,332 @@
+package ndstest
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/qedus/nds"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+const keyProperty = "__key__"
+
+var errNonAncestorQuery = errors.New(
+	"ndstest: only ancestor queries are allowed inside transactions")
+
+type queryResult struct {
+	key *datastore.Key
+	pl  datastore.PropertyList
+}
+
+// QueryKeys runs a keys-only query. Cursors are positions within the
+// current results so, unlike App Engine cursors, they can refer to different
+// entities if entities are put or deleted between queries.
+func (d *Datastore) QueryKeys(c context.Context,
+	q *nds.KeysQuery) ([]*datastore.Key, nds.Cursor, error) {
+
+	start, err := decodeCursor(q.Start, 0)
+	if err != nil {
+		return nil, "", err
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	if tx, ok := transactionFromContext(c); ok {
+		if q.Ancestor == nil {
+			return nil, "", errNonAncestorQuery
+		}
+		if err := d.use(tx, q.Ancestor); err != nil {
+			return nil, "", err
+		}
+	}
+
+	namespace := q.Namespace
+	if q.Ancestor != nil {
+		namespace = q.Ancestor.Namespace()
+	}
+
+	results := []queryResult{}
+	for encoded, pl := range d.entities {
+		key, err := datastore.DecodeKey(encoded)
+		if err != nil {
+			return nil, "", err
+		}
+		if key.Namespace() != namespace ||
+			(q.Kind != "" && key.Kind() != q.Kind) ||
+			(q.Ancestor != nil && !hasAncestor(key, q.Ancestor)) {
+			continue
+		}
+
+		result := queryResult{key: key, pl: pl}
+		if matches(result, q.Filters) && hasProperties(result, q.Orders) {
+			results = append(results, result)
+		}
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		return less(results[i], results[j], q.Orders)
+	})
+
+	end, err := decodeCursor(q.End, len(results))
+	if err != nil {
+		return nil, "", err
+	}
+	if end > len(results) {
+		end = len(results)
+	}
+
+	lo := start + q.Offset
+	if lo > end {
+		lo = end
+	}
+	hi := lo + q.Limit
+	if hi > end {
+		hi = end
+	}
+
+	keys := make([]*datastore.Key, 0, hi-lo)
+	for _, result := range results[lo:hi] {
+		keys = append(keys, result.key)
+	}
+	return keys, nds.Cursor(strconv.Itoa(hi)), nil
+}
+
+func decodeCursor(cursor nds.Cursor, empty int) (int, error) {
+	if cursor == "" {
+		return empty, nil
+	}
+	i, err := strconv.Atoi(string(cursor))
+	if err != nil || i < 0 {
+		return 0, fmt.Errorf("ndstest: invalid cursor %q", cursor)
+	}
+	return i, nil
+}
+
+func hasAncestor(key, ancestor *datastore.Key) bool {
+	for ; key != nil; key = key.Parent() {
+		if key.Equal(ancestor) {
+			return true
+		}
+	}
+	return false
+}
+
+// values returns the indexed values of property.
+func (r queryResult) values(property string) []interface{} {
+	if property == keyProperty {
+		return []interface{}{r.key}
+	}
+
+	values := []interface{}{}
+	for _, p := range r.pl {
+		if p.Name == property && !p.NoIndex {
+			values = append(values, p.Value)
+		}
+	}
+	return values
+}
+
+func matches(r queryResult, filters []nds.Filter) bool {
+	// Like the datastore, a single value of a multiple valued property must
+	// satisfy all inequality filters on that property.
+	inequalities := map[string][]nds.Filter{}
+	for _, f := range filters {
+		if f.Operator != "=" {
+			inequalities[f.Property] = append(inequalities[f.Property], f)
+			continue
+		}
+
+		if !anyValue(r.values(f.Property), []nds.Filter{f}) {
+			return false
+		}
+	}
+
+	for property, fs := range inequalities {
+		if !anyValue(r.values(property), fs) {
+			return false
+		}
+	}
+	return true
+}
+
+func anyValue(values []interface{}, filters []nds.Filter) bool {
+	for _, v := range values {
+		ok := true
+		for _, f := range filters {
+			cmp := compare(v, f.Value)
+			switch f.Operator {
+			case "=":
+				ok = ok && cmp == 0
+			case "<":
+				ok = ok && cmp < 0
+			case "<=":
+				ok = ok && cmp <= 0
+			case ">":
+				ok = ok && cmp > 0
+			case ">=":
+				ok = ok && cmp >= 0
+			default:
+				ok = false
+			}
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+func hasProperties(r queryResult, orders []nds.Order) bool {
+	for _, o := range orders {
+		if len(r.values(o.Property)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// orderValue returns the value used to sort by a property. Like the
+// datastore, the smallest value of a multiple valued property is used for
+// ascending orders and the largest for descending orders.
+func orderValue(r queryResult, o nds.Order) interface{} {
+	values := r.values(o.Property)
+	v := values[0]
+	for _, value := range values[1:] {
+		cmp := compare(value, v)
+		if (o.Descending && cmp > 0) || (!o.Descending && cmp < 0) {
+			v = value
+		}
+	}
+	return v
+}
+
+func less(a, b queryResult, orders []nds.Order) bool {
+	for _, o := range orders {
+		cmp := compare(orderValue(a, o), orderValue(b, o))
+		if o.Descending {
+			cmp = -cmp
+		}
+		if cmp != 0 {
+			return cmp < 0
+		}
+	}
+	return compareKeys(a.key, b.key) < 0
+}
+
+// normalize converts v into one of the types the datastore stores and returns
+// its rank in the datastore's ordering of types.
+func normalize(v interface{}) (interface{}, int) {
+	switch v := v.(type) {
+	case nil:
+		return nil, 0
+	case int:
+		return int64(v), 1
+	case int8:
+		return int64(v), 1
+	case int16:
+		return int64(v), 1
+	case int32:
+		return int64(v), 1
+	case int64:
+		return v, 1
+	case time.Time:
+		return v, 2
+	case bool:
+		return v, 3
+	case datastore.ByteString:
+		return string(v), 4
+	case string:
+		return v, 4
+	case appengine.BlobKey:
+		return string(v), 4
+	case float32:
+		return float64(v), 5
+	case float64:
+		return v, 5
+	case appengine.GeoPoint:
+		return v, 6
+	case *datastore.Key:
+		return v, 7
+	}
+	return v, 8
+}
+
+// compare orders a and b in the same way as the datastore, returning a
+// negative number if a is less than b, zero if they are equal and a positive
+// number otherwise.
+func compare(a, b interface{}) int {
+	a, rankA := normalize(a)
+	b, rankB := normalize(b)
+	if rankA != rankB {
+		return rankA - rankB
+	}
+
+	switch a := a.(type) {
+	case int64:
+		return compareOrdered(a < b.(int64), a > b.(int64))
+	case time.Time:
+		return compareOrdered(a.Before(b.(time.Time)), a.After(b.(time.Time)))
+	case bool:
+		return compareOrdered(!a && b.(bool), a && !b.(bool))
+	case string:
+		return compareOrdered(a < b.(string), a > b.(string))
+	case float64:
+		return compareOrdered(a < b.(float64), a > b.(float64))
+	case appengine.GeoPoint:
+		b := b.(appengine.GeoPoint)
+		if a.Lat != b.Lat {
+			return compareOrdered(a.Lat < b.Lat, a.Lat > b.Lat)
+		}
+		return compareOrdered(a.Lng < b.Lng, a.Lng > b.Lng)
+	case *datastore.Key:
+		return compareKeys(a, b.(*datastore.Key))
+	}
+	return 0
+}
+
+func compareOrdered(less, greater bool) int {
+	switch {
+	case less:
+		return -1
+	case greater:
+		return 1
+	}
+	return 0
+}
+
+func keyPath(key *datastore.Key) []*datastore.Key {
+	path := []*datastore.Key{}
+	for ; key != nil; key = key.Parent() {
+		path = append([]*datastore.Key{key}, path...)
+	}
+	return path
+}
+
+// compareKeys orders keys by their paths, ordering integer IDs before string
+// IDs, as the datastore does.
+func compareKeys(a, b *datastore.Key) int {
+	pathA, pathB := keyPath(a), keyPath(b)
+	for i := 0; i < len(pathA) && i < len(pathB); i++ {
+		a, b := pathA[i], pathB[i]
+		if a.Kind() != b.Kind() {
+			return compareOrdered(a.Kind() < b.Kind(), a.Kind() > b.Kind())
+		}
+		if (a.StringID() == "") != (b.StringID() == "") {
+			return compareOrdered(a.StringID() == "", b.StringID() == "")
+		}
+		if a.IntID() != b.IntID() {
+			return compareOrdered(a.IntID() < b.IntID(), a.IntID() > b.IntID())
+		}
+		if a.StringID() != b.StringID() {
+			return compareOrdered(a.StringID() < b.StringID(),
+				a.StringID() > b.StringID())
+		}
+	}
+	return len(pathA) - len(pathB)
+}
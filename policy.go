@@ -0,0 +1,50 @@
+package nds
+
+import (
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+var policyKey = "used for Policy"
+
+// Policy controls how Get and GetMulti use the context cache, LocalCache and
+// Cache for an entity. Policies can be combined with |.
+//
+// Put, Delete and RunInTransaction invalidate cached entities whatever their
+// Policy, so changing the Policy of an entity never exposes stale entities.
+type Policy uint8
+
+const (
+	// SkipCacheRead makes Get and GetMulti ignore cached entities and load
+	// them from the datastore, replacing them in the cache.
+	SkipCacheRead Policy = 1 << iota
+
+	// SkipCacheWrite makes Get and GetMulti load entities that are not
+	// cached from the datastore without caching them.
+	SkipCacheWrite
+
+	// BypassCache makes Get and GetMulti load entities from the datastore
+	// without using the cache at all.
+	BypassCache = SkipCacheRead | SkipCacheWrite
+)
+
+// WithPolicy returns a context that makes nds calls apply p to every entity,
+// in addition to the Policy returned by the Policy function of their Config.
+func WithPolicy(c context.Context, p Policy) context.Context {
+	return context.WithValue(c, &policyKey, policyFromContext(c)|p)
+}
+
+func policyFromContext(c context.Context) Policy {
+	p, _ := c.Value(&policyKey).(Policy)
+	return p
+}
+
+// keyPolicy returns the Policy nds calls made with c apply to the entity of
+// key.
+func keyPolicy(c context.Context, cfg *Config, key *datastore.Key) Policy {
+	p := policyFromContext(c)
+	if cfg.Policy != nil && key != nil {
+		p |= cfg.Policy(key)
+	}
+	return p
+}
@@ -0,0 +1,81 @@
+package nds_test
+
+import (
+	"testing"
+
+	"github.com/qedus/nds"
+	"github.com/qedus/nds/ndstest"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestPolicy(t *testing.T) {
+	d, cache := &countingDatastore{Datastore: ndstest.NewDatastore()},
+		ndstest.NewCache()
+	ndstest.Install(t, d, cache)
+
+	bypass := false
+	c := nds.WithConfig(context.Background(), nds.Config{
+		Logger: testLogger(t),
+		Policy: func(key *datastore.Key) nds.Policy {
+			if bypass || key.Kind() == "Counter" {
+				return nds.BypassCache
+			}
+			return 0
+		},
+	})
+
+	get := func(c context.Context, key *datastore.Key, text string,
+		gets int) {
+		t.Helper()
+		entity := &textEntity{}
+		if err := nds.Get(c, key, entity); err != nil {
+			t.Fatal(err)
+		}
+		if entity.Text != text {
+			t.Fatal("incorrect entity", entity)
+		}
+		if d.gets != gets {
+			t.Fatal("incorrect gets", d.gets)
+		}
+	}
+
+	// Kinds that bypass the cache are never cached.
+	counterKey := datastore.NewKey(c, "Counter", "", 1, nil)
+	if _, err := nds.Put(c, counterKey, &textEntity{"one"}); err != nil {
+		t.Fatal(err)
+	}
+	get(c, counterKey, "one", 1)
+	get(c, counterKey, "one", 2)
+	if cache.Len() != 0 {
+		t.Fatal("entity cached")
+	}
+
+	// Entities that skip cache writes are loaded without being cached.
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(c, key, &textEntity{"one"}); err != nil {
+		t.Fatal(err)
+	}
+	get(nds.WithPolicy(c, nds.SkipCacheWrite), key, "one", 3)
+	get(c, key, "one", 4)
+	get(nds.WithPolicy(c, nds.SkipCacheWrite), key, "one", 4)
+
+	// Entities that skip cache reads are refreshed from the datastore.
+	if _, err := d.PutMulti(c, []*datastore.Key{key},
+		[]datastore.PropertyList{{{Name: "Text", Value: "two",
+			NoIndex: true}}}); err != nil {
+		t.Fatal(err)
+	}
+	get(c, key, "one", 4)
+	get(nds.WithPolicy(c, nds.SkipCacheRead), key, "two", 5)
+	get(c, key, "two", 5)
+
+	// Changes made while an entity bypasses the cache invalidate it.
+	bypass = true
+	if _, err := nds.Put(c, key, &textEntity{"three"}); err != nil {
+		t.Fatal(err)
+	}
+	bypass = false
+	get(c, key, "three", 6)
+	get(c, key, "three", 6)
+}
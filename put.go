@@ -7,8 +7,6 @@ import (
 	"golang.org/x/net/context"
 	"google.golang.org/appengine"
 	"google.golang.org/appengine/datastore"
-	"google.golang.org/appengine/log"
-	"google.golang.org/appengine/memcache"
 )
 
 // putMultiLimit is the App Engine datastore limit for the maximum number
@@ -32,15 +30,16 @@ func PutMulti(c context.Context,
 		return nil, err
 	}
 
-	callCount := (len(keys)-1)/putMultiLimit + 1
+	limit := configFromContext(c).putMultiLimit()
+	callCount := (len(keys)-1)/limit + 1
 	putKeys := make([][]*datastore.Key, callCount)
 	errs := make([]error, callCount)
 
 	var wg sync.WaitGroup
 	wg.Add(callCount)
 	for i := 0; i < callCount; i++ {
-		lo := i * putMultiLimit
-		hi := (i + 1) * putMultiLimit
+		lo := i * limit
+		hi := (i + 1) * limit
 		if hi > len(keys) {
 			hi = len(keys)
 		}
@@ -55,8 +54,8 @@ func PutMulti(c context.Context,
 	if isErrorsNil(errs) {
 		groupedKeys := make([]*datastore.Key, len(keys))
 		for i, k := range putKeys {
-			lo := i * putMultiLimit
-			hi := (i + 1) * putMultiLimit
+			lo := i * limit
+			hi := (i + 1) * limit
 			if hi > len(keys) {
 				hi = len(keys)
 			}
@@ -68,8 +67,8 @@ func PutMulti(c context.Context,
 	groupedKeys := make([]*datastore.Key, len(keys))
 	groupedErrs := make(appengine.MultiError, len(keys))
 	for i, err := range errs {
-		lo := i * putMultiLimit
-		hi := (i + 1) * putMultiLimit
+		lo := i * limit
+		hi := (i + 1) * limit
 		if hi > len(keys) {
 			hi = len(keys)
 		}
@@ -119,32 +118,38 @@ func Put(c context.Context,
 func putMulti(c context.Context,
 	keys []*datastore.Key, vals interface{}) ([]*datastore.Key, error) {
 
-	lockMemcacheKeys := make([]string, 0, len(keys))
-	lockMemcacheItems := make([]*memcache.Item, 0, len(keys))
-	for _, key := range keys {
-		if !key.Incomplete() {
-			item := &memcache.Item{
-				Key:        createMemcacheKey(key),
-				Flags:      lockItem,
-				Value:      itemLock(),
-				Expiration: memcacheLockTime,
-			}
-			lockMemcacheItems = append(lockMemcacheItems, item)
-			lockMemcacheKeys = append(lockMemcacheKeys, item.Key)
-		}
+	pls, err := saveValues(reflect.ValueOf(vals))
+	if err != nil {
+		return nil, err
 	}
 
-	memcacheCtx, err := memcacheContext(c)
+	// Lock query results of the kinds being put. Removing the locks once the
+	// entities are put invalidates them.
+	cl, cfg := clientFromContext(c), configFromContext(c)
+	lockMemcacheItems := append(entityLockItems(cfg, keys),
+		generationLockItems(cfg, keys)...)
+	lockMemcacheKeys := make([]string, 0, len(lockMemcacheItems))
+	for _, item := range lockMemcacheItems {
+		lockMemcacheKeys = append(lockMemcacheKeys, item.Key)
+	}
+
+	memcacheCtx, err := cl.cache.NewContext(c)
 	if err != nil {
 		return nil, err
 	}
 
+	invalidateLocalCache(c, lockMemcacheItems)
+
 	defer func() {
 		if _, ok := transactionFromContext(c); !ok {
+			// Entities could have been loaded into the local cache while the
+			// datastore was being written to.
+			invalidateLocalCache(c, lockMemcacheItems)
+
 			// Remove the locks.
-			if err := memcacheDeleteMulti(memcacheCtx,
+			if err := cl.cache.DeleteMulti(memcacheCtx,
 				lockMemcacheKeys); err != nil {
-				log.Warningf(c, "putMulti memcache.DeleteMulti %s", err)
+				warningf(c, "putMulti cache.DeleteMulti %s", err)
 			}
 		}
 	}()
@@ -154,11 +159,13 @@ func putMulti(c context.Context,
 		tx.lockMemcacheItems = append(tx.lockMemcacheItems,
 			lockMemcacheItems...)
 		tx.Unlock()
-	} else if err := memcacheSetMulti(memcacheCtx,
+	} else if err := cl.cache.SetMulti(memcacheCtx,
 		lockMemcacheItems); err != nil {
 		return nil, err
 	}
 
 	// Save to the datastore.
-	return datastorePutMulti(c, keys, vals)
+	putKeys, err := cl.datastore.PutMulti(c, keys, pls)
+	putContextCache(c, keys, putKeys, pls, err)
+	return putKeys, err
 }
@@ -0,0 +1,499 @@
+package nds
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+// queryBatchSize is the maximum number of keys GetAll fetches from the
+// datastore, and then from the cache, at once.
+const queryBatchSize = 1000
+
+// iteratorBatchSize is the maximum number of keys an Iterator fetches from the
+// datastore, and then from the cache, at once.
+const iteratorBatchSize = 100
+
+// Cursor is an opaque position within the results of a query that is
+// produced by the Datastore. The empty Cursor is the start of the results.
+type Cursor string
+
+// Filter is a property filter of a KeysQuery.
+type Filter struct {
+	// Property is the name of the property or "__key__".
+	Property string
+
+	// Operator is one of "=", "<", "<=", ">" or ">=".
+	Operator string
+
+	Value interface{}
+}
+
+// Order is a sort order of a KeysQuery.
+type Order struct {
+	// Property is the name of the property or "__key__".
+	Property string
+
+	Descending bool
+}
+
+// KeysQuery is a keys-only query run by a Datastore.
+type KeysQuery struct {
+	Kind string
+
+	// Namespace is the namespace to query. The empty string means the
+	// namespace of the context.
+	Namespace string
+
+	Ancestor *datastore.Key
+	Filters  []Filter
+	Orders   []Order
+
+	// Offset is the number of keys to skip before returning any.
+	Offset int
+
+	// Limit is the maximum number of keys to return and is never negative.
+	Limit int
+
+	// Start and End restrict the results to those between the two cursors.
+	// Empty cursors do not restrict the results.
+	Start Cursor
+	End   Cursor
+
+	EventualConsistency bool
+}
+
+var operators = map[string]bool{
+	"=":  true,
+	"<":  true,
+	"<=": true,
+	">":  true,
+	">=": true,
+}
+
+// Query represents a datastore query. It is used in the same way as
+// datastore.Query except that results are always loaded through the cache.
+// Query values are immutable: each method returns a modified copy.
+//
+// Queries are run as keys-only queries against the datastore and the
+// resulting keys are then loaded in the same way as GetMulti. Although this
+// means results can be served from the cache, note that queries are
+// eventually consistent and may return keys of entities that have since been
+// deleted. Such entities are skipped.
+type Query struct {
+	kq              KeysQuery
+	limit           int
+	keysOnly        bool
+	cacheExpiration time.Duration
+	err             error
+}
+
+// NewQuery creates a new Query for a specific entity kind.
+func NewQuery(kind string) *Query {
+	return &Query{
+		kq: KeysQuery{
+			Kind: kind,
+		},
+		limit: -1,
+	}
+}
+
+func (q *Query) clone() *Query {
+	x := *q
+	x.kq.Filters = append([]Filter(nil), q.kq.Filters...)
+	x.kq.Orders = append([]Order(nil), q.kq.Orders...)
+	return &x
+}
+
+// Ancestor returns a derivative query with an ancestor filter.
+func (q *Query) Ancestor(ancestor *datastore.Key) *Query {
+	q = q.clone()
+	if ancestor == nil {
+		q.err = errors.New("nds: nil query ancestor")
+		return q
+	}
+	q.kq.Ancestor = ancestor
+	return q
+}
+
+// Namespace returns a derivative query that queries namespace instead of the
+// namespace of the context.
+func (q *Query) Namespace(namespace string) *Query {
+	q = q.clone()
+	q.kq.Namespace = namespace
+	return q
+}
+
+// EventualConsistency returns a derivative query that returns eventually
+// consistent results. It only has an effect on ancestor queries.
+func (q *Query) EventualConsistency() *Query {
+	q = q.clone()
+	q.kq.EventualConsistency = true
+	return q
+}
+
+// Filter returns a derivative query with a field-based filter. The filterStr
+// argument must be a field name followed by optional space, followed by an
+// operator, one of ">", "<", ">=", "<=", or "=". Fields are compared against
+// the provided value using the operator.
+func (q *Query) Filter(filterStr string, value interface{}) *Query {
+	q = q.clone()
+	filterStr = strings.TrimSpace(filterStr)
+	if len(filterStr) < 1 {
+		q.err = errors.New("nds: invalid query filter: " + filterStr)
+		return q
+	}
+
+	property := strings.TrimRight(filterStr, " ><=!")
+	operator := strings.TrimSpace(filterStr[len(property):])
+	if operator == "" {
+		operator = "="
+	}
+	if !operators[operator] {
+		q.err = fmt.Errorf("nds: invalid operator %q in filter %q",
+			operator, filterStr)
+		return q
+	}
+
+	q.kq.Filters = append(q.kq.Filters, Filter{
+		Property: property,
+		Operator: operator,
+		Value:    value,
+	})
+	return q
+}
+
+// Order returns a derivative query with a field-based sort order. Orders are
+// applied in the order they are added. The default order is ascending; to
+// sort in descending order prefix the fieldName with a minus sign (-).
+func (q *Query) Order(fieldName string) *Query {
+	q = q.clone()
+	fieldName = strings.TrimSpace(fieldName)
+	order := Order{Property: fieldName}
+	if strings.HasPrefix(fieldName, "-") {
+		order.Property = strings.TrimSpace(fieldName[1:])
+		order.Descending = true
+	}
+	if order.Property == "" {
+		q.err = errors.New("nds: empty query order field name")
+		return q
+	}
+	q.kq.Orders = append(q.kq.Orders, order)
+	return q
+}
+
+// KeysOnly returns a derivative query that yields only keys, not keys and
+// entities, so the cache is not used at all.
+func (q *Query) KeysOnly() *Query {
+	q = q.clone()
+	q.keysOnly = true
+	return q
+}
+
+// Limit returns a derivative query that has a limit on the number of results
+// returned. A negative value means unlimited.
+func (q *Query) Limit(limit int) *Query {
+	q = q.clone()
+	q.limit = limit
+	return q
+}
+
+// Offset returns a derivative query that has an offset of how many keys to
+// skip over before returning results. A negative value is invalid.
+func (q *Query) Offset(offset int) *Query {
+	q = q.clone()
+	if offset < 0 {
+		q.err = errors.New("nds: negative query offset")
+		return q
+	}
+	q.kq.Offset = offset
+	return q
+}
+
+// Start returns a derivative query with the given start point.
+func (q *Query) Start(c Cursor) *Query {
+	q = q.clone()
+	q.kq.Start = c
+	return q
+}
+
+// End returns a derivative query with the given end point.
+func (q *Query) End(c Cursor) *Query {
+	q = q.clone()
+	q.kq.End = c
+	return q
+}
+
+// Run runs the query in the given context.
+func (q *Query) Run(c context.Context) *Iterator {
+	return q.run(c, iteratorBatchSize)
+}
+
+func (q *Query) run(c context.Context, batchSize int) *Iterator {
+	return &Iterator{
+		c:         c,
+		kq:        q.kq,
+		batchSize: batchSize,
+		remaining: q.limit,
+		keysOnly:  q.keysOnly,
+		start:     q.kq.Start,
+		offset:    q.kq.Offset,
+		err:       q.err,
+	}
+}
+
+// GetAll runs the query in the given context and returns all keys that match
+// that query, as well as appending the values to dst.
+//
+// dst must have type *[]S or *[]*S or *[]P, for some struct type S or some
+// non-interface, non-pointer type P such that P or *P implements
+// PropertyLoadSaver.
+//
+// As a special case, *PropertyList is an invalid type for dst, even though a
+// PropertyList is a slice of structs. It is treated as invalid to avoid being
+// mistakenly passed when *[]PropertyList was intended.
+//
+// The keys returned by GetAll will be in a 1-1 correspondence with the
+// entities added to dst.
+//
+// If q is a keys-only query, GetAll ignores dst and only returns the keys.
+func (q *Query) GetAll(c context.Context,
+	dst interface{}) ([]*datastore.Key, error) {
+
+	var dv reflect.Value
+	if !q.keysOnly {
+		dv = reflect.ValueOf(dst)
+		if dv.Kind() != reflect.Ptr || dv.IsNil() {
+			return nil, datastore.ErrInvalidEntityType
+		}
+		dv = dv.Elem()
+		if dv.Kind() != reflect.Slice || dv.Type() == typeOfPropertyList {
+			return nil, datastore.ErrInvalidEntityType
+		}
+		switch checkValueType(dv.Type().Elem()) {
+		case valueTypeInvalid, valueTypeInterface:
+			return nil, datastore.ErrInvalidEntityType
+		}
+	}
+
+	if _, ok := transactionFromContext(c); !ok && q.cacheExpiration > 0 {
+		keys, err := q.cachedKeys(c)
+		if err != nil || q.keysOnly {
+			return keys, err
+		}
+		return getAll(c, keys, dv)
+	}
+
+	keys := []*datastore.Key{}
+	var errFieldMismatch error
+	t := q.run(c, queryBatchSize)
+	for {
+		key, pl, err := t.next()
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if !q.keysOnly {
+			elem := reflect.New(dv.Type().Elem()).Elem()
+			if err := setValue(elem, pl); err != nil {
+				if _, ok := err.(*datastore.ErrFieldMismatch); !ok {
+					return nil, err
+				}
+				// Load the rest of the entities and return the first field
+				// mismatch error, as datastore.Query.GetAll does.
+				if errFieldMismatch == nil {
+					errFieldMismatch = err
+				}
+			}
+			dv.Set(reflect.Append(dv, elem))
+		}
+		keys = append(keys, key)
+	}
+	return keys, errFieldMismatch
+}
+
+// getAll loads the entities for keys and appends them to dv, skipping any
+// that no longer exist. It returns the keys of the entities appended.
+func getAll(c context.Context, keys []*datastore.Key,
+	dv reflect.Value) ([]*datastore.Key, error) {
+
+	if len(keys) == 0 {
+		return keys, nil
+	}
+
+	vals := reflect.MakeSlice(dv.Type(), len(keys), len(keys))
+	err := GetMulti(c, keys, vals.Interface())
+	me, isMultiErr := err.(appengine.MultiError)
+	if err != nil && !isMultiErr {
+		return nil, err
+	}
+
+	gotKeys := make([]*datastore.Key, 0, len(keys))
+	var errFieldMismatch error
+	for i, key := range keys {
+		if isMultiErr && me[i] != nil {
+			if me[i] == datastore.ErrNoSuchEntity {
+				continue
+			}
+			if _, ok := me[i].(*datastore.ErrFieldMismatch); !ok {
+				return nil, me[i]
+			}
+			if errFieldMismatch == nil {
+				errFieldMismatch = me[i]
+			}
+		}
+		dv.Set(reflect.Append(dv, vals.Index(i)))
+		gotKeys = append(gotKeys, key)
+	}
+	return gotKeys, errFieldMismatch
+}
+
+// Iterator is the result of running a query.
+type Iterator struct {
+	c         context.Context
+	kq        KeysQuery
+	batchSize int
+	keysOnly  bool
+
+	// remaining is the number of results left to fetch. A negative value
+	// means unlimited.
+	remaining int
+
+	// start and offset give the position of the first key of the current
+	// batch, from which cursors within the batch are calculated.
+	start  Cursor
+	offset int
+
+	keys    []*datastore.Key
+	pls     []datastore.PropertyList
+	errs    []error
+	i       int
+	end     Cursor
+	fetched bool
+	done    bool
+
+	err error
+}
+
+// Next returns the key of the next result. When there are no more results,
+// datastore.Done is returned as the error.
+//
+// If the query is not keys only and dst is non-nil, it also loads the entity
+// stored for that key into the struct pointer or PropertyLoadSaver dst, with
+// the same semantics and possible errors as for the Get function.
+func (t *Iterator) Next(dst interface{}) (*datastore.Key, error) {
+	key, pl, err := t.next()
+	if err != nil {
+		return nil, err
+	}
+	if dst != nil && !t.keysOnly {
+		err = setValue(reflect.ValueOf(&dst).Elem(), pl)
+	}
+	return key, err
+}
+
+func (t *Iterator) next() (*datastore.Key, datastore.PropertyList, error) {
+	for {
+		for t.err == nil && t.i >= len(t.keys) {
+			if t.done {
+				return nil, nil, datastore.Done
+			}
+			t.err = t.fetch()
+		}
+		if t.err != nil {
+			return nil, nil, t.err
+		}
+
+		i := t.i
+		t.i++
+		switch t.errs[i] {
+		case nil:
+			return t.keys[i], t.pls[i], nil
+		case datastore.ErrNoSuchEntity:
+			// The entity has been deleted since the query ran so skip it.
+		default:
+			return nil, nil, t.errs[i]
+		}
+	}
+}
+
+// fetch gets the next batch of keys from the datastore and loads their
+// entities through the cache.
+func (t *Iterator) fetch() error {
+	limit := t.batchSize
+	if t.remaining >= 0 && t.remaining < limit {
+		limit = t.remaining
+	}
+	if limit == 0 {
+		t.done = true
+		return nil
+	}
+
+	if t.fetched {
+		t.start, t.offset = t.end, 0
+	}
+	kq := t.kq
+	kq.Start, kq.Offset, kq.Limit = t.start, t.offset, limit
+
+	keys, end, err := clientFromContext(t.c).datastore.QueryKeys(t.c, &kq)
+	if err != nil {
+		return err
+	}
+	t.keys, t.end, t.i, t.fetched = keys, end, 0, true
+
+	if t.remaining >= 0 {
+		t.remaining -= len(keys)
+	}
+	if len(keys) < limit || t.remaining == 0 {
+		t.done = true
+	}
+
+	t.pls = make([]datastore.PropertyList, len(keys))
+	t.errs = make([]error, len(keys))
+	if t.keysOnly || len(keys) == 0 {
+		return nil
+	}
+
+	vals := make([]interface{}, len(keys))
+	for i := range t.pls {
+		vals[i] = &t.pls[i]
+	}
+	if err := GetMulti(t.c, keys, vals); err != nil {
+		me, ok := err.(appengine.MultiError)
+		if !ok {
+			return err
+		}
+		copy(t.errs, me)
+	}
+	return nil
+}
+
+// Cursor returns a cursor for the iterator's current location.
+func (t *Iterator) Cursor() (Cursor, error) {
+	if t.err != nil {
+		return "", t.err
+	}
+
+	switch {
+	case t.fetched && t.i == len(t.keys):
+		return t.end, nil
+	case t.offset+t.i == 0:
+		return t.start, nil
+	}
+
+	// Otherwise find the cursor by skipping to the current location from the
+	// start of the batch, as datastore.Iterator does.
+	kq := t.kq
+	kq.Start, kq.Offset, kq.Limit = t.start, t.offset+t.i, 0
+	_, cursor, err := clientFromContext(t.c).datastore.QueryKeys(t.c, &kq)
+	return cursor, err
+}
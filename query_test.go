@@ -0,0 +1,358 @@
+package nds_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/qedus/nds"
+	"github.com/qedus/nds/ndstest"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+type queryEntity struct {
+	IntVal int64
+	Tags   []string
+}
+
+func putQueryEntities(t *testing.T, n int) (context.Context,
+	*ndstest.Datastore, *ndstest.Cache, []*datastore.Key) {
+
+	c := context.Background()
+	d, cache := ndstest.NewDatastore(), ndstest.NewCache()
+	ndstest.Install(t, d, cache)
+
+	keys := make([]*datastore.Key, n)
+	entities := make([]queryEntity, n)
+	for i := range keys {
+		keys[i] = datastore.NewKey(c, "Entity", "", int64(i+1), nil)
+		entities[i] = queryEntity{
+			IntVal: int64(i),
+			Tags:   []string{"all", []string{"even", "odd"}[i%2]},
+		}
+	}
+	if _, err := nds.PutMulti(c, keys, entities); err != nil {
+		t.Fatal(err)
+	}
+	return c, d, cache, keys
+}
+
+func TestQueryGetAll(t *testing.T) {
+	c, _, cache, keys := putQueryEntities(t, 10)
+
+	q := nds.NewQuery("Entity").Filter("IntVal >=", 2).
+		Filter("Tags =", "even").Order("-IntVal")
+	for i := 0; i < 2; i++ {
+		entities := []queryEntity{}
+		gotKeys, err := q.GetAll(c, &entities)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(gotKeys) != 4 || len(entities) != 4 {
+			t.Fatal("incorrect results", len(gotKeys), len(entities))
+		}
+		for j, want := range []int64{8, 6, 4, 2} {
+			if entities[j].IntVal != want {
+				t.Fatal("incorrect IntVal", entities[j].IntVal)
+			}
+			if !gotKeys[j].Equal(keys[want]) {
+				t.Fatal("incorrect key", gotKeys[j])
+			}
+		}
+
+		// The entities must now be served from the cache, along with the
+		// epochs of their namespace and kind.
+		if cache.Len() != 6 {
+			t.Fatal("expected cached entities", cache.Len())
+		}
+	}
+}
+
+func TestQueryGetAllTypes(t *testing.T) {
+	c, _, _, _ := putQueryEntities(t, 3)
+	q := nds.NewQuery("Entity")
+
+	ptrs := []*queryEntity{}
+	if _, err := q.GetAll(c, &ptrs); err != nil {
+		t.Fatal(err)
+	}
+	if len(ptrs) != 3 || ptrs[2].IntVal != 2 {
+		t.Fatal("incorrect entities", ptrs)
+	}
+
+	pls := []datastore.PropertyList{}
+	if _, err := q.GetAll(c, &pls); err != nil {
+		t.Fatal(err)
+	}
+	if len(pls) != 3 {
+		t.Fatal("incorrect entities", pls)
+	}
+
+	keys, err := q.KeysOnly().GetAll(c, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 3 {
+		t.Fatal("incorrect keys", keys)
+	}
+
+	invalid := []interface{}{
+		nil,
+		[]queryEntity{},
+		&datastore.PropertyList{},
+		&[]interface{}{},
+		&[]int{},
+	}
+	for _, dst := range invalid {
+		if _, err := q.GetAll(c, dst); err != datastore.ErrInvalidEntityType {
+			t.Fatal("expected ErrInvalidEntityType", dst, err)
+		}
+	}
+}
+
+func TestQueryLimitOffset(t *testing.T) {
+	c, _, _, keys := putQueryEntities(t, 10)
+
+	gotKeys, err := nds.NewQuery("Entity").Order("IntVal").
+		Offset(3).Limit(4).KeysOnly().GetAll(c, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(gotKeys) != 4 {
+		t.Fatal("incorrect keys", gotKeys)
+	}
+	for i, key := range gotKeys {
+		if !key.Equal(keys[i+3]) {
+			t.Fatal("incorrect key", key)
+		}
+	}
+
+	if gotKeys, err := nds.NewQuery("Entity").Limit(0).KeysOnly().GetAll(c,
+		nil); err != nil {
+		t.Fatal(err)
+	} else if len(gotKeys) != 0 {
+		t.Fatal("expected no keys", gotKeys)
+	}
+}
+
+func TestQueryIteratorCursor(t *testing.T) {
+	c, _, _, keys := putQueryEntities(t, 10)
+
+	q := nds.NewQuery("Entity").Order("IntVal").Offset(1)
+	it := q.Run(c)
+	for i := 0; i < 3; i++ {
+		entity := &queryEntity{}
+		key, err := it.Next(entity)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !key.Equal(keys[i+1]) || entity.IntVal != int64(i+1) {
+			t.Fatal("incorrect result", key, entity)
+		}
+	}
+
+	cursor, err := it.Cursor()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	it = nds.NewQuery("Entity").Order("IntVal").Start(cursor).Run(c)
+	for i := 4; i < 10; i++ {
+		entity := &queryEntity{}
+		if _, err := it.Next(entity); err != nil {
+			t.Fatal(err)
+		}
+		if entity.IntVal != int64(i) {
+			t.Fatal("incorrect IntVal", entity.IntVal)
+		}
+	}
+	if _, err := it.Next(&queryEntity{}); err != datastore.Done {
+		t.Fatal("expected Done", err)
+	}
+	if cursor, err := it.Cursor(); err != nil {
+		t.Fatal(err)
+	} else if cursor == "" {
+		t.Fatal("expected cursor")
+	}
+}
+
+// staleIndexDatastore runs queries against a different Datastore as if the
+// query index had not yet caught up with changes.
+type staleIndexDatastore struct {
+	*ndstest.Datastore
+	index *ndstest.Datastore
+}
+
+func (d staleIndexDatastore) QueryKeys(c context.Context,
+	q *nds.KeysQuery) ([]*datastore.Key, nds.Cursor, error) {
+	return d.index.QueryKeys(c, q)
+}
+
+func TestQueryDeletedEntities(t *testing.T) {
+	c, d, cache, keys := putQueryEntities(t, 5)
+
+	pls := make([]datastore.PropertyList, len(keys))
+	if err := d.GetMulti(c, keys, pls); err != nil {
+		t.Fatal(err)
+	}
+	index := ndstest.NewDatastore()
+	if _, err := index.PutMulti(c, keys, pls); err != nil {
+		t.Fatal(err)
+	}
+	if err := nds.DeleteMulti(c, keys[1:3]); err != nil {
+		t.Fatal(err)
+	}
+	ndstest.Install(t, staleIndexDatastore{d, index}, cache)
+
+	entities := []queryEntity{}
+	gotKeys, err := nds.NewQuery("Entity").GetAll(c, &entities)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(gotKeys) != 3 || len(entities) != 3 {
+		t.Fatal("incorrect results", len(gotKeys), len(entities))
+	}
+
+	count := 0
+	it := nds.NewQuery("Entity").Run(c)
+	for {
+		_, err := it.Next(&queryEntity{})
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		count++
+	}
+	if count != 3 {
+		t.Fatal("incorrect count", count)
+	}
+}
+
+func TestQueryInvalid(t *testing.T) {
+	c, _, _, _ := putQueryEntities(t, 1)
+
+	queries := []*nds.Query{
+		nds.NewQuery("Entity").Filter("IntVal !=", 1),
+		nds.NewQuery("Entity").Filter("", 1),
+		nds.NewQuery("Entity").Order("-"),
+		nds.NewQuery("Entity").Offset(-1),
+		nds.NewQuery("Entity").Ancestor(nil),
+	}
+	for i, q := range queries {
+		if _, err := q.KeysOnly().GetAll(c, nil); err == nil {
+			t.Fatal(i, "expected error")
+		}
+		if _, err := q.Run(c).Next(nil); err == nil {
+			t.Fatal(i, "expected error")
+		}
+	}
+}
+
+// countingDatastore counts the queries run and the entities got, and records
+// the largest GetMulti call.
+type countingDatastore struct {
+	*ndstest.Datastore
+	sync.Mutex
+	queries int
+	gets    int
+	maxGets int
+}
+
+func (d *countingDatastore) GetMulti(c context.Context,
+	keys []*datastore.Key, vals []datastore.PropertyList) error {
+	d.Lock()
+	d.gets += len(keys)
+	if len(keys) > d.maxGets {
+		d.maxGets = len(keys)
+	}
+	d.Unlock()
+	return d.Datastore.GetMulti(c, keys, vals)
+}
+
+func (d *countingDatastore) QueryKeys(c context.Context,
+	q *nds.KeysQuery) ([]*datastore.Key, nds.Cursor, error) {
+	d.queries++
+	return d.Datastore.QueryKeys(c, q)
+}
+
+func TestQueryCacheKeys(t *testing.T) {
+	c, d, cache, keys := putQueryEntities(t, 4)
+	cd := &countingDatastore{Datastore: d}
+	ndstest.Install(t, cd, cache)
+
+	q := nds.NewQuery("Entity").Filter("Tags =", "even").CacheKeys(time.Hour)
+	getAll := func(want int, queries int) {
+		t.Helper()
+		entities := []queryEntity{}
+		gotKeys, err := q.GetAll(c, &entities)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(gotKeys) != want || len(entities) != want {
+			t.Fatal("incorrect results", len(gotKeys), len(entities))
+		}
+		if cd.queries != queries {
+			t.Fatal("incorrect queries", cd.queries)
+		}
+	}
+
+	getAll(2, 1)
+	getAll(2, 1)
+
+	// Different queries are cached separately.
+	if keys, err := nds.NewQuery("Entity").Filter("Tags =", "odd").
+		CacheKeys(time.Hour).KeysOnly().GetAll(c, nil); err != nil {
+		t.Fatal(err)
+	} else if len(keys) != 2 {
+		t.Fatal("incorrect keys", keys)
+	}
+	getAll(2, 2)
+
+	// Puts invalidate cached keys straight away.
+	newKey := datastore.NewKey(c, "Entity", "", 100, nil)
+	if _, err := nds.Put(c, newKey, &queryEntity{
+		Tags: []string{"even"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	getAll(3, 3)
+	getAll(3, 3)
+
+	// Puts of other kinds do not.
+	if _, err := nds.Put(c, datastore.NewKey(c, "Other", "", 1, nil),
+		&queryEntity{}); err != nil {
+		t.Fatal(err)
+	}
+	getAll(3, 3)
+
+	// Keys are not cached while deletes hold their locks.
+	if err := nds.Delete(c, keys[0]); err != nil {
+		t.Fatal(err)
+	}
+	getAll(2, 4)
+	getAll(2, 5)
+	cache.Advance(time.Minute)
+	getAll(2, 6)
+	getAll(2, 6)
+
+	// Transactions invalidate cached keys when they commit.
+	if err := nds.RunInTransaction(c, func(tc context.Context) error {
+		_, err := nds.Put(tc, keys[1], &queryEntity{
+			Tags: []string{"even"},
+		})
+		return err
+	}, nil); err != nil {
+		t.Fatal(err)
+	}
+	getAll(3, 7)
+	cache.Advance(time.Minute)
+	getAll(3, 8)
+	getAll(3, 8)
+
+	// Cached keys expire.
+	cache.Advance(time.Hour)
+	getAll(3, 9)
+}
@@ -0,0 +1,285 @@
+package nds
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// memcacheMaxItemSize is the App Engine memcache limit on the size of an
+// item's value. Query results larger than this are not cached.
+const memcacheMaxItemSize = 1 << 20
+
+// generationSize is the size of the random value identifying a generation.
+const generationSize = 8
+
+// CacheKeys returns a derivative query whose result keys are cached for at
+// most expiration by GetAll. Only the keys are cached; entities are still
+// loaded in the same way as GetMulti.
+//
+// Cached keys are invalidated whenever Put, Delete or RunInTransaction change
+// an entity of the query's kind in the query's namespace. Queries are only
+// cached while no such change is in progress, so results are not cached for
+// up to the Config's LockTime after a Delete or RunInTransaction changes the
+// kind.
+// Non-ancestor queries are eventually consistent and a query run just after
+// a change may not reflect it. Such results can be cached for up to
+// expiration so it should be kept short.
+//
+// Cached keys are not used within transactions or by Run.
+func (q *Query) CacheKeys(expiration time.Duration) *Query {
+	q = q.clone()
+	q.cacheExpiration = expiration
+	return q
+}
+
+// createGenerationKey returns the cache key of the item whose value
+// identifies the current generation of entities of kind in namespace. Any
+// change to the entities removes or locks the item. The application ID is
+// not included as it is not always known consistently outside of App Engine;
+// sharing generations between applications only causes extra invalidations.
+func createGenerationKey(cfg *Config, prefix, namespace,
+	kind string) string {
+
+	generationKey := prefix + "G:" + strconv.Quote(namespace) +
+		strconv.Quote(kind)
+	if len(generationKey) > cfg.maxKeySize() {
+		hash := sha1.Sum([]byte(generationKey))
+		generationKey = hex.EncodeToString(hash[:])
+	}
+	return generationKey
+}
+
+// generationLockItems returns lock items for the generations of the kinds of
+// keys, which must be set before any of the entities are changed.
+func generationLockItems(cfg *Config, keys []*datastore.Key) []*Item {
+	items := []*Item{}
+	seen := map[string]bool{}
+	for _, prefix := range cfg.lockPrefixes() {
+		for _, key := range keys {
+			if key == nil {
+				continue
+			}
+			generationKey := createGenerationKey(cfg, prefix,
+				key.Namespace(), key.Kind())
+			if seen[generationKey] {
+				continue
+			}
+			seen[generationKey] = true
+			items = append(items, &Item{
+				Key:        generationKey,
+				Flags:      lockItem,
+				Value:      itemLock(),
+				Expiration: cfg.lockTime(),
+			})
+		}
+	}
+	return items
+}
+
+func newGeneration() []byte {
+	b := make([]byte, generationSize)
+	binary.LittleEndian.PutUint64(b, uint64(rand.Int63()))
+	return b
+}
+
+// canonicalQuery encodes kq such that two queries have the same encoding
+// only if they return the same results.
+func canonicalQuery(appID, namespace string, kq KeysQuery, limit int) string {
+	parts := []string{
+		appID,
+		namespace,
+		kq.Kind,
+		strconv.Itoa(kq.Offset),
+		strconv.Itoa(limit),
+		string(kq.Start),
+		string(kq.End),
+		strconv.FormatBool(kq.EventualConsistency),
+	}
+	if kq.Ancestor != nil {
+		parts = append(parts, "ancestor", kq.Ancestor.Encode())
+	}
+	for _, f := range kq.Filters {
+		parts = append(parts, "filter", f.Property, f.Operator,
+			canonicalValue(f.Value))
+	}
+	for _, o := range kq.Orders {
+		parts = append(parts, "order", o.Property,
+			strconv.FormatBool(o.Descending))
+	}
+
+	for i, part := range parts {
+		parts[i] = strconv.Quote(part)
+	}
+	return strings.Join(parts, " ")
+}
+
+func canonicalValue(v interface{}) string {
+	switch v := v.(type) {
+	case *datastore.Key:
+		if v == nil {
+			return "*datastore.Key(nil)"
+		}
+		return "*datastore.Key:" + v.Encode()
+	case time.Time:
+		return "time.Time:" + v.UTC().Format(time.RFC3339Nano)
+	}
+	return fmt.Sprintf("%T:%v", v, v)
+}
+
+// queryNamespace returns the application ID and namespace that q runs in.
+func queryNamespace(c context.Context, kq KeysQuery) (appID,
+	namespace string) {
+
+	if kq.Ancestor != nil {
+		return kq.Ancestor.AppID(), kq.Ancestor.Namespace()
+	}
+
+	// Outside of App Engine datastore.NewKey panics if the application ID is
+	// not in the environment, in which case there is no namespace in c.
+	defer func() {
+		if recover() != nil {
+			appID, namespace = "", kq.Namespace
+		}
+	}()
+
+	// There is no other way of getting them from the context.
+	key := datastore.NewKey(c, "Query", "", 1, nil)
+	if kq.Namespace != "" {
+		return key.AppID(), kq.Namespace
+	}
+	return key.AppID(), key.Namespace()
+}
+
+func encodeQueryKeys(generation []byte, keys []*datastore.Key) []byte {
+	buf := bytes.NewBuffer(generation)
+	for _, key := range keys {
+		buf.WriteString(key.Encode())
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
+
+func decodeQueryKeys(generation,
+	value []byte) ([]*datastore.Key, bool) {
+
+	if !bytes.HasPrefix(value, generation) {
+		return nil, false
+	}
+
+	keys := []*datastore.Key{}
+	for _, encoded := range strings.Split(
+		string(value[len(generation):]), "\n") {
+
+		if encoded == "" {
+			continue
+		}
+		key, err := datastore.DecodeKey(encoded)
+		if err != nil {
+			return nil, false
+		}
+		keys = append(keys, key)
+	}
+	return keys, true
+}
+
+// cachedKeys returns the keys of q's results from the cache, or from the
+// datastore if they are not cached, in which case they are then cached.
+func (q *Query) cachedKeys(c context.Context) ([]*datastore.Key, error) {
+	cl := clientFromContext(c)
+	memcacheCtx, err := cl.cache.NewContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	appID, namespace := queryNamespace(c, q.kq)
+	cfg := configFromContext(c)
+	generationKey := createGenerationKey(cfg, cfg.prefix(), namespace,
+		q.kq.Kind)
+	hash := sha1.Sum([]byte(canonicalQuery(appID, namespace, q.kq, q.limit)))
+	queryKey := cfg.prefix() + "Q:" + hex.EncodeToString(hash[:])
+
+	items, err := cl.cache.GetMulti(memcacheCtx,
+		[]string{generationKey, queryKey})
+	if err != nil {
+		warningf(c, "nds:cachedKeys GetMulti %s", err)
+		return q.queryKeys(c)
+	}
+
+	generation, ok := items[generationKey]
+	if ok && generation.Flags == generationItem {
+		if item, ok := items[queryKey]; ok && item.Flags == queryItem {
+			if keys, ok := decodeQueryKeys(generation.Value,
+				item.Value); ok {
+				return keys, nil
+			}
+		}
+	} else if !ok {
+		// Start a new generation. If another query has already started one
+		// then use that instead, so any error is ignored as the generation is
+		// read back anyway.
+		cl.cache.AddMulti(memcacheCtx, []*Item{{
+			Key:   generationKey,
+			Flags: generationItem,
+			Value: newGeneration(),
+		}})
+		items, err := cl.cache.GetMulti(memcacheCtx, []string{generationKey})
+		if err != nil {
+			warningf(c, "nds:cachedKeys GetMulti %s", err)
+			return q.queryKeys(c)
+		}
+		generation, ok = items[generationKey]
+	}
+
+	keys, err := q.queryKeys(c)
+	if err != nil {
+		return nil, err
+	}
+
+	// Entities of the kind are being changed, so the results may be stale.
+	if !ok || generation.Flags != generationItem {
+		return keys, nil
+	}
+
+	// The results are tagged with the generation read before the query ran.
+	// If the entities change before the results are cached, the generation
+	// is removed and the results are never used.
+	value := encodeQueryKeys(generation.Value, keys)
+	if len(value) > memcacheMaxItemSize {
+		return keys, nil
+	}
+	if err := cl.cache.SetMulti(memcacheCtx, []*Item{{
+		Key:        queryKey,
+		Flags:      queryItem,
+		Value:      value,
+		Expiration: q.cacheExpiration,
+	}}); err != nil {
+		warningf(c, "nds:cachedKeys SetMulti %s", err)
+	}
+	return keys, nil
+}
+
+// queryKeys returns the keys of q's results from the datastore.
+func (q *Query) queryKeys(c context.Context) ([]*datastore.Key, error) {
+	keys := []*datastore.Key{}
+	t := q.KeysOnly().run(c, queryBatchSize)
+	for {
+		key, _, err := t.next()
+		if err == datastore.Done {
+			return keys, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+}
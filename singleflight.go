@@ -0,0 +1,191 @@
+package nds
+
+import (
+	"bytes"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	// loadLockFlag is set in the Flags of the lock items Get and GetMulti
+	// write while they load entities into the Cache. Only these locks are
+	// waited for, as the locks written by Put, Delete, RunInTransaction and
+	// the Invalidate functions are never replaced by cached entities.
+	loadLockFlag uint32 = 1 << 12
+
+	// lockPollDelay is the initial delay between polls of the Cache for
+	// entities locked by calls on other instances. It doubles after each poll
+	// up to maxLockPollDelay.
+	lockPollDelay    = 10 * time.Millisecond
+	maxLockPollDelay = 200 * time.Millisecond
+)
+
+// loadLock returns the lock held by item if it was written by a call loading
+// an entity into the Cache, or nil otherwise.
+func loadLock(item *Item) []byte {
+	if item.Flags&loadLockFlag == 0 {
+		return nil
+	}
+	return item.Value
+}
+
+// flight is the loading of an entity into the Cache by a call on this
+// instance, which holds lock on the entity in the Cache until done is closed.
+type flight struct {
+	lock []byte
+	done chan struct{}
+}
+
+type flightKey struct {
+	client      *Client
+	memcacheKey string
+}
+
+// flights are the flights in progress on this instance.
+var flights = struct {
+	sync.Mutex
+	m map[flightKey]*flight
+}{m: map[flightKey]*flight{}}
+
+// startFlight records that the call holding lock is loading the entity of
+// memcacheKey into the Cache. It returns nil if another call on this instance
+// already is.
+func startFlight(c context.Context, memcacheKey string, lock []byte) *flight {
+	k := flightKey{clientFromContext(c), memcacheKey}
+	flights.Lock()
+	defer flights.Unlock()
+	if _, ok := flights.m[k]; ok {
+		return nil
+	}
+	f := &flight{lock: lock, done: make(chan struct{})}
+	flights.m[k] = f
+	return f
+}
+
+// findFlight returns the flight of the call on this instance holding lock on
+// the entity of memcacheKey, or nil if the lock is held by another instance.
+func findFlight(c context.Context, memcacheKey string, lock []byte) *flight {
+	k := flightKey{clientFromContext(c), memcacheKey}
+	flights.Lock()
+	defer flights.Unlock()
+	if f, ok := flights.m[k]; ok && bytes.Equal(f.lock, lock) {
+		return f
+	}
+	return nil
+}
+
+// finishFlights ends the flights started by cacheItems, waking the calls
+// waiting for them.
+func finishFlights(c context.Context, cacheItems []cacheItem) {
+	cl := clientFromContext(c)
+	flights.Lock()
+	defer flights.Unlock()
+	for i, cacheItem := range cacheItems {
+		if cacheItem.flight == nil {
+			continue
+		}
+		k := flightKey{cl, cacheItem.memcacheKey}
+		if flights.m[k] == cacheItem.flight {
+			delete(flights.m, k)
+		}
+		close(cacheItem.flight.done)
+		cacheItems[i].flight = nil
+	}
+}
+
+// waitLocked marks the entities locked by other calls loading them into the
+// Cache to be waited for instead of loaded from the datastore. Entities
+// locked by calls on this instance are always waited for and those locked by
+// other instances only if poll is true. It reports whether any entities are
+// to be waited for.
+func waitLocked(c context.Context, cacheItems []cacheItem, poll bool) bool {
+	found := false
+	for i, cacheItem := range cacheItems {
+		if cacheItem.state != externalLock || cacheItem.lock == nil ||
+			cacheItem.policy&SkipCacheRead != 0 {
+			continue
+		}
+		f := findFlight(c, cacheItem.memcacheKey, cacheItem.lock)
+		if f == nil && !poll {
+			continue
+		}
+		cacheItems[i].state = waiting
+		cacheItems[i].wait = f
+		found = true
+	}
+	return found
+}
+
+// waitMemcache waits for the entities marked by waitLocked to be cached by
+// the calls that locked them and loads them from the Cache again. Entities
+// locked by calls on other instances are polled for until the Config's
+// LockWait has passed. It reports whether any of the entities still have to
+// be loaded from the datastore.
+//
+// Entities in the Cache are never stale so, unlike sharing the results of
+// other calls, this never returns entities older than the call.
+func waitMemcache(c context.Context, cacheItems []cacheItem) bool {
+	// Entities that have already been loaded from the datastore are done.
+	for i, cacheItem := range cacheItems {
+		switch cacheItem.state {
+		case internalLock, externalLock:
+			cacheItems[i].state = done
+		}
+	}
+
+	deadline := time.Now().Add(configFromContext(c).LockWait)
+	delay := lockPollDelay
+	for {
+		poll := false
+		for _, cacheItem := range cacheItems {
+			if cacheItem.state != waiting {
+				continue
+			}
+			if cacheItem.wait == nil {
+				poll = true
+				continue
+			}
+			select {
+			case <-cacheItem.wait.done:
+			case <-c.Done():
+			}
+		}
+
+		if poll {
+			if d := deadline.Sub(time.Now()); d < delay {
+				delay = d
+			}
+			select {
+			case <-time.After(delay):
+			case <-c.Done():
+			}
+			if delay *= 2; delay > maxLockPollDelay {
+				delay = maxLockPollDelay
+			}
+		}
+
+		for i, cacheItem := range cacheItems {
+			if cacheItem.state == waiting {
+				cacheItems[i].state = miss
+				cacheItems[i].lock = nil
+				cacheItems[i].wait = nil
+			}
+		}
+		loadMemcache(c, cacheItems)
+
+		if c.Err() != nil || !time.Now().Before(deadline) ||
+			!waitLocked(c, cacheItems, true) {
+			break
+		}
+	}
+
+	for _, cacheItem := range cacheItems {
+		switch cacheItem.state {
+		case miss, externalLock:
+			return true
+		}
+	}
+	return false
+}
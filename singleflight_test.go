@@ -0,0 +1,207 @@
+package nds_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/qedus/nds"
+	"github.com/qedus/nds/ndstest"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// blockingDatastore blocks the first GetMulti until release is closed.
+type blockingDatastore struct {
+	countingDatastore
+	once    sync.Once
+	started chan struct{}
+	release chan struct{}
+
+	// locks receives a value each time a Cache returned by watch returns a
+	// lock item.
+	locks chan struct{}
+}
+
+// lockWatchingCache signals each lock item it returns on locks.
+type lockWatchingCache struct {
+	nds.Cache
+	locks chan struct{}
+}
+
+func (c lockWatchingCache) GetMulti(ctx context.Context,
+	keys []string) (map[string]*nds.Item, error) {
+
+	items, err := c.Cache.GetMulti(ctx, keys)
+	for _, item := range items {
+		if item.Flags&nds.ItemTypeMask == nds.LockItem {
+			c.locks <- struct{}{}
+		}
+	}
+	return items, err
+}
+
+// watch returns a Cache that signals d.locks whenever cache returns a lock
+// item.
+func (d *blockingDatastore) watch(cache nds.Cache) nds.Cache {
+	return lockWatchingCache{Cache: cache, locks: d.locks}
+}
+
+// newBlockingDatastore returns a blockingDatastore holding an entity at key.
+func newBlockingDatastore(t *testing.T, c context.Context,
+	key *datastore.Key) *blockingDatastore {
+
+	d := &blockingDatastore{
+		countingDatastore: countingDatastore{
+			Datastore: ndstest.NewDatastore(),
+		},
+		started: make(chan struct{}),
+		release: make(chan struct{}),
+		locks:   make(chan struct{}, 100),
+	}
+	if _, err := d.PutMulti(c, []*datastore.Key{key},
+		[]datastore.PropertyList{{{Name: "Text", Value: "text"}}}); err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func (d *blockingDatastore) GetMulti(c context.Context,
+	keys []*datastore.Key, vals []datastore.PropertyList) error {
+	if len(keys) > 0 {
+		d.once.Do(func() {
+			close(d.started)
+			<-d.release
+		})
+	}
+	return d.countingDatastore.GetMulti(c, keys, vals)
+}
+
+// getConcurrently gets key from each client at once while the first client's
+// datastore read is blocked, releasing it once each of the other clients has
+// seen the first client's lock. The clients' Caches must be watched by d.
+func getConcurrently(t *testing.T, c context.Context, d *blockingDatastore,
+	key *datastore.Key, clients ...*nds.Client) {
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(clients))
+	got := make([]textEntity, len(clients))
+	get := func(i int) {
+		errs[i] = clients[i].Get(c, key, &got[i])
+		wg.Done()
+	}
+
+	wg.Add(len(clients))
+	go get(0)
+	<-d.started
+	// The first client has seen its own lock.
+	for len(d.locks) > 0 {
+		<-d.locks
+	}
+	for i := 1; i < len(clients); i++ {
+		go get(i)
+	}
+	for i := 1; i < len(clients); i++ {
+		<-d.locks
+	}
+	close(d.release)
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got[i].Text != "text" {
+			t.Fatal("incorrect entity", got[i])
+		}
+	}
+}
+
+func TestSingleflight(t *testing.T) {
+	c := ndstest.NewContext(t)
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	d := newBlockingDatastore(t, c, key)
+	cl := nds.NewClient(d, d.watch(ndstest.NewCache()), nds.Config{
+		Logger: testLogger(t),
+	})
+
+	clients := make([]*nds.Client, 10)
+	for i := range clients {
+		clients[i] = cl
+	}
+	getConcurrently(t, c, d, key, clients...)
+
+	// Concurrent misses on the instance shared a single datastore read.
+	if d.gets != 1 {
+		t.Fatal("incorrect gets", d.gets)
+	}
+}
+
+func TestLockWait(t *testing.T) {
+	c := ndstest.NewContext(t)
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+
+	for _, test := range []struct {
+		lockWait time.Duration
+		gets     int
+	}{
+		{0, 2},
+		{time.Minute, 1},
+	} {
+		d := newBlockingDatastore(t, c, key)
+
+		// Clients sharing a Cache and Datastore act as separate instances.
+		cache := d.watch(ndstest.NewCache())
+		cfg := nds.Config{LockWait: test.lockWait, Logger: testLogger(t)}
+		getConcurrently(t, c, d, key, nds.NewClient(d, cache, cfg),
+			nds.NewClient(d, cache, cfg))
+
+		if d.gets != test.gets {
+			t.Fatal("incorrect gets", test.lockWait, d.gets)
+		}
+	}
+}
+
+func TestLockWaitWriteLocks(t *testing.T) {
+	c := ndstest.NewContext(t)
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	cl := nds.NewClient(ndstest.NewDatastore(), ndstest.NewCache(), nds.Config{
+		LockWait: time.Minute,
+		Logger:   testLogger(t),
+	})
+
+	// The locks left by changes are never replaced by cached entities so
+	// calls do not wait for them.
+	get := func(text string) {
+		t.Helper()
+		start := time.Now()
+		entity := &textEntity{}
+		err := cl.Get(c, key, entity)
+		if text == "" && err != datastore.ErrNoSuchEntity {
+			t.Fatal("expected ErrNoSuchEntity", err)
+		} else if text != "" && (err != nil || entity.Text != text) {
+			t.Fatal("incorrect entity", entity, err)
+		}
+		if d := time.Since(start); d > time.Second {
+			t.Fatal("waited for lock", d)
+		}
+	}
+
+	if _, err := cl.Put(c, key, &textEntity{"text"}); err != nil {
+		t.Fatal(err)
+	}
+	get("text")
+	if err := cl.Delete(c, key); err != nil {
+		t.Fatal(err)
+	}
+	get("")
+	get("")
+
+	if err := cl.RunInTransaction(c, func(tc context.Context) error {
+		_, err := nds.Put(tc, key, &textEntity{"tx"})
+		return err
+	}, nil); err != nil {
+		t.Fatal(err)
+	}
+	get("tx")
+}
@@ -5,14 +5,13 @@ import (
 
 	"golang.org/x/net/context"
 	"google.golang.org/appengine/datastore"
-	"google.golang.org/appengine/memcache"
 )
 
 var transactionKey = "used for *transaction"
 
 type transaction struct {
 	sync.Mutex
-	lockMemcacheItems []*memcache.Item
+	lockMemcacheItems []*Item
 }
 
 func transactionFromContext(c context.Context) (*transaction, bool) {
@@ -26,8 +25,10 @@ func transactionFromContext(c context.Context) (*transaction, bool) {
 func RunInTransaction(c context.Context, f func(tc context.Context) error,
 	opts *datastore.TransactionOptions) error {
 
-	return datastore.RunInTransaction(c, func(tc context.Context) error {
-		tx := &transaction{}
+	cl := clientFromContext(c)
+	var tx *transaction
+	err := cl.datastore.RunInTransaction(c, func(tc context.Context) error {
+		tx = &transaction{}
 		tc = context.WithValue(tc, &transactionKey, tx)
 		if err := f(tc); err != nil {
 			return err
@@ -36,10 +37,17 @@ func RunInTransaction(c context.Context, f func(tc context.Context) error,
 		// tx.Unlock() is not called as the tx context should never be called
 		//again so we rather block than allow people to misuse the context.
 		tx.Lock()
-		memcacheCtx, err := memcacheContext(tc)
+		memcacheCtx, err := cl.cache.NewContext(tc)
 		if err != nil {
 			return err
 		}
-		return memcacheSetMulti(memcacheCtx, tx.lockMemcacheItems)
+		return cl.cache.SetMulti(memcacheCtx, tx.lockMemcacheItems)
 	}, opts)
+
+	// The transaction has committed, or failed, so entities loaded into the
+	// local cache while it was running could now be stale.
+	if tx != nil {
+		invalidateLocalCache(c, tx.lockMemcacheItems)
+	}
+	return err
 }
@@ -0,0 +1,109 @@
+package nds
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+// warmConcurrency is the default maximum number of batches Warm loads at
+// once.
+const warmConcurrency = 4
+
+var errWarmTransaction = errors.New("nds: Warm called within a transaction")
+
+// Warm loads the entities of keys into the cache, so that subsequent Get and
+// GetMulti calls are served from it, in the same way as GetMulti but without
+// loading the entities into values. Entities that are already cached are not
+// loaded from the datastore again. Keys are loaded in batches of the
+// Config's GetMultiLimit, at most WarmConcurrency of them at once, so Warm
+// can be used to prime a cache with many keys, for example after a
+// deployment or from a cron job. The absence of entities that do not exist
+// is cached too and not reported as an error. If any keys are nil or
+// incomplete nothing is loaded and an appengine.MultiError holding
+// datastore.ErrInvalidKey for each of them is returned.
+//
+// Warm cannot be called within a transaction.
+func Warm(c context.Context, keys []*datastore.Key) error {
+	if _, ok := transactionFromContext(c); ok {
+		return errWarmTransaction
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+
+	isInvalidErr, invalidErr := false, make(appengine.MultiError, len(keys))
+	for i, key := range keys {
+		if key == nil || key.Incomplete() {
+			isInvalidErr = true
+			invalidErr[i] = datastore.ErrInvalidKey
+		}
+	}
+	if isInvalidErr {
+		return invalidErr
+	}
+
+	cfg := configFromContext(c)
+	limit := cfg.getMultiLimit()
+	callCount := (len(keys)-1)/limit + 1
+	errs := make([]error, callCount)
+
+	var wg sync.WaitGroup
+	wg.Add(callCount)
+	sem := make(chan struct{}, cfg.warmConcurrency())
+	for i := 0; i < callCount; i++ {
+		lo := i * limit
+		hi := (i + 1) * limit
+		if hi > len(keys) {
+			hi = len(keys)
+		}
+
+		sem <- struct{}{}
+		go func(i int, keys []*datastore.Key) {
+			errs[i] = warmMulti(c, keys)
+			<-sem
+			wg.Done()
+		}(i, keys[lo:hi])
+	}
+	wg.Wait()
+
+	if isErrorsNil(errs) {
+		return nil
+	}
+
+	return groupErrors(errs, len(keys), limit)
+}
+
+// Warm loads the entities q returns into the cache as the package level Warm
+// does. Only the keys of q's results are loaded from the datastore by the
+// query itself.
+func (q *Query) Warm(c context.Context) error {
+	keys, err := q.KeysOnly().GetAll(c, nil)
+	if err != nil {
+		return err
+	}
+	return Warm(c, keys)
+}
+
+// warmMulti loads the entities of keys into the cache. Entities are loaded
+// into PropertyLists rather than values, so they do not need to match any
+// struct.
+func warmMulti(c context.Context, keys []*datastore.Key) error {
+	pls := make([]datastore.PropertyList, len(keys))
+	err := getMulti(c, keys, reflect.ValueOf(pls))
+	if me, ok := err.(appengine.MultiError); ok {
+		for i, e := range me {
+			if e == datastore.ErrNoSuchEntity {
+				me[i] = nil
+			}
+		}
+		if isErrorsNil(me) {
+			return nil
+		}
+	}
+	return err
+}
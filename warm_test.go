@@ -0,0 +1,102 @@
+package nds_test
+
+import (
+	"testing"
+
+	"github.com/qedus/nds"
+	"github.com/qedus/nds/ndstest"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestWarm(t *testing.T) {
+	d, cache := &countingDatastore{Datastore: ndstest.NewDatastore()},
+		ndstest.NewCache()
+	ndstest.Install(t, d, cache)
+	c := nds.WithConfig(context.Background(), nds.Config{
+		Logger:          testLogger(t),
+		GetMultiLimit:   2,
+		WarmConcurrency: 1,
+	})
+
+	keys := make([]*datastore.Key, 5)
+	entities := make([]textEntity, len(keys))
+	for i := range keys {
+		keys[i] = datastore.NewKey(c, "Entity", "", int64(i+1), nil)
+		entities[i].Text = "text"
+	}
+	if _, err := nds.PutMulti(c, keys, entities); err != nil {
+		t.Fatal(err)
+	}
+
+	// The absence of missing entities is cached without an error.
+	missingKey := datastore.NewKey(c, "Entity", "", 100, nil)
+	if err := nds.Warm(c, append(keys, missingKey)); err != nil {
+		t.Fatal(err)
+	}
+	if d.gets != 6 || d.maxGets != 2 {
+		t.Fatal("incorrect gets", d.gets, d.maxGets)
+	}
+
+	// Warmed entities are served from the cache.
+	got := make([]textEntity, len(keys))
+	if err := nds.GetMulti(c, keys, got); err != nil {
+		t.Fatal(err)
+	}
+	err := nds.Get(c, missingKey, &textEntity{})
+	if err != datastore.ErrNoSuchEntity {
+		t.Fatal("expected ErrNoSuchEntity", err)
+	}
+	if err := nds.Warm(c, keys); err != nil {
+		t.Fatal(err)
+	}
+	if d.gets != 6 {
+		t.Fatal("incorrect gets", d.gets)
+	}
+
+	// Invalid keys are reported without loading any entities.
+	invalidKeys := []*datastore.Key{keys[0], nil,
+		datastore.NewIncompleteKey(c, "Entity", nil)}
+	err = nds.Warm(c, invalidKeys)
+	me, ok := err.(appengine.MultiError)
+	if !ok {
+		t.Fatal("expected appengine.MultiError", err)
+	}
+	if me[0] != nil || me[1] != datastore.ErrInvalidKey ||
+		me[2] != datastore.ErrInvalidKey {
+		t.Fatal("incorrect errors", me)
+	}
+	if d.gets != 6 {
+		t.Fatal("incorrect gets", d.gets)
+	}
+
+	// Warm cannot be used in transactions.
+	if err := nds.RunInTransaction(c, func(tc context.Context) error {
+		return nds.Warm(tc, keys)
+	}, nil); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestQueryWarm(t *testing.T) {
+	c, _, cache, keys := putQueryEntities(t, 10)
+
+	q := nds.NewQuery("Entity").Filter("Tags =", "even")
+	if err := q.Warm(c); err != nil {
+		t.Fatal(err)
+	}
+
+	// The five even entities are cached along with the epochs of their
+	// namespace and kind.
+	if cache.Len() != 7 {
+		t.Fatal("incorrect cache length", cache.Len())
+	}
+	items, err := cache.GetMulti(c, []string{nds.CreateMemcacheKey(keys[0])})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 {
+		t.Fatal("entity not cached")
+	}
+}